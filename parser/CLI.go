@@ -15,6 +15,8 @@ const (
 	defaultPackagePath       = ""
 	defaultAppName           = ""
 	defaultDiffFileName      = "new-relic-instrumentation.diff"
+
+	defaultErrorStatusThreshold = 400 // the lowest status code the agent records as an error
 )
 
 type CLIConfig struct {
@@ -23,6 +25,13 @@ type CLIConfig struct {
 	AppName           string
 	AgentVariableName string
 	DiffFile          string
+
+	RewriteHttpMethods bool
+
+	UntracedExternalCalls string
+
+	ConfigFile   string
+	AgentOptions AgentOptions
 }
 
 func setConfigValue(input *string, defaultValue string) string {
@@ -32,6 +41,17 @@ func setConfigValue(input *string, defaultValue string) string {
 	return defaultValue
 }
 
+// splitList splits a comma separated flag value into its non-empty elements.
+func splitList(input string) []string {
+	list := []string{}
+	for _, element := range strings.Split(input, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			list = append(list, element)
+		}
+	}
+	return list
+}
+
 func NewCLIConfig() *CLIConfig {
 	wd, _ := os.Getwd()
 	diffFile := filepath.Join(wd, defaultDiffFileName)
@@ -45,18 +65,91 @@ func NewCLIConfig() *CLIConfig {
 	var appNameFlag = flag.String("name", defaultAppName, "configure the New Relic application name")
 	var diffFlag = flag.String("diff", relativePath, "output diff file path name")
 	var agentFlag = flag.String("agent", defaultAgentVariableName, "application variable for New Relic agent")
+	var rewriteHttpMethodsFlag = flag.Bool("rewrite-http-methods", false, "rewrite http.Get, http.Post, http.Head and http.PostForm calls in traced functions into requests that can be instrumented")
+	var errorStatusFlag = flag.Int("error-status-threshold", defaultErrorStatusThreshold, "lowest http status code written by handlers that is recorded as an error, from 400 to 599")
+	var untracedCallsFlag = flag.String("untraced-external-calls", untracedCallsReport, "how external calls made outside of a transaction are handled: report, transaction or ignore")
+	var configFlag = flag.String("config", "", "path to a JSON file with options to configure the New Relic application with; flags take precedence over it")
+	var distributedTracingFlag = flag.Bool("distributed-tracing", true, "enable distributed tracing in the New Relic application")
+	var codeLevelMetricsFlag = flag.Bool("code-level-metrics", false, "enable code level metrics in the New Relic application")
+	var logForwardingFlag = flag.Bool("log-forwarding", true, "enable forwarding application logs to New Relic")
+	var labelsFlag = flag.String("labels", "", "labels to add to the New Relic application, formatted as key1:value1;key2:value2")
+	var hostFlag = flag.String("host-display-name", "", "custom name of the host the New Relic application runs on")
+	var highSecurityFlag = flag.Bool("high-security", false, "enable high security mode in the New Relic application")
+	var debugLoggerFlag = flag.String("debug-logger", "", "write New Relic agent debug logs to stdout or stderr")
+	var enabledEnvFlag = flag.String("enabled-env", "", "environment variable that disables the New Relic agent when set to false")
+	var waitFlag = flag.Duration("wait-for-connection", 0, "how long main waits for the New Relic application to connect before it continues, ex: 5s")
+	var shutdownFlag = flag.Duration("shutdown-timeout", defaultShutdownTimeout, "how long the New Relic application has to send its data when the program exits")
+	var binariesFlag = flag.String("binaries", "", "comma separated directories of the binaries to instrument, relative to the application, ex: cmd/api,cmd/worker; all of them by default")
+	var excludeBinariesFlag = flag.String("exclude-binaries", "", "comma separated directories of the binaries not to instrument, relative to the application")
+	var onErrorFlag = flag.String("on-agent-error", agentErrorPanic, "how errors creating the New Relic application are handled: panic, log, ignore, exit or return; connection timeouts are logged unless ignored or exited on")
 	flag.Parse()
 
 	cfg.PackagePath = setConfigValue(pathFlag, defaultPackagePath)
 	cfg.AppName = setConfigValue(appNameFlag, defaultAppName)
 	cfg.DiffFile = setConfigValue(diffFlag, diffFile)
 	cfg.AgentVariableName = setConfigValue(agentFlag, defaultAgentVariableName)
+	cfg.RewriteHttpMethods = *rewriteHttpMethodsFlag
+	cfg.UntracedExternalCalls = setConfigValue(untracedCallsFlag, untracedCallsReport)
+	cfg.ConfigFile = setConfigValue(configFlag, "")
+
+	if cfg.ConfigFile != "" {
+		options, err := loadAgentOptions(cfg.ConfigFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.AgentOptions = options
+	}
+	// only flags set by the user override the config file, so that the agent defaults are kept otherwise
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "distributed-tracing":
+			cfg.AgentOptions.DistributedTracing = distributedTracingFlag
+		case "code-level-metrics":
+			cfg.AgentOptions.CodeLevelMetrics = codeLevelMetricsFlag
+		case "log-forwarding":
+			cfg.AgentOptions.AppLogForwarding = logForwardingFlag
+		case "labels":
+			labels, err := parseLabels(*labelsFlag)
+			if err != nil {
+				log.Fatal(err)
+			}
+			cfg.AgentOptions.Labels = labels
+		case "host-display-name":
+			cfg.AgentOptions.HostDisplayName = setConfigValue(hostFlag, "")
+		case "high-security":
+			cfg.AgentOptions.HighSecurity = *highSecurityFlag
+		case "debug-logger":
+			cfg.AgentOptions.DebugLogger = setConfigValue(debugLoggerFlag, "")
+		case "enabled-env":
+			cfg.AgentOptions.EnabledEnvVar = setConfigValue(enabledEnvFlag, "")
+		case "wait-for-connection":
+			cfg.AgentOptions.WaitForConnection = duration(*waitFlag)
+		case "shutdown-timeout":
+			cfg.AgentOptions.ShutdownTimeout = duration(*shutdownFlag)
+		case "binaries":
+			cfg.AgentOptions.Binaries = splitList(*binariesFlag)
+		case "exclude-binaries":
+			cfg.AgentOptions.ExcludeBinaries = splitList(*excludeBinariesFlag)
+		case "error-status-threshold":
+			cfg.AgentOptions.ErrorStatusThreshold = *errorStatusFlag
+		case "on-agent-error":
+			cfg.AgentOptions.OnError = setConfigValue(onErrorFlag, agentErrorPanic)
+		}
+	})
 
 	cfg.Validate()
 	return cfg
 }
 
 func (cfg *CLIConfig) Validate() {
+	switch cfg.UntracedExternalCalls {
+	case untracedCallsReport, untracedCallsTransaction, untracedCallsIgnore:
+	default:
+		log.Fatalf("untraced-external-calls flag must be one of: %s, %s, %s", untracedCallsReport, untracedCallsTransaction, untracedCallsIgnore)
+	}
+	if err := cfg.AgentOptions.Validate(); err != nil {
+		log.Fatal(err)
+	}
 	if cfg.PackagePath == "" {
 		log.Fatal("path flag is required")
 	}
@@ -5,6 +5,8 @@ import (
 	"go/ast"
 	"go/token"
 	"go/types"
+	"strconv"
+	"time"
 
 	"github.com/dave/dst"
 	"github.com/dave/dst/decorator"
@@ -15,7 +17,7 @@ func panicOnError() *dst.IfStmt {
 	return &dst.IfStmt{
 		Cond: &dst.BinaryExpr{
 			X: &dst.Ident{
-				Name: "err",
+				Name: agentErrVariable,
 			},
 			Op: token.NEQ,
 			Y: &dst.Ident{
@@ -31,7 +33,7 @@ func panicOnError() *dst.IfStmt {
 						},
 						Args: []dst.Expr{
 							&dst.Ident{
-								Name: "err",
+								Name: agentErrVariable,
 							},
 						},
 					},
@@ -46,15 +48,89 @@ func panicOnError() *dst.IfStmt {
 	}
 }
 
-func createAgentAST(AppName, AgentVariableName string) []dst.Stmt {
-	newappArgs := []dst.Expr{
-		&dst.CallExpr{
-			Fun: &dst.Ident{
-				Path: newrelicAgentImport,
-				Name: "ConfigFromEnvironment",
+// durationExpr creates an expression for a duration in the largest unit it is a multiple of, ex: 5 * time.Second
+func durationExpr(d time.Duration) dst.Expr {
+	units := []struct {
+		duration time.Duration
+		name     string
+	}{
+		{time.Hour, "Hour"},
+		{time.Minute, "Minute"},
+		{time.Second, "Second"},
+		{time.Millisecond, "Millisecond"},
+	}
+	for _, unit := range units {
+		if d%unit.duration == 0 {
+			return &dst.BinaryExpr{
+				X: &dst.BasicLit{
+					Kind:  token.INT,
+					Value: strconv.FormatInt(int64(d/unit.duration), 10),
+				},
+				Op: token.MUL,
+				Y: &dst.Ident{
+					Name: unit.name,
+					Path: "time",
+				},
+			}
+		}
+	}
+	return &dst.CallExpr{
+		Fun: &dst.Ident{
+			Name: "Duration",
+			Path: "time",
+		},
+		Args: []dst.Expr{
+			&dst.BasicLit{
+				Kind:  token.INT,
+				Value: strconv.FormatInt(int64(d), 10),
 			},
 		},
 	}
+}
+
+// waitForConnection creates a statement that blocks until the application connects to New Relic, or the timeout passes,
+// so that the transactions of short-lived programs are not lost.
+func waitForConnection(AgentVariableName string, timeout time.Duration, strategy string, logger *appLogger) dst.Stmt {
+	wait := &dst.CallExpr{
+		Fun: &dst.SelectorExpr{
+			X:   dst.NewIdent(AgentVariableName),
+			Sel: dst.NewIdent("WaitForConnection"),
+		},
+		Args: []dst.Expr{durationExpr(timeout)},
+	}
+
+	// a connection timeout is logged unless the program is asked to exit, since the application can still connect later
+	if strategy == agentErrorPanic || strategy == agentErrorReturn || strategy == "" {
+		strategy = agentErrorLog
+	}
+	handleErr := handleAgentError(strategy, "New Relic application failed to connect", logger)
+	if handleErr == nil {
+		return &dst.ExprStmt{
+			X: wait,
+			Decs: dst.ExprStmtDecorations{
+				NodeDecs: dst.NodeDecs{
+					After: dst.EmptyLine,
+				},
+			},
+		}
+	}
+	handleErr.Init = &dst.AssignStmt{
+		Lhs: []dst.Expr{dst.NewIdent(agentErrVariable)},
+		Tok: token.DEFINE,
+		Rhs: []dst.Expr{wait},
+	}
+	return handleErr
+}
+
+func createAgentAST(AppName, AgentVariableName string, options AgentOptions, logger *appLogger) []dst.Stmt {
+	// options set in the environment take precedence over the options generated from the user's config
+	configOptions := agentConfigOptions(options)
+	newappArgs := append(configOptions, &dst.CallExpr{
+		Fun: &dst.Ident{
+			Path: newrelicAgentImport,
+			Name: "ConfigFromEnvironment",
+		},
+	})
 	if AppName != "" {
 		AppName = "\"" + AppName + "\""
 		newappArgs = append([]dst.Expr{&dst.CallExpr{
@@ -71,13 +147,21 @@ func createAgentAST(AppName, AgentVariableName string) []dst.Stmt {
 		}}, newappArgs...)
 	}
 
+	// each option is written on its own line when the application is configured with more than its name
+	if len(configOptions) > 0 {
+		for _, arg := range newappArgs {
+			arg.Decorations().Before = dst.NewLine
+		}
+		newappArgs[len(newappArgs)-1].Decorations().After = dst.NewLine
+	}
+
 	agentInit := &dst.AssignStmt{
 		Lhs: []dst.Expr{
 			&dst.Ident{
 				Name: AgentVariableName,
 			},
 			&dst.Ident{
-				Name: "err",
+				Name: agentErrVariable,
 			},
 		},
 		Tok: token.DEFINE,
@@ -92,10 +176,21 @@ func createAgentAST(AppName, AgentVariableName string) []dst.Stmt {
 		},
 	}
 
-	return []dst.Stmt{agentInit, panicOnError()}
+	stmts := []dst.Stmt{agentInit}
+	if handleErr := handleAgentError(options.OnError, "failed to create New Relic application", logger); handleErr != nil {
+		stmts = append(stmts, handleErr)
+	} else {
+		// the error is discarded so that it is not declared without being used
+		agentInit.Lhs[1] = dst.NewIdent("_")
+		agentInit.Decs.After = dst.EmptyLine
+	}
+	if options.WaitForConnection > 0 {
+		stmts = append(stmts, waitForConnection(AgentVariableName, time.Duration(options.WaitForConnection), options.OnError, logger))
+	}
+	return stmts
 }
 
-func shutdownAgent(AgentVariableName string) *dst.ExprStmt {
+func shutdownAgent(AgentVariableName string, timeout time.Duration) *dst.ExprStmt {
 	return &dst.ExprStmt{
 		X: &dst.CallExpr{
 			Fun: &dst.SelectorExpr{
@@ -107,22 +202,7 @@ func shutdownAgent(AgentVariableName string) *dst.ExprStmt {
 				},
 			},
 			Args: []dst.Expr{
-				&dst.BinaryExpr{
-					X: &dst.BasicLit{
-						Kind:  token.INT,
-						Value: "5",
-					},
-					Op: token.MUL,
-					Y: &dst.Ident{
-						Name: "Second",
-						Path: "time",
-					},
-				},
-			},
-		},
-		Decs: dst.ExprStmtDecorations{
-			NodeDecs: dst.NodeDecs{
-				Before: dst.EmptyLine,
+				durationExpr(timeout),
 			},
 		},
 	}
@@ -169,33 +249,43 @@ func InstrumentMain(mainFunctionNode dst.Node, manager *InstrumentationManager,
 	txnStarted := false
 	if decl, ok := mainFunctionNode.(*dst.FuncDecl); ok {
 		// only inject go agent into the main.main function
-		if decl.Name.Name == "main" {
-			agentDecl := createAgentAST(manager.appName, manager.agentVariableName)
-			decl.Body.List = append(agentDecl, decl.Body.List...)
-			decl.Body.List = append(decl.Body.List, shutdownAgent(manager.agentVariableName))
+		pkg := manager.GetDecoratorPackage()
+		if decl.Name.Name == "main" && decl.Recv == nil && (pkg == nil || pkg.Name == "main") {
+			// the application is created in the function main delegates its work to, which errors can be returned from
+			entry := decl
+			options := manager.agentOptions
+			if run := findRunFunction(decl, manager); run != nil {
+				entry = run
+			} else if options.OnError == agentErrorReturn {
+				options.OnError = agentErrorLog
+			}
+			logger := findAppLogger(entry.Body, manager.GetDecoratorPackage())
+
+			agentDecl := agentStatements(manager, options, nil)
+			entry.Body.List = append(agentDecl, entry.Body.List...)
+			manager.SetAgentFunction(entry)
 
 			// add go-agent/v3/newrelic to imports
 			manager.AddImport(newrelicAgentImport)
 
-			newMain := dstutil.Apply(decl, func(c *dstutil.Cursor) bool {
+			// routes of muxes served through middleware are named by the middleware wrapper instead
+			FindMiddlewareMuxes(entry, manager)
+
+			newMain := dstutil.Apply(entry, func(c *dstutil.Cursor) bool {
 				node := c.Node()
 				switch v := node.(type) {
+				case *dst.FuncLit:
+					// jobs are instrumented once all packages are, with a transaction for each run
+					if isScheduledJobLit(v, c.Parent(), manager.GetDecoratorPackage()) {
+						return false
+					}
 				case *dst.ExprStmt:
-					rootPkg := manager.currentPackage
 					txnVarName := defaultTxnName
 					invInfo := manager.GetPackageFunctionInvocation(v)
-					// check if the called function has been instrumented already, if not, instrument it.
-					if manager.ShouldInstrumentFunction(invInfo) {
-						manager.SetPackage(invInfo.packageName)
-						decl := manager.GetDeclaration(invInfo.functionName)
-						_, wasModified := TraceFunction(manager, decl, defaultTxnName)
-						if wasModified {
-							// add transaction to declaration arguments
-							manager.AddTxnArgumentToFunctionDecl(decl, defaultTxnName)
-							manager.AddImport(newrelicAgentImport)
-						}
-						manager.SetPackage(rootPkg)
+					if runsCommandLineOf(v, invInfo, manager.GetDecoratorPackage()) {
+						invInfo = nil
 					}
+					traceInvokedFunction(manager, invInfo)
 					// pass the called function a transaction if needed
 					// always check c.Index >= 0 to avoid panics when using c.Insert methods
 					if manager.RequiresTransactionArgument(invInfo, txnVarName) && c.Index() >= 0 {
@@ -205,12 +295,64 @@ func InstrumentMain(mainFunctionNode dst.Node, manager *InstrumentationManager,
 						txnStarted = true
 					}
 					WrapHandleFunc(v.X, manager, c)
+					WrapFastHttpHandleFunc(v.X, manager, c)
+				case *dst.AssignStmt, *dst.IfStmt, *dst.SwitchStmt, *dst.ReturnStmt:
+					// statements that are not in a block, such as the init of an if statement, are part of their parent
+					if c.Index() < 0 {
+						return true
+					}
+					txnVarName := defaultTxnName
+					invInfo := statementInvocation(manager, v.(dst.Stmt))
+					traceInvokedFunction(manager, invInfo)
+					if !manager.RequiresTransactionArgument(invInfo, txnVarName) {
+						return true
+					}
+					// the transaction is started before the statement, so that the variables it declares keep their scope
+					c.InsertBefore(startTransaction(manager.agentVariableName, txnVarName, invInfo.functionName, txnStarted))
+					switch v.(type) {
+					case *dst.ReturnStmt:
+						c.InsertBefore(deferEndTransaction(txnVarName))
+					case *dst.IfStmt, *dst.SwitchStmt:
+						endTransactionInBranches(v.(dst.Stmt), txnVarName, manager.GetDecoratorPackage())
+						c.InsertAfter(endTransaction(txnVarName))
+					default:
+						c.InsertAfter(endTransaction(txnVarName))
+					}
+					invInfo.call.Args = append(invInfo.call.Args, dst.NewIdent(txnVarName))
+					txnStarted = true
+					// calls nested in the statement, such as in the branches of an if, run as part of its transaction
+					for _, nested := range iterationCalls(manager, v.(dst.Stmt), txnVarName) {
+						nested.call.Args = append(nested.call.Args, dst.NewIdent(txnVarName))
+					}
+					return false
+				case *dst.ForStmt, *dst.RangeStmt:
+					// each iteration of a worker loop is a unit of work with a transaction of its own
+					instrumentWorkerLoop(manager, v.(dst.Stmt))
+				case *dst.DeferStmt:
+					// deferred calls get a transaction of their own when they run, if deferring them can be kept as is
+					invInfo := manager.GetPackageFunctionInvocation(v.Call)
+					if invInfo == nil || invInfo.call != v.Call || !hasConstantArgs(v.Call) {
+						return true
+					}
+					traceInvokedFunction(manager, invInfo)
+					if manager.RequiresTransactionArgument(invInfo, defaultTxnName) {
+						deferredTransaction(manager, v, invInfo, defaultTxnName)
+					}
+				case *dst.CompositeLit, *dst.CallExpr:
+					WrapServerHandler(v, manager, c)
+					WrapFastHttpServedHandler(v, manager, c)
 				}
 
 				return true
 			}, nil)
+			if logger != nil && (options.OnError == agentErrorLog || options.OnError == agentErrorExit) {
+				createAgentAfterLogger(manager, entry, len(agentDecl), logger, options)
+			}
+			ShutdownOnExit(manager, entry, options)
 			// this will skip the tracing of this function in the outer tree walking algorithm
-			c.Replace(newMain)
+			if entry == decl {
+				c.Replace(newMain)
+			}
 		}
 	}
 }
@@ -348,7 +490,8 @@ func txnNoticeError(errVariableName, txnName string, nodeDecs *dst.NodeDecs) *ds
 func findErrorVariable(stmt *dst.AssignStmt, pkg *decorator.Package) string {
 	if len(stmt.Rhs) == 1 {
 		if call, ok := stmt.Rhs[0].(*dst.CallExpr); ok {
-			if !isNewRelicMethod(call) {
+			// errors returned by commands are captured by the segments ExecCommandCall adds to them
+			if _, isCommand := isExecCommandRun(call, pkg); !isNewRelicMethod(call) && !isCommand {
 				if errIndex, ok := errorReturns(call, pkg); ok {
 					expr := stmt.Lhs[errIndex]
 					if ident, ok := expr.(*dst.Ident); ok {
@@ -363,7 +506,7 @@ func findErrorVariable(stmt *dst.AssignStmt, pkg *decorator.Package) string {
 
 type StatefulTracingFunction func(manager *InstrumentationManager, stmt dst.Stmt, c *dstutil.Cursor, tracingName string) bool
 
-var TracingFunctionsForSupportedPackages = []StatefulTracingFunction{ExternalHttpCall, WrapNestedHandleFunction}
+var TracingFunctionsForSupportedPackages = []StatefulTracingFunction{ExternalHttpCall, WrapNestedHandleFunction, ExternalFastHttpCall, WrapNestedFastHttpHandleFunction, ElasticsearchCall, RewriteHttpMethodCall, TemplateExecution, ExecCommandCall}
 
 // NoticeError will check for the presence of an error.Error variable in the body at the index in bodyIndex.
 // If it finds that an error is returned, it will add a line after the assignment statement to capture an error
@@ -380,13 +523,33 @@ func NoticeError(manager *InstrumentationManager, stmt dst.Stmt, c *dstutil.Curs
 	return false
 }
 
+// function literals are traced as a declaration with a name that can not collide with functions in the package
+const funcLitName = "function literal"
+
+// traceFuncLit traces the body of a function literal, as TraceFunction does for a declaration. It returns the
+// declaration the literal was traced as, which shares its body, and whether the body was modified.
+func traceFuncLit(manager *InstrumentationManager, lit *dst.FuncLit, txnVarName string) (*dst.FuncDecl, bool) {
+	decl := &dst.FuncDecl{
+		Name: dst.NewIdent(funcLitName),
+		Type: lit.Type,
+		Body: lit.Body,
+	}
+	newFn, modified := TraceFunction(manager, decl, txnVarName)
+	lit.Body = newFn.Body
+	return newFn, modified
+}
+
 // TraceFunction adds tracing to a function. This includes error capture, and passing agent metadata to relevant functions and services.
 // Traces all called functions inside the current package as well.
 // This function returns a FuncDecl object pointer that contains the potentially modified version of the FuncDecl object, fn, passed. If
 // the bool field is true, then the function was modified, and requires a transaction most likely.
 func TraceFunction(manager *InstrumentationManager, fn *dst.FuncDecl, txnVarName string) (*dst.FuncDecl, bool) {
 	TopLevelFunctionChanged := false
-	outputNode := dstutil.Apply(fn, nil, func(c *dstutil.Cursor) bool {
+	outputNode := dstutil.Apply(fn, func(c *dstutil.Cursor) bool {
+		// http handler literals get their own transaction from the request they serve
+		lit, ok := c.Node().(*dst.FuncLit)
+		return !ok || !isHttpHandlerLit(lit, manager.GetDecoratorPackage())
+	}, func(c *dstutil.Cursor) bool {
 		n := c.Node()
 		switch v := n.(type) {
 		case *dst.GoStmt:
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/token"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dave/dst"
+)
+
+// strategies for handling errors creating the application, or connecting it to New Relic
+const (
+	agentErrorPanic  = "panic"
+	agentErrorLog    = "log"
+	agentErrorIgnore = "ignore"
+	agentErrorExit   = "exit"
+	agentErrorReturn = "return" // only used when main delegates to a function that returns an error
+)
+
+// destinations of the agent debug logger
+const (
+	debugLoggerStdout = "stdout"
+	debugLoggerStderr = "stderr"
+)
+
+// AgentOptions configure the New Relic application that is created in main, in addition to its name and the
+// environment. Options that are not set are left to the defaults of the agent.
+type AgentOptions struct {
+	DistributedTracing *bool             `json:"distributedTracing,omitempty"`
+	CodeLevelMetrics   *bool             `json:"codeLevelMetrics,omitempty"`
+	AppLogForwarding   *bool             `json:"appLogForwarding,omitempty"`
+	Labels             map[string]string `json:"labels,omitempty"`
+	HostDisplayName    string            `json:"hostDisplayName,omitempty"`
+	HighSecurity       bool              `json:"highSecurity,omitempty"`
+	DebugLogger        string            `json:"debugLogger,omitempty"`   // "stdout" or "stderr"
+	EnabledEnvVar      string            `json:"enabledEnvVar,omitempty"` // the agent is disabled when this is set to "false"
+
+	// status codes written by handlers are recorded as errors by the agent from 400, the codes below this are ignored
+	ErrorStatusThreshold int `json:"errorStatusThreshold,omitempty"`
+
+	WaitForConnection duration `json:"waitForConnection,omitempty"` // how long main waits for the application to connect
+	OnError           string   `json:"onError,omitempty"`           // how errors creating or connecting the application are handled
+	ShutdownTimeout   duration `json:"shutdownTimeout,omitempty"`   // how long the application has to send its data when the program exits
+
+	// binaries are identified by their directory relative to the application, ex: "cmd/api"
+	AppNames        map[string]string `json:"appNames,omitempty"`        // names of the applications created in each binary
+	Binaries        []string          `json:"binaries,omitempty"`        // binaries that are instrumented, all of them if empty
+	ExcludeBinaries []string          `json:"excludeBinaries,omitempty"` // binaries that are not instrumented
+}
+
+// duration is a time.Duration that is read from JSON as a string, ex: "5s"
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// shutdownTimeout returns how long the application has to send its data when the program exits.
+func (o AgentOptions) shutdownTimeout() time.Duration {
+	if o.ShutdownTimeout == 0 {
+		return defaultShutdownTimeout
+	}
+	return time.Duration(o.ShutdownTimeout)
+}
+
+// loadAgentOptions reads agent options from a JSON config file.
+func loadAgentOptions(path string) (AgentOptions, error) {
+	options := AgentOptions{}
+	f, err := os.Open(path)
+	if err != nil {
+		return options, err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&options); err != nil {
+		return options, fmt.Errorf("failed to read config file %s: %v", path, err)
+	}
+	return options, nil
+}
+
+// parseLabels parses labels in the format the agent reads them from the environment: "key1:value1;key2:value2"
+func parseLabels(labels string) (map[string]string, error) {
+	parsed := map[string]string{}
+	for _, label := range strings.Split(labels, ";") {
+		label = strings.TrimSpace(label)
+		if label == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(label, ":")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" || value == "" {
+			return nil, fmt.Errorf("invalid label %q, labels must be formatted as key:value", label)
+		}
+		parsed[key] = value
+	}
+	return parsed, nil
+}
+
+// Validate returns an error if the options can not be used to configure an application.
+func (o AgentOptions) Validate() error {
+	switch o.DebugLogger {
+	case "", debugLoggerStdout, debugLoggerStderr:
+	default:
+		return fmt.Errorf("debug logger must be %s or %s, got %q", debugLoggerStdout, debugLoggerStderr, o.DebugLogger)
+	}
+	switch o.OnError {
+	case "", agentErrorPanic, agentErrorLog, agentErrorIgnore, agentErrorExit, agentErrorReturn:
+	default:
+		return fmt.Errorf("agent error handling must be one of %s, %s, %s, %s or %s, got %q", agentErrorPanic, agentErrorLog, agentErrorIgnore, agentErrorExit, agentErrorReturn, o.OnError)
+	}
+	if o.WaitForConnection < 0 {
+		return fmt.Errorf("wait for connection timeout can not be negative")
+	}
+	if o.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown timeout can not be negative")
+	}
+	if o.ErrorStatusThreshold != 0 && (o.ErrorStatusThreshold < defaultErrorStatusThreshold || o.ErrorStatusThreshold > 599) {
+		return fmt.Errorf("error status threshold must be an http status code from %d to 599, got %d", defaultErrorStatusThreshold, o.ErrorStatusThreshold)
+	}
+	return o.validateBinaries()
+}
+
+// configOption creates a call to a ConfigOption function of the newrelic package.
+func configOption(name string, args ...dst.Expr) *dst.CallExpr {
+	return &dst.CallExpr{
+		Fun: &dst.Ident{
+			Name: name,
+			Path: newrelicAgentImport,
+		},
+		Args: args,
+	}
+}
+
+// configField creates a statement that sets a field of the config: cfg.Field = value
+func configField(field string, value dst.Expr) *dst.AssignStmt {
+	return &dst.AssignStmt{
+		Lhs: []dst.Expr{
+			&dst.SelectorExpr{
+				X:   dst.NewIdent("cfg"),
+				Sel: dst.NewIdent(field),
+			},
+		},
+		Tok: token.ASSIGN,
+		Rhs: []dst.Expr{value},
+	}
+}
+
+// stringLit creates a string literal expression.
+func stringLit(value string) *dst.BasicLit {
+	return &dst.BasicLit{
+		Kind:  token.STRING,
+		Value: strconv.Quote(value),
+	}
+}
+
+// ignoreStatusCodes creates a loop that adds the status codes below a threshold to the status codes the agent does
+// not record as errors: for code := 400; code < threshold; code++ {...}
+func ignoreStatusCodes(threshold int) *dst.ForStmt {
+	ignored := &dst.SelectorExpr{
+		X: &dst.SelectorExpr{
+			X:   dst.NewIdent("cfg"),
+			Sel: dst.NewIdent("ErrorCollector"),
+		},
+		Sel: dst.NewIdent("IgnoreStatusCodes"),
+	}
+	return &dst.ForStmt{
+		Init: &dst.AssignStmt{
+			Lhs: []dst.Expr{dst.NewIdent("code")},
+			Tok: token.DEFINE,
+			Rhs: []dst.Expr{&dst.BasicLit{Kind: token.INT, Value: strconv.Itoa(defaultErrorStatusThreshold)}},
+		},
+		Cond: &dst.BinaryExpr{
+			X:  dst.NewIdent("code"),
+			Op: token.LSS,
+			Y:  &dst.BasicLit{Kind: token.INT, Value: strconv.Itoa(threshold)},
+		},
+		Post: &dst.IncDecStmt{X: dst.NewIdent("code"), Tok: token.INC},
+		Body: &dst.BlockStmt{
+			List: []dst.Stmt{
+				&dst.AssignStmt{
+					Lhs: []dst.Expr{ignored},
+					Tok: token.ASSIGN,
+					Rhs: []dst.Expr{
+						&dst.CallExpr{
+							Fun:  dst.NewIdent("append"),
+							Args: []dst.Expr{dst.Clone(ignored).(dst.Expr), dst.NewIdent("code")},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// labelsLit creates a map[string]string literal of labels, sorted by key.
+func labelsLit(labels map[string]string) *dst.CompositeLit {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	lit := &dst.CompositeLit{
+		Type: &dst.MapType{
+			Key:   dst.NewIdent("string"),
+			Value: dst.NewIdent("string"),
+		},
+	}
+	for _, key := range keys {
+		lit.Elts = append(lit.Elts, &dst.KeyValueExpr{
+			Key:   stringLit(key),
+			Value: stringLit(labels[key]),
+		})
+	}
+	return lit
+}
+
+// agentConfigOptions creates the ConfigOptions that configure an application with the options passed. Settings that
+// the newrelic package has no ConfigOption for are set in a function literal: func(cfg *newrelic.Config) {...}
+func agentConfigOptions(o AgentOptions) []dst.Expr {
+	options := []dst.Expr{}
+	if o.DistributedTracing != nil {
+		options = append(options, configOption("ConfigDistributedTracerEnabled", dst.NewIdent(strconv.FormatBool(*o.DistributedTracing))))
+	}
+	if o.CodeLevelMetrics != nil {
+		options = append(options, configOption("ConfigCodeLevelMetricsEnabled", dst.NewIdent(strconv.FormatBool(*o.CodeLevelMetrics))))
+	}
+	if o.AppLogForwarding != nil {
+		options = append(options, configOption("ConfigAppLogForwardingEnabled", dst.NewIdent(strconv.FormatBool(*o.AppLogForwarding))))
+	}
+	if o.DebugLogger != "" {
+		output := "Stdout"
+		if o.DebugLogger == debugLoggerStderr {
+			output = "Stderr"
+		}
+		options = append(options, configOption("ConfigDebugLogger", &dst.Ident{Name: output, Path: "os"}))
+	}
+	if o.EnabledEnvVar != "" {
+		options = append(options, configOption("ConfigEnabled", &dst.BinaryExpr{
+			X: &dst.CallExpr{
+				Fun:  &dst.Ident{Name: "Getenv", Path: "os"},
+				Args: []dst.Expr{stringLit(o.EnabledEnvVar)},
+			},
+			Op: token.NEQ,
+			Y:  stringLit("false"),
+		}))
+	}
+
+	fields := []dst.Stmt{}
+	if o.HostDisplayName != "" {
+		fields = append(fields, configField("HostDisplayName", stringLit(o.HostDisplayName)))
+	}
+	if o.HighSecurity {
+		fields = append(fields, configField("HighSecurity", dst.NewIdent("true")))
+	}
+	if len(o.Labels) > 0 {
+		fields = append(fields, configField("Labels", labelsLit(o.Labels)))
+	}
+	if o.ErrorStatusThreshold > defaultErrorStatusThreshold {
+		fields = append(fields, ignoreStatusCodes(o.ErrorStatusThreshold))
+	}
+	if len(fields) > 0 {
+		options = append(options, &dst.FuncLit{
+			Type: &dst.FuncType{
+				Params: &dst.FieldList{
+					List: []*dst.Field{{
+						Names: []*dst.Ident{dst.NewIdent("cfg")},
+						Type: &dst.StarExpr{
+							X: &dst.Ident{Name: "Config", Path: newrelicAgentImport},
+						},
+					}},
+				},
+			},
+			Body: &dst.BlockStmt{List: fields},
+		})
+	}
+	return options
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dave/dst"
+)
+
+func Test_parseLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		labels  string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:   "multiple_labels",
+			labels: "env:prod; team:payments;",
+			want:   map[string]string{"env": "prod", "team": "payments"},
+		},
+		{
+			name:   "empty",
+			labels: "",
+			want:   map[string]string{},
+		},
+		{
+			name:    "missing_value",
+			labels:  "env",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLabels(tt.labels)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseLabels() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseLabels() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_loadAgentOptions(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.json")
+	if err := os.WriteFile(valid, []byte(`{"distributedTracing": false, "labels": {"env": "prod"}, "debugLogger": "stderr", "waitForConnection": "5s", "shutdownTimeout": "10s"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	unknown := filepath.Join(dir, "unknown.json")
+	if err := os.WriteFile(unknown, []byte(`{"distributedTracer": true}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := loadAgentOptions(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt := false
+	want := AgentOptions{DistributedTracing: &dt, Labels: map[string]string{"env": "prod"}, DebugLogger: debugLoggerStderr, WaitForConnection: duration(5 * time.Second), ShutdownTimeout: duration(10 * time.Second)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loadAgentOptions() = %+v, want %+v", got, want)
+	}
+
+	if _, err := loadAgentOptions(unknown); err == nil {
+		t.Error("expected loadAgentOptions() to fail on unknown options")
+	}
+}
+
+func Test_createAgentAST(t *testing.T) {
+	enabled := true
+	tests := []struct {
+		name        string
+		options     AgentOptions
+		wantContain []string
+	}{
+		{
+			name:        "default_options",
+			wantContain: []string{`NewRelicAgent, nrErr := newrelic.NewApplication(newrelic.ConfigAppName("app"), newrelic.ConfigFromEnvironment())`},
+		},
+		{
+			name: "config_options",
+			options: AgentOptions{
+				DistributedTracing: &enabled,
+				CodeLevelMetrics:   &enabled,
+				DebugLogger:        debugLoggerStdout,
+				EnabledEnvVar:      "NEW_RELIC_ENABLED",
+			},
+			wantContain: []string{
+				"\tNewRelicAgent, nrErr := newrelic.NewApplication(\n\t\tnewrelic.ConfigAppName(\"app\"),\n",
+				"\t\tnewrelic.ConfigDistributedTracerEnabled(true),\n",
+				"\t\tnewrelic.ConfigCodeLevelMetricsEnabled(true),\n",
+				"\t\tnewrelic.ConfigDebugLogger(os.Stdout),\n",
+				"\t\tnewrelic.ConfigEnabled(os.Getenv(\"NEW_RELIC_ENABLED\") != \"false\"),\n",
+				"\t\tnewrelic.ConfigFromEnvironment(),\n\t)",
+			},
+		},
+		{
+			name: "config_fields",
+			options: AgentOptions{
+				HostDisplayName: "web-1",
+				HighSecurity:    true,
+				Labels:          map[string]string{"team": "payments", "env": "prod"},
+			},
+			wantContain: []string{
+				"func(cfg *newrelic.Config) {",
+				`cfg.HostDisplayName = "web-1"`,
+				"cfg.HighSecurity = true",
+				`cfg.Labels = map[string]string{"env": "prod", "team": "payments"}`,
+			},
+		},
+		{
+			name:    "error_status_threshold",
+			options: AgentOptions{ErrorStatusThreshold: 500},
+			wantContain: []string{
+				"func(cfg *newrelic.Config) {\n\t\t\tfor code := 400; code < 500; code++ {\n\t\t\t\tcfg.ErrorCollector.IgnoreStatusCodes = append(cfg.ErrorCollector.IgnoreStatusCodes, code)\n\t\t\t}\n\t\t}",
+			},
+		},
+		{
+			name: "log_errors_and_wait_for_connection",
+			options: AgentOptions{
+				OnError:           agentErrorLog,
+				WaitForConnection: duration(10 * time.Second),
+			},
+			wantContain: []string{
+				"\tif nrErr != nil {\n\t\tlog.Printf(\"failed to create New Relic application: %v\", nrErr)\n\t}",
+				"\tif nrErr := NewRelicAgent.WaitForConnection(10 * time.Second); nrErr != nil {\n\t\tlog.Printf(\"New Relic application failed to connect: %v\", nrErr)\n\t}",
+			},
+		},
+		{
+			name: "default_errors_log_connection_timeout",
+			options: AgentOptions{
+				WaitForConnection: duration(5 * time.Second),
+			},
+			wantContain: []string{
+				"\tif nrErr != nil {\n\t\tpanic(nrErr)\n\t}",
+				"\tif nrErr := NewRelicAgent.WaitForConnection(5 * time.Second); nrErr != nil {\n\t\tlog.Printf(\"New Relic application failed to connect: %v\", nrErr)\n\t}",
+			},
+		},
+		{
+			name: "ignore_errors",
+			options: AgentOptions{
+				OnError:           agentErrorIgnore,
+				WaitForConnection: duration(1500 * time.Millisecond),
+			},
+			wantContain: []string{
+				"NewRelicAgent, _ := newrelic.NewApplication(",
+				"\tNewRelicAgent.WaitForConnection(1500 * time.Millisecond)\n",
+			},
+		},
+		{
+			name: "exit_on_connection_timeout",
+			options: AgentOptions{
+				OnError:           agentErrorExit,
+				WaitForConnection: duration(5 * time.Second),
+			},
+			wantContain: []string{
+				"\tif nrErr := NewRelicAgent.WaitForConnection(5 * time.Second); nrErr != nil {\n\t\tlog.Fatalf(\"New Relic application failed to connect: %v\", nrErr)\n\t}",
+			},
+		},
+		{
+			name:        "exit_on_error",
+			options:     AgentOptions{OnError: agentErrorExit},
+			wantContain: []string{"log.Fatalf(\"failed to create New Relic application: %v\", nrErr)"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := &dst.File{
+				Name: dst.NewIdent("main"),
+				Decls: []dst.Decl{
+					&dst.FuncDecl{
+						Name: dst.NewIdent("main"),
+						Type: &dst.FuncType{},
+						Body: &dst.BlockStmt{List: createAgentAST("app", defaultAgentVariableName, tt.options, nil)},
+					},
+				},
+			}
+
+			got := restoreTestFile(t, file)
+			for _, want := range tt.wantContain {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected agent initialization to contain %q, but got:\n%s", want, got)
+				}
+			}
+		})
+	}
+}
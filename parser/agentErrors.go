@@ -0,0 +1,298 @@
+package main
+
+import (
+	"go/token"
+	"strconv"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+)
+
+// kinds of loggers that errors from the agent can be logged with
+const (
+	loggerLog        = "*log.Logger"
+	loggerSlog       = "*log/slog.Logger"
+	loggerZap        = "*go.uber.org/zap.Logger"
+	loggerZapSugared = "*go.uber.org/zap.SugaredLogger"
+
+	slogPath = "log/slog"
+	zapPath  = "go.uber.org/zap"
+
+	// variable that errors from the agent are stored in, named so that it does not clash with the variables of the
+	// function the application is created in
+	agentErrVariable = "nrErr"
+)
+
+// appLogger is a logger created by the application, that errors from the agent are logged with.
+type appLogger struct {
+	kind string   // type of the logger
+	name string   // variable the logger is stored in, empty for the default logger of the log or slog package
+	stmt dst.Stmt // statement the logger is created in
+}
+
+// findAppLogger returns the first logger created in the body of a function: log.New, slog.New, slog.SetDefault, or
+// any function that returns a zap logger. It returns nil if the function does not create a logger.
+func findAppLogger(body *dst.BlockStmt, pkg *decorator.Package) *appLogger {
+	for _, stmt := range body.List {
+		switch v := stmt.(type) {
+		case *dst.AssignStmt:
+			if v.Tok != token.DEFINE && v.Tok != token.ASSIGN {
+				continue
+			}
+			for _, lhs := range v.Lhs {
+				ident, ok := lhs.(*dst.Ident)
+				if !ok || ident.Name == "_" {
+					continue
+				}
+				obj := identObject(ident, pkg)
+				if obj == nil {
+					continue
+				}
+				switch kind := obj.Type().String(); kind {
+				case loggerLog, loggerSlog, loggerZap, loggerZapSugared:
+					return &appLogger{kind: kind, name: ident.Name, stmt: stmt}
+				}
+			}
+		case *dst.ExprStmt:
+			call, ok := v.X.(*dst.CallExpr)
+			if !ok {
+				continue
+			}
+			if fun, ok := call.Fun.(*dst.Ident); ok && fun.Name == "SetDefault" && fun.Path == slogPath {
+				return &appLogger{kind: loggerSlog, stmt: stmt}
+			}
+		}
+	}
+	return nil
+}
+
+// call creates a call to a method of the logger, or a function of the log or slog package for their default logger.
+func (l *appLogger) call(method string, args ...dst.Expr) *dst.ExprStmt {
+	var fun dst.Expr = &dst.Ident{Name: method, Path: "log"}
+	if l.kind == loggerSlog {
+		fun = &dst.Ident{Name: method, Path: slogPath}
+	}
+	if l.name != "" {
+		fun = &dst.SelectorExpr{
+			X:   dst.NewIdent(l.name),
+			Sel: dst.NewIdent(method),
+		}
+	}
+	return &dst.ExprStmt{
+		X: &dst.CallExpr{
+			Fun:  fun,
+			Args: args,
+		},
+	}
+}
+
+// logError creates the statements that log an error with the logger, and exit if exit is true.
+func (l *appLogger) logError(message string, exit bool) []dst.Stmt {
+	msg := stringLit(message)
+	errVar := dst.NewIdent(agentErrVariable)
+	switch l.kind {
+	case loggerSlog:
+		stmts := []dst.Stmt{l.call("Error", msg, stringLit("error"), errVar)}
+		if exit {
+			stmts = append(stmts, osExit())
+		}
+		return stmts
+	case loggerZap:
+		method := "Error"
+		if exit {
+			method = "Fatal"
+		}
+		return []dst.Stmt{l.call(method, msg, &dst.CallExpr{
+			Fun:  &dst.Ident{Name: "Error", Path: zapPath},
+			Args: []dst.Expr{errVar},
+		})}
+	case loggerZapSugared:
+		method := "Errorw"
+		if exit {
+			method = "Fatalw"
+		}
+		return []dst.Stmt{l.call(method, msg, stringLit("error"), errVar)}
+	}
+
+	method := "Printf"
+	if exit {
+		method = "Fatalf"
+	}
+	return []dst.Stmt{l.call(method, stringLit(message+": %v"), errVar)}
+}
+
+// osExit creates the statement: os.Exit(1)
+func osExit() *dst.ExprStmt {
+	return &dst.ExprStmt{
+		X: &dst.CallExpr{
+			Fun: &dst.Ident{
+				Name: "Exit",
+				Path: "os",
+			},
+			Args: []dst.Expr{
+				&dst.BasicLit{
+					Kind:  token.INT,
+					Value: "1",
+				},
+			},
+		},
+	}
+}
+
+// stdLogger returns the logger of the log package, which errors are logged with when the application does not create one.
+func stdLogger() *appLogger {
+	return &appLogger{kind: loggerLog}
+}
+
+// returnError creates the statement: return fmt.Errorf("message: %w", nrErr)
+func returnError(message string) *dst.ReturnStmt {
+	return &dst.ReturnStmt{
+		Results: []dst.Expr{
+			&dst.CallExpr{
+				Fun: &dst.Ident{
+					Name: "Errorf",
+					Path: "fmt",
+				},
+				Args: []dst.Expr{
+					&dst.BasicLit{
+						Kind:  token.STRING,
+						Value: strconv.Quote(message + ": %w"),
+					},
+					dst.NewIdent(agentErrVariable),
+				},
+			},
+		},
+	}
+}
+
+// handleAgentError creates a statement that handles an error returned by the agent with the strategy chosen by the
+// user: panic, log the error and continue with a nil application, log the error and exit, or return the error from
+// the function the application is created in. Errors are logged with the application's logger if it has one. It
+// returns nil if errors are ignored.
+func handleAgentError(strategy, message string, logger *appLogger) *dst.IfStmt {
+	handleErr := panicOnError()
+	if logger == nil {
+		logger = stdLogger()
+	}
+
+	switch strategy {
+	case agentErrorIgnore:
+		return nil
+	case agentErrorLog:
+		handleErr.Body.List = logger.logError(message, false)
+	case agentErrorExit:
+		handleErr.Body.List = logger.logError(message, true)
+	case agentErrorReturn:
+		handleErr.Body.List = []dst.Stmt{returnError(message)}
+	}
+	return handleErr
+}
+
+// isRunFunction returns true if a function returns only an error, which main can return errors through.
+func isRunFunction(decl *dst.FuncDecl) bool {
+	if decl == nil || decl.Recv != nil || decl.Type.Results == nil || len(decl.Type.Results.List) != 1 {
+		return false
+	}
+	result := decl.Type.Results.List[0]
+	ident, ok := result.Type.(*dst.Ident)
+	return ok && ident.Name == "error" && ident.Path == "" && len(result.Names) <= 1
+}
+
+// findRunFunction returns the function of the package that main delegates its work to, if main does nothing but
+// call a function that returns only an error, and handle that error: if err := run(); err != nil {...}, or
+// err := run(); if err != nil {...}
+func findRunFunction(mainDecl *dst.FuncDecl, manager *InstrumentationManager) *dst.FuncDecl {
+	var call dst.Stmt
+	var check *dst.IfStmt
+	switch list := mainDecl.Body.List; len(list) {
+	case 1:
+		check, _ = list[0].(*dst.IfStmt)
+		if check != nil {
+			call = check.Init
+		}
+	case 2:
+		call = list[0]
+		check, _ = list[1].(*dst.IfStmt)
+		if check != nil && check.Init != nil {
+			return nil
+		}
+	}
+	if call == nil || check == nil {
+		return nil
+	}
+
+	assign, ok := call.(*dst.AssignStmt)
+	if !ok || len(assign.Lhs) != 1 || len(assign.Rhs) != 1 {
+		return nil
+	}
+	errIdent, ok := assign.Lhs[0].(*dst.Ident)
+	if !ok || !referencesIdent(check.Cond, errIdent.Name) {
+		return nil
+	}
+	runCall, ok := assign.Rhs[0].(*dst.CallExpr)
+	if !ok {
+		return nil
+	}
+	ident, ok := runCall.Fun.(*dst.Ident)
+	if !ok || ident.Path != "" {
+		return nil
+	}
+	if decl := manager.GetDeclaration(ident.Name); decl != mainDecl && isRunFunction(decl) {
+		return decl
+	}
+	return nil
+}
+
+// agentStatements creates the statements that create the application, handle errors creating it, and shut it down
+// when the function they are added to returns.
+func agentStatements(manager *InstrumentationManager, options AgentOptions, logger *appLogger) []dst.Stmt {
+	stmts := createAgentAST(manager.AppName(), manager.agentVariableName, options, logger)
+	return append(stmts, deferShutdown(manager.agentVariableName, options.shutdownTimeout()))
+}
+
+// referencesIdent returns true if a node refers to a local identifier with the given name.
+func referencesIdent(n dst.Node, name string) bool {
+	found := false
+	dst.Inspect(n, func(n dst.Node) bool {
+		if ident, ok := n.(*dst.Ident); ok && ident.Name == name && ident.Path == "" {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// createAgentAfterLogger moves the creation of the application after the statement that creates the application's
+// logger, so that errors from the agent are logged with it. The numAgentStmts statements that create the application
+// are expected at the start of the function. The application is not moved if it is used before the logger is created.
+func createAgentAfterLogger(manager *InstrumentationManager, fn *dst.FuncDecl, numAgentStmts int, logger *appLogger, options AgentOptions) {
+	list := fn.Body.List
+	index := -1
+	for i, stmt := range list {
+		if stmt == logger.stmt {
+			index = i
+		}
+	}
+	if index < numAgentStmts {
+		return
+	}
+
+	// errors creating the logger are handled before the application is created
+	insert := index + 1
+	if insert < len(list) {
+		if _, ok := list[insert].(*dst.IfStmt); ok {
+			insert++
+		}
+	}
+	for _, stmt := range list[numAgentStmts:insert] {
+		if referencesIdent(stmt, manager.agentVariableName) || referencesIdent(stmt, defaultTxnName) {
+			return
+		}
+	}
+
+	agentStmts := agentStatements(manager, options, logger)
+	newList := append([]dst.Stmt{}, list[numAgentStmts:insert]...)
+	newList[len(newList)-1].Decorations().After = dst.EmptyLine
+	newList = append(newList, agentStmts...)
+	fn.Body.List = append(newList, list[insert:]...)
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dave/dst"
+)
+
+func Test_findAppLogger(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     string
+		wantKind string
+		wantName string
+	}{
+		{
+			name: "log_new",
+			code: `
+package main
+import (
+	"log"
+	"os"
+)
+func main() {
+	logger := log.New(os.Stderr, "app: ", log.LstdFlags)
+	logger.Println("started")
+}
+`,
+			wantKind: loggerLog,
+			wantName: "logger",
+		},
+		{
+			name: "slog_new",
+			code: `
+package main
+import (
+	"log/slog"
+	"os"
+)
+func main() {
+	var logger *slog.Logger
+	logger = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	logger.Info("started")
+}
+`,
+			wantKind: loggerSlog,
+			wantName: "logger",
+		},
+		{
+			name: "slog_set_default",
+			code: `
+package main
+import (
+	"log/slog"
+	"os"
+)
+func main() {
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	slog.Info("started")
+}
+`,
+			wantKind: loggerSlog,
+		},
+		{
+			name: "no_logger",
+			code: `
+package main
+import "log"
+func main() {
+	x := 1
+	log.Println(x)
+}
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, tt.code)
+			if err := tracePackageFunctionCalls(manager); err != nil {
+				t.Fatal(err)
+			}
+			pkg := manager.GetDecoratorPackage()
+			mainDecl := manager.GetDeclaration("main")
+			got := findAppLogger(mainDecl.Body, pkg)
+			if tt.wantKind == "" {
+				if got != nil {
+					t.Fatalf("findAppLogger() = %+v, want nil", got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatal("findAppLogger() = nil, want a logger")
+			}
+			if got.kind != tt.wantKind || got.name != tt.wantName {
+				t.Errorf("findAppLogger() = {%s %s}, want {%s %s}", got.kind, got.name, tt.wantKind, tt.wantName)
+			}
+		})
+	}
+}
+
+func Test_findRunFunction(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		want string
+	}{
+		{
+			name: "if_init",
+			main: "if err := run(); err != nil {\n\t\tlog.Fatal(err)\n\t}",
+			want: "run",
+		},
+		{
+			name: "checked_after_call",
+			main: "err := run()\n\tif err != nil {\n\t\tlog.Fatal(err)\n\t}",
+			want: "run",
+		},
+		{
+			name: "argument_of_exit_call",
+			main: "log.Fatal(run())",
+		},
+		{
+			name: "work_before_delegating",
+			main: "log.Println(\"starting\")\n\tif err := run(); err != nil {\n\t\tlog.Fatal(err)\n\t}",
+		},
+		{
+			name: "error_discarded",
+			main: "run()",
+		},
+		{
+			name: "not_last_statement",
+			main: "if err := run(); err != nil {\n\t\tlog.Fatal(err)\n\t}\n\tlog.Println(\"done\")",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := "package main\nimport \"log\"\nfunc main() {\n\t" + tt.main + "\n}\nfunc run() error {\n\treturn nil\n}\n"
+			manager := newTestingInstrumentationManager(t, code)
+			if err := tracePackageFunctionCalls(manager); err != nil {
+				t.Fatal(err)
+			}
+			got := findRunFunction(manager.GetDeclaration("main"), manager)
+			if tt.want == "" {
+				if got != nil {
+					t.Fatalf("findRunFunction() = %s, want nil", got.Name.Name)
+				}
+				return
+			}
+			if got == nil || got.Name.Name != tt.want {
+				t.Errorf("findRunFunction() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_appLogger_logError(t *testing.T) {
+	tests := []struct {
+		name   string
+		logger *appLogger
+		exit   bool
+		want   string
+	}{
+		{
+			name:   "std_log",
+			logger: stdLogger(),
+			want:   `log.Printf("agent failed: %v", nrErr)`,
+		},
+		{
+			name:   "std_log_exit",
+			logger: &appLogger{kind: loggerLog, name: "logger"},
+			exit:   true,
+			want:   `logger.Fatalf("agent failed: %v", nrErr)`,
+		},
+		{
+			name:   "slog_default_exit",
+			logger: &appLogger{kind: loggerSlog},
+			exit:   true,
+			want:   "slog.Error(\"agent failed\", \"error\", nrErr)\nos.Exit(1)",
+		},
+		{
+			name:   "zap",
+			logger: &appLogger{kind: loggerZap, name: "logger"},
+			want:   `logger.Error("agent failed", zap.Error(nrErr))`,
+		},
+		{
+			name:   "zap_sugared_exit",
+			logger: &appLogger{kind: loggerZapSugared, name: "sugar"},
+			exit:   true,
+			want:   `sugar.Fatalw("agent failed", "error", nrErr)`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn := &dst.FuncDecl{
+				Name: dst.NewIdent("main"),
+				Type: &dst.FuncType{},
+				Body: &dst.BlockStmt{List: tt.logger.logError("agent failed", tt.exit)},
+			}
+			got := restoreTestFile(t, &dst.File{
+				Name:  dst.NewIdent("main"),
+				Decls: []dst.Decl{fn},
+			})
+			for _, want := range strings.Split(tt.want, "\n") {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected logged error to contain %q, but got:\n%s", want, got)
+				}
+			}
+		})
+	}
+}
+
+func Test_InstrumentMain_agentErrors(t *testing.T) {
+	tests := []struct {
+		name           string
+		code           string
+		onError        string
+		wantContain    []string
+		wantNotContain []string
+	}{
+		{
+			name: "log_with_app_logger",
+			code: `
+package main
+import (
+	"log"
+	"os"
+)
+func main() {
+	logger := log.New(os.Stderr, "app: ", log.LstdFlags)
+	logger.Println("started")
+}
+`,
+			onError: agentErrorLog,
+			wantContain: []string{
+				"logger := log.New(os.Stderr, \"app: \", log.LstdFlags)\n\n\tNewRelicAgent, nrErr := newrelic.NewApplication(",
+				`logger.Printf("failed to create New Relic application: %v", nrErr)`,
+				"defer NewRelicAgent.Shutdown(5 * time.Second)\n\n\tlogger.Println(\"started\")",
+			},
+		},
+		{
+			name: "exit_with_app_logger",
+			code: `
+package main
+import (
+	"log/slog"
+	"os"
+)
+func main() {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	logger.Info("started")
+}
+`,
+			onError: agentErrorExit,
+			wantContain: []string{
+				`logger.Error("failed to create New Relic application", "error", nrErr)`,
+				"os.Exit(1)",
+			},
+		},
+		{
+			name: "return_from_run",
+			code: `
+package main
+import "log"
+func main() {
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+func run() error {
+	log.Println("running")
+	return nil
+}
+`,
+			onError: agentErrorReturn,
+			wantContain: []string{
+				"func run() error {\n\tNewRelicAgent, nrErr := newrelic.NewApplication(",
+				`return fmt.Errorf("failed to create New Relic application: %w", nrErr)`,
+				"defer NewRelicAgent.Shutdown(5 * time.Second)",
+			},
+			wantNotContain: []string{
+				"panic(nrErr)",
+			},
+		},
+		{
+			name: "panic_in_run",
+			code: `
+package main
+import "log"
+func main() {
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+func run() error {
+	log.Println("running")
+	return nil
+}
+`,
+			wantContain: []string{
+				"func run() error {\n\tNewRelicAgent, nrErr := newrelic.NewApplication(",
+				"panic(nrErr)",
+			},
+			wantNotContain: []string{
+				"func main() {\n\tNewRelicAgent",
+			},
+		},
+		{
+			name: "run_declares_err",
+			code: `
+package main
+import (
+	"log"
+	"net/http"
+)
+func main() {
+	err := run()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+func run() error {
+	err := http.ListenAndServe(":8000", nil)
+	return err
+}
+`,
+			onError: agentErrorReturn,
+			wantContain: []string{
+				"func run() error {\n\tNewRelicAgent, nrErr := newrelic.NewApplication(",
+				`return fmt.Errorf("failed to create New Relic application: %w", nrErr)`,
+				"err := http.ListenAndServe(\":8000\", nil)\n\treturn err",
+			},
+		},
+		{
+			name: "return_without_run_logs",
+			code: `
+package main
+import "log"
+func main() {
+	log.Println("running")
+}
+`,
+			onError: agentErrorReturn,
+			wantContain: []string{
+				`log.Printf("failed to create New Relic application: %v", nrErr)`,
+			},
+			wantNotContain: []string{
+				"fmt.Errorf",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, tt.code)
+			manager.agentOptions.OnError = tt.onError
+			if err := tracePackageFunctionCalls(manager); err != nil {
+				t.Fatal(err)
+			}
+			instrumentPackages(manager, InstrumentMain)
+
+			got := restoreTestFile(t, manager.GetDecoratorPackage().Syntax[0])
+			for _, want := range tt.wantContain {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected instrumented code to contain %q, but got:\n%s", want, got)
+				}
+			}
+			for _, notWant := range tt.wantNotContain {
+				if strings.Contains(got, notWant) {
+					t.Errorf("expected instrumented code not to contain %q, but got:\n%s", notWant, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"go/token"
+	"sort"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/dstutil"
+)
+
+const (
+	// package variable that holds the application, so that functions outside of main can use it
+	backgroundAppVariable = "nrApp"
+
+	// exported function that sets the application of a package other than the one it is created in
+	applicationSetter = "SetNewRelicApplication"
+)
+
+const backgroundAppSource = `package helper
+
+import "github.com/newrelic/go-agent/v3/newrelic"
+
+// nrApp is the New Relic application used to start transactions outside of main.
+var nrApp *newrelic.Application
+`
+
+const applicationSetterSource = `package helper
+
+import "github.com/newrelic/go-agent/v3/newrelic"
+
+// SetNewRelicApplication sets the New Relic application this package is instrumented with. It is called by main
+// once the application is created.
+func SetNewRelicApplication(app *newrelic.Application) {
+	nrApp = app
+}
+`
+
+// agentFunction is a function that an application is created in, and the ID of its package.
+type agentFunction struct {
+	pkgID string
+	decl  *dst.FuncDecl
+}
+
+// agentFunctions returns the functions applications are created in, one for each binary, sorted by package.
+func (m *InstrumentationManager) agentFunctions() []agentFunction {
+	agents := []agentFunction{}
+	for id, state := range m.packages {
+		if state.agentDecl != nil {
+			agents = append(agents, agentFunction{pkgID: id, decl: state.agentDecl})
+		}
+	}
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].pkgID < agents[j].pkgID
+	})
+	return agents
+}
+
+// importsPackage returns true if a package of the application imports another, directly or through other packages
+// of the application.
+func (m *InstrumentationManager) importsPackage(pkgID, importID string) bool {
+	visited := map[string]bool{}
+	var visit func(id string) bool
+	visit = func(id string) bool {
+		state, ok := m.packages[id]
+		if !ok || visited[id] {
+			return false
+		}
+		visited[id] = true
+		for path := range state.pkg.Imports {
+			if path == importID || visit(path) {
+				return true
+			}
+		}
+		return false
+	}
+	return visit(pkgID)
+}
+
+// sharingAgents returns the functions creating an application that can share it with the current package: the
+// function of the same package, or of binaries that import it. Main packages can not be imported by other binaries.
+func (m *InstrumentationManager) sharingAgents() []agentFunction {
+	state, ok := m.packages[m.currentPackage]
+	if !ok {
+		return nil
+	}
+
+	agents := []agentFunction{}
+	for _, agent := range m.agentFunctions() {
+		if applicationSharedIndex(agent.decl, m.agentVariableName) < 0 {
+			continue
+		}
+		if agent.pkgID == m.currentPackage || (state.pkg.Name != "main" && m.importsPackage(agent.pkgID, m.currentPackage)) {
+			agents = append(agents, agent)
+		}
+	}
+	return agents
+}
+
+// isApplicationShare returns true if a statement shares the application with a package: nrApp = app, or
+// pkg.SetNewRelicApplication(app)
+func isApplicationShare(stmt dst.Stmt) bool {
+	switch v := stmt.(type) {
+	case *dst.AssignStmt:
+		ident, ok := v.Lhs[0].(*dst.Ident)
+		return ok && ident.Name == backgroundAppVariable
+	case *dst.ExprStmt:
+		call, ok := v.X.(*dst.CallExpr)
+		if !ok {
+			return false
+		}
+		ident, ok := call.Fun.(*dst.Ident)
+		return ok && ident.Name == applicationSetter
+	}
+	return false
+}
+
+// applicationSharedIndex returns the index in the body of the function the application is created in that the
+// application can be shared at, once the error creating it has been handled, and after it has been shared with other
+// packages. It returns -1 if it is not created there.
+func applicationSharedIndex(agentDecl *dst.FuncDecl, agentVariableName string) int {
+	list := agentDecl.Body.List
+	for i, stmt := range list {
+		assign, ok := stmt.(*dst.AssignStmt)
+		if !ok || len(assign.Lhs) == 0 {
+			continue
+		}
+		if ident, ok := assign.Lhs[0].(*dst.Ident); !ok || ident.Name != agentVariableName {
+			continue
+		}
+		index := i + 1
+		if index < len(list) {
+			if _, ok := list[index].(*dst.IfStmt); ok {
+				index++
+			}
+		}
+		for index < len(list) && isApplicationShare(list[index]) {
+			index++
+		}
+		return index
+	}
+	return -1
+}
+
+// canShareApplication returns true if an application can be shared with the current package, so that a function
+// of it can use the application. Functions that run before the application is created can not use it.
+func (m *InstrumentationManager) canShareApplication(fn *dst.FuncDecl) bool {
+	if fn.Name.Name == "main" || fn.Name.Name == "init" {
+		return false
+	}
+	for _, agent := range m.agentFunctions() {
+		if fn == agent.decl {
+			return false
+		}
+	}
+	return len(m.sharingAgents()) > 0
+}
+
+// shareApplication makes the application available to the functions of the current package through the package
+// variable nrApp. In the package it is created in, the application is assigned to it once it is created. Other
+// packages get a setter that the function creating the application calls, ex: server.SetNewRelicApplication(app).
+// Packages shared by several binaries get the application of whichever binary runs.
+func (m *InstrumentationManager) shareApplication() {
+	state, ok := m.packages[m.currentPackage]
+	if !ok {
+		return
+	}
+	if _, ok := state.helpersAdded[backgroundAppVariable]; ok {
+		return
+	}
+	agents := m.sharingAgents()
+	if len(agents) == 0 {
+		return
+	}
+
+	for _, agent := range agents {
+		var share dst.Stmt = &dst.AssignStmt{
+			Lhs: []dst.Expr{dst.NewIdent(backgroundAppVariable)},
+			Tok: token.ASSIGN,
+			Rhs: []dst.Expr{dst.NewIdent(m.agentVariableName)},
+		}
+		if agent.pkgID != m.currentPackage {
+			share = &dst.ExprStmt{
+				X: &dst.CallExpr{
+					Fun: &dst.Ident{
+						Name: applicationSetter,
+						Path: state.pkg.PkgPath,
+					},
+					Args: []dst.Expr{dst.NewIdent(m.agentVariableName)},
+				},
+			}
+			m.AddHelper(applicationSetter, parseHelperDecls(applicationSetterSource)...)
+		}
+		insertApplicationShare(agent.decl, applicationSharedIndex(agent.decl, m.agentVariableName), share)
+	}
+
+	m.AddImport(newrelicAgentImport)
+	m.AddHelper(backgroundAppVariable, parseHelperDecls(backgroundAppSource)...)
+}
+
+// insertApplicationShare inserts a statement that shares the application at an index of the function it is created
+// in. Statements sharing the application are grouped together.
+func insertApplicationShare(agentDecl *dst.FuncDecl, index int, share dst.Stmt) {
+	if index > 0 && isApplicationShare(agentDecl.Body.List[index-1]) {
+		agentDecl.Body.List[index-1].Decorations().After = dst.NewLine
+	}
+	share.Decorations().After = dst.EmptyLine
+	list := append([]dst.Stmt{}, agentDecl.Body.List[:index]...)
+	list = append(list, share)
+	agentDecl.Body.List = append(list, agentDecl.Body.List[index:]...)
+}
+
+// wrapUntracedHandlers wraps the handlers registered in a function that is not traced by a transaction with the
+// application of its package. It returns true if a handler was wrapped.
+func (m *InstrumentationManager) wrapUntracedHandlers(fn *dst.FuncDecl) bool {
+	wasModified := false
+	dstutil.Apply(fn.Body, nil, func(c *dstutil.Cursor) bool {
+		app := dst.NewIdent(backgroundAppVariable)
+		switch v := c.Node().(type) {
+		case *dst.CallExpr:
+			if wrapHandlerRegistration(m, v, app) || wrapServerHandler(m, v, app) {
+				wasModified = true
+			} else if isFastHttpRouteRegistration(v, m) {
+				wrapFastHttpHandler(v, app)
+				m.AddImport(nrFastHttpImport)
+				wasModified = true
+			}
+		case *dst.CompositeLit:
+			if wrapServerHandler(m, v, app) {
+				wasModified = true
+			}
+		}
+		return true
+	})
+	return wasModified
+}
+
+// InstrumentUntracedHandlers wraps the http handlers registered in functions that are not traced by a transaction,
+// such as the setup functions of packages other than main, with the application shared with their package.
+// Handlers registered before the application is created, ex: in init functions, are not wrapped.
+func (m *InstrumentationManager) InstrumentUntracedHandlers() {
+	pkgNames := make([]string, 0, len(m.packages))
+	for name := range m.packages {
+		pkgNames = append(pkgNames, name)
+	}
+	sort.Strings(pkgNames)
+
+	for _, pkgName := range pkgNames {
+		m.SetPackage(pkgName)
+		for _, file := range m.packages[pkgName].pkg.Syntax {
+			for _, decl := range file.Decls {
+				fn, ok := decl.(*dst.FuncDecl)
+				if !ok || fn.Body == nil || m.isTracedFunction(fn) || !m.canShareApplication(fn) {
+					continue
+				}
+				if m.wrapUntracedHandlers(fn) {
+					m.shareApplication()
+				}
+			}
+		}
+	}
+}
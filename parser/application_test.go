@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_InstrumentUntracedHandlers(t *testing.T) {
+	tests := []struct {
+		name        string
+		files       map[string]string
+		wantContain map[string][]string
+	}{
+		{
+			name: "handlers_in_other_package",
+			files: map[string]string{
+				"main.go": `
+package main
+
+import (
+	"net/http"
+
+	"parser/tmp/server"
+)
+
+func main() {
+	mux := server.Routes()
+	http.ListenAndServe(":8000", mux)
+}
+`,
+				"server/server.go": `
+package server
+
+import "net/http"
+
+func Routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/items", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("items"))
+	})
+	return mux
+}
+`,
+			},
+			wantContain: map[string][]string{
+				"parser/tmp": {
+					"panic(nrErr)\n\t}\n\n\tserver.SetNewRelicApplication(NewRelicAgent)\n\n\tdefer NewRelicAgent.Shutdown",
+				},
+				"parser/tmp/server": {
+					`mux.HandleFunc(newrelic.WrapHandleFunc(nrApp, "/items", func(w http.ResponseWriter, r *http.Request) {`,
+					"var nrApp *newrelic.Application",
+					"func SetNewRelicApplication(app *newrelic.Application) {\n\tnrApp = app\n}",
+				},
+			},
+		},
+		{
+			name: "handlers_in_main_package",
+			files: map[string]string{
+				"main.go": `
+package main
+
+import "net/http"
+
+func main() {
+	srv := newServer()
+	srv.ListenAndServe()
+}
+
+func newServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	return &http.Server{Addr: ":8000", Handler: mux}
+}
+`,
+			},
+			wantContain: map[string][]string{
+				"parser/tmp": {
+					"panic(nrErr)\n\t}\n\n\tnrApp = NewRelicAgent\n\n\tdefer NewRelicAgent.Shutdown",
+					`mux.HandleFunc(newrelic.WrapHandleFunc(nrApp, "/", func(w http.ResponseWriter, r *http.Request) {}))`,
+					"var nrApp *newrelic.Application",
+				},
+			},
+		},
+		{
+			name: "init_not_wrapped",
+			files: map[string]string{
+				"main.go": `
+package main
+
+import "net/http"
+
+func init() {
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+}
+
+func main() {
+	http.ListenAndServe(":8000", nil)
+}
+`,
+			},
+			wantContain: map[string][]string{
+				"parser/tmp": {
+					`http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})`,
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingMultiPackageManager(t, tt.files)
+			if err := tracePackageFunctionCalls(manager); err != nil {
+				t.Fatal(err)
+			}
+			instrumentPackages(manager, InstrumentMain)
+			manager.InstrumentUntracedHandlers()
+			manager.writeHelpers()
+
+			for pkgName, wants := range tt.wantContain {
+				manager.SetPackage(pkgName)
+				pkg := manager.GetDecoratorPackage()
+				if pkg == nil {
+					t.Fatalf("package %s was not loaded", pkgName)
+				}
+				got := restoreTestFile(t, pkg.Syntax[0])
+				for _, want := range wants {
+					if !strings.Contains(got, want) {
+						t.Errorf("expected package %s to contain %q, but got:\n%s", pkgName, want, got)
+					}
+				}
+			}
+		})
+	}
+}
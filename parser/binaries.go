@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+)
+
+// isMainPackage returns true if a package is built into a binary: it is named main, and declares a main function.
+func isMainPackage(pkg *decorator.Package) bool {
+	if pkg.Name != "main" {
+		return false
+	}
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			if fn, ok := decl.(*dst.FuncDecl); ok && fn.Recv == nil && fn.Name.Name == "main" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// binaryDir returns the directory of a main package relative to the application, ex: "cmd/api", or "." when the
+// binary is built from the root of the application.
+func (m *InstrumentationManager) binaryDir(pkg *decorator.Package) string {
+	absAppPath, err := filepath.Abs(m.userAppPath)
+	if err != nil {
+		return pkg.PkgPath
+	}
+	rel, err := filepath.Rel(absAppPath, pkg.Dir)
+	if err != nil {
+		return pkg.PkgPath
+	}
+	return filepath.ToSlash(rel)
+}
+
+// includesBinary returns true if the binary built from a directory is instrumented. When binaries are listed, only
+// those are instrumented, and excluded binaries never are.
+func (o AgentOptions) includesBinary(dir string) bool {
+	for _, excluded := range o.ExcludeBinaries {
+		if path.Clean(excluded) == dir {
+			return false
+		}
+	}
+	if len(o.Binaries) == 0 {
+		return true
+	}
+	for _, included := range o.Binaries {
+		if path.Clean(included) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// binaryAppName returns the name of the application created in the binary built from a directory. Names mapped to
+// the directory by the user are used first. A single binary is named by the -name flag, and several binaries are
+// named after their directory, prefixed by the -name flag if it is set, ex: "shop-api".
+func (m *InstrumentationManager) binaryAppName(dir string, numBinaries int) string {
+	if name, ok := m.agentOptions.AppNames[dir]; ok {
+		return name
+	}
+	if numBinaries == 1 {
+		return m.appName
+	}
+
+	name := path.Base(dir)
+	if dir == "." {
+		if absAppPath, err := filepath.Abs(m.userAppPath); err == nil {
+			name = filepath.Base(absAppPath)
+		}
+	}
+	if m.appName != "" {
+		return m.appName + "-" + name
+	}
+	return name
+}
+
+// selectBinaries finds the main packages of the application, and removes the binaries that are not instrumented
+// from the packages of the manager. Each binary that is instrumented is given the name of its application.
+func (m *InstrumentationManager) selectBinaries() error {
+	binaries := map[string]string{}
+	for id, state := range m.packages {
+		if isMainPackage(state.pkg) {
+			binaries[id] = m.binaryDir(state.pkg)
+		}
+	}
+	if len(binaries) == 0 {
+		return errors.New("cannot find a main method for this application")
+	}
+
+	found := map[string]bool{}
+	for id, dir := range binaries {
+		found[dir] = true
+		if !m.agentOptions.includesBinary(dir) {
+			delete(m.packages, id)
+			delete(binaries, id)
+		}
+	}
+	if len(binaries) == 0 {
+		return errors.New("all binaries of this application are excluded from instrumentation")
+	}
+	for id, dir := range binaries {
+		m.packages[id].appName = m.binaryAppName(dir, len(binaries))
+	}
+
+	listed := append(append([]string{}, m.agentOptions.Binaries...), m.agentOptions.ExcludeBinaries...)
+	for dir := range m.agentOptions.AppNames {
+		listed = append(listed, dir)
+	}
+	sort.Strings(listed)
+	for _, dir := range listed {
+		if !found[path.Clean(dir)] {
+			log.Printf("warning: no main package found in %s", dir)
+		}
+	}
+	return nil
+}
+
+// AppName returns the name of the application created in the current package.
+func (m *InstrumentationManager) AppName() string {
+	state, ok := m.packages[m.currentPackage]
+	if !ok || state.appName == "" {
+		return m.appName
+	}
+	return state.appName
+}
+
+// validateBinaries returns an error if a binary is both included and excluded.
+func (o AgentOptions) validateBinaries() error {
+	for _, included := range o.Binaries {
+		for _, excluded := range o.ExcludeBinaries {
+			if path.Clean(included) == path.Clean(excluded) {
+				return fmt.Errorf("binary %s can not be both included and excluded", included)
+			}
+		}
+	}
+	return nil
+}
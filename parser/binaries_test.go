@@ -0,0 +1,157 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_includesBinary(t *testing.T) {
+	tests := []struct {
+		name    string
+		options AgentOptions
+		dir     string
+		want    bool
+	}{
+		{
+			name: "all_by_default",
+			dir:  "cmd/api",
+			want: true,
+		},
+		{
+			name:    "excluded",
+			options: AgentOptions{ExcludeBinaries: []string{"cmd/migrate/"}},
+			dir:     "cmd/migrate",
+			want:    false,
+		},
+		{
+			name:    "included",
+			options: AgentOptions{Binaries: []string{"cmd/api", "./cmd/worker"}},
+			dir:     "cmd/worker",
+			want:    true,
+		},
+		{
+			name:    "not_included",
+			options: AgentOptions{Binaries: []string{"cmd/api"}},
+			dir:     "cmd/worker",
+			want:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.options.includesBinary(tt.dir); got != tt.want {
+				t.Errorf("includesBinary(%q) = %v, want %v", tt.dir, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_binaryAppName(t *testing.T) {
+	tests := []struct {
+		name        string
+		appName     string
+		appNames    map[string]string
+		dir         string
+		numBinaries int
+		want        string
+	}{
+		{
+			name:        "single_binary",
+			appName:     "shop",
+			dir:         "cmd/api",
+			numBinaries: 1,
+			want:        "shop",
+		},
+		{
+			name:        "directory",
+			dir:         "cmd/api",
+			numBinaries: 2,
+			want:        "api",
+		},
+		{
+			name:        "prefixed_directory",
+			appName:     "shop",
+			dir:         "cmd/worker",
+			numBinaries: 2,
+			want:        "shop-worker",
+		},
+		{
+			name:        "mapped",
+			appName:     "shop",
+			appNames:    map[string]string{"cmd/api": "Shop API"},
+			dir:         "cmd/api",
+			numBinaries: 2,
+			want:        "Shop API",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := &InstrumentationManager{appName: tt.appName, agentOptions: AgentOptions{AppNames: tt.appNames}}
+			if got := manager.binaryAppName(tt.dir, tt.numBinaries); got != tt.want {
+				t.Errorf("binaryAppName(%q) = %q, want %q", tt.dir, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_selectBinaries(t *testing.T) {
+	mainCode := `
+package main
+
+import "parser/tmp/jobs"
+
+func main() {
+	jobs.Start()
+}
+`
+	files := map[string]string{
+		"cmd/api/main.go":     mainCode,
+		"cmd/worker/main.go":  mainCode,
+		"cmd/migrate/main.go": mainCode,
+		"jobs/jobs.go": `
+package jobs
+
+import "net/http"
+
+func Start() {
+	http.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {})
+}
+`,
+	}
+
+	manager := newTestingMultiPackageManager(t, files)
+	manager.agentOptions = AgentOptions{
+		AppNames:        map[string]string{"cmd/worker": "Jobs Worker"},
+		ExcludeBinaries: []string{"cmd/migrate"},
+	}
+	if err := tracePackageFunctionCalls(manager); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := manager.packages["parser/tmp/cmd/migrate"]; ok {
+		t.Error("expected excluded binary cmd/migrate not to be instrumented")
+	}
+	instrumentPackages(manager, InstrumentMain)
+	manager.InstrumentUntracedHandlers()
+
+	wantNames := map[string]string{
+		"parser/tmp/cmd/api":    `newrelic.ConfigAppName("api")`,
+		"parser/tmp/cmd/worker": `newrelic.ConfigAppName("Jobs Worker")`,
+	}
+	for pkgName, want := range wantNames {
+		manager.SetPackage(pkgName)
+		got := restoreTestFile(t, manager.GetDecoratorPackage().Syntax[0])
+		if !strings.Contains(got, want) {
+			t.Errorf("expected package %s to contain %q, but got:\n%s", pkgName, want, got)
+		}
+	}
+}
+
+func Test_selectBinaries_allExcluded(t *testing.T) {
+	manager := newTestingInstrumentationManager(t, `
+package main
+func main() {}
+`)
+	manager.agentOptions = AgentOptions{ExcludeBinaries: []string{"."}}
+	if err := tracePackageFunctionCalls(manager); err == nil {
+		t.Error("expected an error when every binary is excluded")
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"go/ast"
+	"go/types"
+	"sort"
+	"strings"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+)
+
+const (
+	CobraPath   = "github.com/spf13/cobra"
+	UrfaveCliV2 = "github.com/urfave/cli/v2"
+	UrfaveCliV3 = "github.com/urfave/cli/v3"
+)
+
+// cliCommand describes a type of the cobra or urfave/cli packages that runs a function for a command line command.
+type cliCommand struct {
+	fields    []string // fields of the type that hold the function run by the command
+	param     int      // index of the parameter of that function that identifies the command
+	paramName string   // name given to that parameter when it has none
+	nameSel   []string // selectors of the parameter that name the command
+	nameCall  bool     // whether the last selector is a method that is called to get the name
+}
+
+// cliCommands are the command types of supported command line packages, by type name
+var cliCommands = map[string]cliCommand{
+	CobraPath + ".Command": {
+		fields:    []string{"Run", "RunE"},
+		param:     0,
+		paramName: "nrCmd",
+		nameSel:   []string{"CommandPath"},
+		nameCall:  true,
+	},
+	UrfaveCliV2 + ".Command": {
+		fields:    []string{"Action"},
+		param:     0,
+		paramName: "nrCtx",
+		nameSel:   []string{"Command", "FullName"},
+		nameCall:  true,
+	},
+	UrfaveCliV2 + ".App": {
+		fields:    []string{"Action"},
+		param:     0,
+		paramName: "nrCtx",
+		nameSel:   []string{"App", "Name"},
+	},
+	UrfaveCliV3 + ".Command": {
+		fields:    []string{"Action"},
+		param:     1,
+		paramName: "nrCmd",
+		nameSel:   []string{"FullName"},
+		nameCall:  true,
+	},
+}
+
+// cliRunMethods are the methods that run a command line application, by the type they are called on
+var cliRunMethods = map[string][]string{
+	"*" + CobraPath + ".Command":   {"Execute", "ExecuteC", "ExecuteContext", "ExecuteContextC"},
+	"*" + UrfaveCliV2 + ".App":     {"Run", "RunContext"},
+	"*" + UrfaveCliV3 + ".Command": {"Run"},
+}
+
+// cliCommandType returns the command type a composite literal creates, if it is one of a supported command line package.
+func cliCommandType(lit *dst.CompositeLit, pkg *decorator.Package) (cliCommand, bool) {
+	if pkg == nil || pkg.TypesInfo == nil {
+		return cliCommand{}, false
+	}
+	astLit, ok := pkg.Decorator.Ast.Nodes[lit].(ast.Expr)
+	if !ok {
+		return cliCommand{}, false
+	}
+	t := pkg.TypesInfo.TypeOf(astLit)
+	if t == nil {
+		return cliCommand{}, false
+	}
+	// elements of a slice of pointers can elide their type, ex: []*cli.Command{{Name: "serve"}}
+	if ptr, ok := t.(*types.Pointer); ok {
+		t = ptr.Elem()
+	}
+	cmd, ok := cliCommands[t.String()]
+	return cmd, ok
+}
+
+// runsCommandLine returns true if an invoked function runs a command line application, ex: rootCmd.Execute().
+// Commands get their own transactions, so such functions are not traced by one.
+func (m *InstrumentationManager) runsCommandLine(inv *invocationInfo) bool {
+	state, ok := m.packages[inv.packageName]
+	if !ok {
+		return false
+	}
+	fn, ok := state.tracedFuncs[inv.functionName]
+	if !ok {
+		return false
+	}
+	return callsCliRunMethod(fn.body, state.pkg)
+}
+
+// callsCliRunMethod returns true if a function calls a method that runs a command line application.
+func callsCliRunMethod(fn *dst.FuncDecl, pkg *decorator.Package) bool {
+	if fn == nil {
+		return false
+	}
+	found := false
+	dst.Inspect(fn.Body, func(n dst.Node) bool {
+		if call, ok := n.(*dst.CallExpr); ok && isCliRunCall(call, pkg) {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// isCliRunCall returns true if a call is to a method that runs a command line application, ex: rootCmd.Execute().
+func isCliRunCall(call *dst.CallExpr, pkg *decorator.Package) bool {
+	if pkg == nil || pkg.TypesInfo == nil {
+		return false
+	}
+	sel, ok := call.Fun.(*dst.SelectorExpr)
+	if !ok {
+		return false
+	}
+	astExpr, ok := pkg.Decorator.Ast.Nodes[sel.X].(ast.Expr)
+	if !ok {
+		return false
+	}
+	t := pkg.TypesInfo.TypeOf(astExpr)
+	if t == nil {
+		return false
+	}
+	if _, isPtr := t.(*types.Pointer); !isPtr {
+		t = types.NewPointer(t)
+	}
+	for _, method := range cliRunMethods[t.String()] {
+		if sel.Sel.Name == method {
+			return true
+		}
+	}
+	return false
+}
+
+// runsCommandLineOf returns true if a node runs a command line application on what an invoked function returns,
+// ex: newRootCmd().Execute(). The function only builds the application, so it is not traced by a transaction.
+func runsCommandLineOf(node dst.Node, inv *invocationInfo, pkg *decorator.Package) bool {
+	if inv == nil {
+		return false
+	}
+	found := false
+	dst.Inspect(node, func(n dst.Node) bool {
+		call, ok := n.(*dst.CallExpr)
+		if !ok || found {
+			return !found
+		}
+		if !isCliRunCall(call, pkg) {
+			return true
+		}
+		dst.Inspect(call.Fun.(*dst.SelectorExpr).X, func(m dst.Node) bool {
+			if m == inv.call {
+				found = true
+			}
+			return !found
+		})
+		return !found
+	})
+	return found
+}
+
+// commandParam returns the name of the parameter of a command function that identifies the command. Parameters
+// without a name are given one, so that the command can be named by the transaction.
+func commandParam(fnType *dst.FuncType, cmd cliCommand) string {
+	if fnType.Params == nil {
+		return ""
+	}
+	fields := fnType.Params.List
+	named := false
+	for _, field := range fields {
+		if len(field.Names) > 0 {
+			named = true
+		}
+	}
+
+	i := 0
+	for _, field := range fields {
+		if !named {
+			name := "_"
+			if i == cmd.param {
+				name = cmd.paramName
+			}
+			field.Names = []*dst.Ident{dst.NewIdent(name)}
+			i++
+			continue
+		}
+		for _, ident := range field.Names {
+			if i == cmd.param {
+				if ident.Name == "_" {
+					ident.Name = cmd.paramName
+				}
+				return ident.Name
+			}
+			i++
+		}
+	}
+	if !named && cmd.param < i {
+		return cmd.paramName
+	}
+	return ""
+}
+
+// commandTransaction creates the statements that start a background transaction named after the path of the command
+// identified by param, and end it when the command returns.
+func commandTransaction(cmd cliCommand, param string) []dst.Stmt {
+	var name dst.Expr = dst.NewIdent(param)
+	for _, sel := range cmd.nameSel {
+		name = &dst.SelectorExpr{
+			X:   name,
+			Sel: dst.NewIdent(sel),
+		}
+	}
+	if cmd.nameCall {
+		name = &dst.CallExpr{Fun: name}
+	}
+	txnStart := startTransaction(backgroundAppVariable, defaultTxnName, "", false)
+	txnStart.Rhs[0].(*dst.CallExpr).Args = []dst.Expr{name}
+	txnEnd := &dst.DeferStmt{
+		Call: endTransaction(defaultTxnName).X.(*dst.CallExpr),
+		Decs: dst.DeferStmtDecorations{
+			NodeDecs: dst.NodeDecs{
+				After: dst.EmptyLine,
+			},
+		},
+	}
+	return []dst.Stmt{txnStart, txnEnd}
+}
+
+// instrumentCommandFunc traces a function run by a command, and starts a background transaction for each run of it.
+// It returns true if the function was instrumented.
+func (m *InstrumentationManager) instrumentCommandFunc(fn dst.Expr, cmd cliCommand) bool {
+	switch v := fn.(type) {
+	case *dst.FuncLit:
+		param := commandParam(v.Type, cmd)
+		if param == "" {
+			return false
+		}
+		traceFuncLit(m, v, defaultTxnName)
+		v.Body.List = append(commandTransaction(cmd, param), v.Body.List...)
+		return true
+	case *dst.Ident:
+		if v.Path != "" {
+			return false
+		}
+		decl := m.GetDeclaration(v.Name)
+		if decl == nil || decl.Recv != nil || m.isTracedFunction(decl) {
+			return false
+		}
+		param := commandParam(decl.Type, cmd)
+		if param == "" {
+			return false
+		}
+		newFn, _ := TraceFunction(m, decl, defaultTxnName)
+		newFn.Body.List = append(commandTransaction(cmd, param), newFn.Body.List...)
+		return true
+	}
+	return false
+}
+
+// instrumentCommandLit instruments the functions run by a command line command created by a composite literal.
+// It returns true if a function was instrumented.
+func (m *InstrumentationManager) instrumentCommandLit(lit *dst.CompositeLit, cmd cliCommand) bool {
+	wasModified := false
+	for _, elt := range lit.Elts {
+		kv, ok := elt.(*dst.KeyValueExpr)
+		if !ok {
+			continue
+		}
+		key, ok := kv.Key.(*dst.Ident)
+		if !ok {
+			continue
+		}
+		for _, field := range cmd.fields {
+			if key.Name == field && m.instrumentCommandFunc(kv.Value, cmd) {
+				wasModified = true
+			}
+		}
+	}
+	return wasModified
+}
+
+// InstrumentCliCommands starts a background transaction for each run of a cobra or urfave/cli command, named after
+// the path of the command, ex: "app serve". The application is shared with the packages the commands are created in.
+func (m *InstrumentationManager) InstrumentCliCommands() {
+	pkgNames := make([]string, 0, len(m.packages))
+	for name := range m.packages {
+		pkgNames = append(pkgNames, name)
+	}
+	sort.Strings(pkgNames)
+
+	for _, pkgName := range pkgNames {
+		m.SetPackage(pkgName)
+		pkg := m.packages[pkgName].pkg
+		if !importsCliPackage(pkg) || len(m.sharingAgents()) == 0 {
+			continue
+		}
+		wasModified := false
+		for _, file := range pkg.Syntax {
+			dst.Inspect(file, func(n dst.Node) bool {
+				lit, ok := n.(*dst.CompositeLit)
+				if !ok {
+					return true
+				}
+				if cmd, ok := cliCommandType(lit, pkg); ok && m.instrumentCommandLit(lit, cmd) {
+					wasModified = true
+				}
+				return true
+			})
+		}
+		if wasModified {
+			m.shareApplication()
+		}
+	}
+}
+
+// importsCliPackage returns true if a package imports a supported command line package.
+func importsCliPackage(pkg *decorator.Package) bool {
+	for path := range pkg.Imports {
+		if path == CobraPath || strings.HasPrefix(path, "github.com/urfave/cli/") {
+			return true
+		}
+	}
+	return false
+}
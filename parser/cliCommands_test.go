@@ -0,0 +1,314 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dave/dst"
+)
+
+// cliStubFiles are stubs of the command line packages, that test applications are built with
+var cliStubFiles = map[string]string{
+	"go.mod": `module parser/tmp
+
+go 1.22
+
+require (
+	github.com/spf13/cobra v1.8.0
+	github.com/urfave/cli/v2 v2.27.0
+)
+
+replace github.com/spf13/cobra => ./stubs/cobra
+
+replace github.com/urfave/cli/v2 => ./stubs/cli
+`,
+	"stubs/cobra/go.mod": "module github.com/spf13/cobra\n\ngo 1.22\n",
+	"stubs/cobra/command.go": `package cobra
+
+type Command struct {
+	Use  string
+	Run  func(cmd *Command, args []string)
+	RunE func(cmd *Command, args []string) error
+}
+
+func (c *Command) AddCommand(cmds ...*Command) {}
+func (c *Command) Execute() error             { return nil }
+func (c *Command) CommandPath() string        { return c.Use }
+`,
+	"stubs/cli/go.mod": "module github.com/urfave/cli/v2\n\ngo 1.22\n",
+	"stubs/cli/app.go": `package cli
+
+type Context struct {
+	App     *App
+	Command *Command
+}
+
+type Command struct {
+	Name   string
+	Action func(*Context) error
+}
+
+func (c *Command) FullName() string { return c.Name }
+
+type App struct {
+	Name     string
+	Action   func(*Context) error
+	Commands []*Command
+}
+
+func (a *App) Run(arguments []string) error { return nil }
+`,
+}
+
+func Test_commandParam(t *testing.T) {
+	tests := []struct {
+		name       string
+		params     []*dst.Field
+		cmd        cliCommand
+		want       string
+		wantParams []string
+	}{
+		{
+			name:       "named",
+			params:     []*dst.Field{{Names: []*dst.Ident{dst.NewIdent("cmd"), dst.NewIdent("args")}}},
+			cmd:        cliCommands[CobraPath+".Command"],
+			want:       "cmd",
+			wantParams: []string{"cmd", "args"},
+		},
+		{
+			name:       "blank",
+			params:     []*dst.Field{{Names: []*dst.Ident{dst.NewIdent("_")}}, {Names: []*dst.Ident{dst.NewIdent("args")}}},
+			cmd:        cliCommands[CobraPath+".Command"],
+			want:       "nrCmd",
+			wantParams: []string{"nrCmd", "args"},
+		},
+		{
+			name:       "unnamed",
+			params:     []*dst.Field{{}, {}},
+			cmd:        cliCommands[UrfaveCliV3+".Command"],
+			want:       "nrCmd",
+			wantParams: []string{"_", "nrCmd"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fnType := &dst.FuncType{Params: &dst.FieldList{List: tt.params}}
+			if got := commandParam(fnType, tt.cmd); got != tt.want {
+				t.Errorf("commandParam() = %q, want %q", got, tt.want)
+			}
+			gotParams := []string{}
+			for _, field := range fnType.Params.List {
+				for _, ident := range field.Names {
+					gotParams = append(gotParams, ident.Name)
+				}
+			}
+			if strings.Join(gotParams, ",") != strings.Join(tt.wantParams, ",") {
+				t.Errorf("params = %v, want %v", gotParams, tt.wantParams)
+			}
+		})
+	}
+}
+
+func Test_InstrumentCliCommands(t *testing.T) {
+	tests := []struct {
+		name           string
+		files          map[string]string
+		wantContain    map[string][]string
+		wantNotContain map[string][]string
+	}{
+		{
+			name: "cobra_commands",
+			files: map[string]string{
+				"main.go": `
+package main
+
+import "parser/tmp/cmd"
+
+func main() {
+	cmd.Execute()
+}
+`,
+				"cmd/root.go": `
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var rootCmd = &cobra.Command{Use: "shop"}
+
+var serveCmd = &cobra.Command{
+	Use: "serve",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		fmt.Println("serving")
+		return nil
+	},
+}
+
+var migrateCmd = &cobra.Command{
+	Use: "migrate",
+	Run: migrate,
+}
+
+func migrate(_ *cobra.Command, args []string) {
+	fmt.Println("migrating")
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd, migrateCmd)
+}
+
+func Execute() {
+	if err := rootCmd.Execute(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+`,
+			},
+			wantContain: map[string][]string{
+				"parser/tmp": {
+					"cmd.SetNewRelicApplication(NewRelicAgent)",
+					"\tcmd.Execute()\n}",
+				},
+				"parser/tmp/cmd": {
+					"RunE: func(cmd *cobra.Command, args []string) error {\n\t\tnrTxn := nrApp.StartTransaction(cmd.CommandPath())\n\t\tdefer nrTxn.End()\n",
+					"func migrate(nrCmd *cobra.Command, args []string) {\n\tnrTxn := nrApp.StartTransaction(nrCmd.CommandPath())\n\tdefer nrTxn.End()\n",
+				},
+			},
+			wantNotContain: map[string][]string{
+				"parser/tmp": {
+					`StartTransaction("Execute")`,
+				},
+			},
+		},
+		{
+			name: "cobra_command_constructor",
+			files: map[string]string{
+				"main.go": `
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/spf13/cobra"
+)
+
+func newRootCmd() *cobra.Command {
+	return &cobra.Command{
+		Use: "shop",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, err := http.Get("http://shop.example")
+			return err
+		},
+	}
+}
+
+func main() {
+	if err := newRootCmd().Execute(); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("done")
+}
+`,
+			},
+			wantContain: map[string][]string{
+				"parser/tmp": {
+					"func newRootCmd() *cobra.Command {",
+					"	if err := newRootCmd().Execute(); err != nil {",
+					"nrTxn := nrApp.StartTransaction(cmd.CommandPath())",
+					"\t\t\t_, err := http.Get(\"http://shop.example\")\n\t\t\tnrTxn.NoticeError(err)\n\t\t\treturn err",
+				},
+			},
+			wantNotContain: map[string][]string{
+				"parser/tmp": {
+					`StartTransaction("newRootCmd")`,
+					"newRootCmd(nrTxn",
+				},
+			},
+		},
+		{
+			name: "urfave_app",
+			files: map[string]string{
+				"main.go": `
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/urfave/cli/v2"
+)
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run() error {
+	app := &cli.App{
+		Name: "shop",
+		Action: func(c *cli.Context) error {
+			return nil
+		},
+		Commands: []*cli.Command{
+			{
+				Name: "serve",
+				Action: func(c *cli.Context) error {
+					return nil
+				},
+			},
+		},
+	}
+	return app.Run(os.Args)
+}
+`,
+			},
+			wantContain: map[string][]string{
+				"parser/tmp": {
+					"func run() error {\n\tNewRelicAgent, nrErr := newrelic.NewApplication(",
+					"nrApp = NewRelicAgent",
+					"nrTxn := nrApp.StartTransaction(c.App.Name)",
+					"nrTxn := nrApp.StartTransaction(c.Command.FullName())",
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]string{}
+			for name, code := range cliStubFiles {
+				files[name] = code
+			}
+			for name, code := range tt.files {
+				files[name] = code
+			}
+			manager := newTestingMultiPackageManager(t, files)
+			if err := tracePackageFunctionCalls(manager); err != nil {
+				t.Fatal(err)
+			}
+			instrumentPackages(manager, InstrumentMain)
+			manager.InstrumentCliCommands()
+
+			for pkgName, wants := range tt.wantContain {
+				manager.SetPackage(pkgName)
+				got := restoreTestFile(t, manager.GetDecoratorPackage().Syntax[0])
+				for _, want := range wants {
+					if !strings.Contains(got, want) {
+						t.Errorf("expected package %s to contain %q, but got:\n%s", pkgName, want, got)
+					}
+				}
+				for _, notWant := range tt.wantNotContain[pkgName] {
+					if strings.Contains(got, notWant) {
+						t.Errorf("expected package %s not to contain %q, but got:\n%s", pkgName, notWant, got)
+					}
+				}
+			}
+		})
+	}
+}
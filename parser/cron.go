@@ -0,0 +1,297 @@
+package main
+
+import (
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"sort"
+	"strconv"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+)
+
+const (
+	CronPath = "github.com/robfig/cron/v3"
+
+	// attribute of the transactions of cron jobs that records their schedule
+	cronScheduleAttribute = "cron.schedule"
+
+	// helper that wraps cron jobs in a background transaction
+	cronJobHelper = "newRelicCronJob"
+)
+
+const cronJobHelperSource = `package helper
+
+import cron "github.com/robfig/cron/v3"
+
+// newRelicCronJob wraps a cron job so that each run of it is a background transaction named after the job, with the
+// schedule of the job as an attribute.
+func newRelicCronJob(name, schedule string, job cron.Job) cron.Job {
+	return cron.FuncJob(func() {
+		nrTxn := nrApp.StartTransaction(name)
+		defer nrTxn.End()
+		if schedule != "" {
+			nrTxn.AddAttribute("cron.schedule", schedule)
+		}
+		job.Run()
+	})
+}
+`
+
+// scheduledJob is a call that registers a job that runs later, and the arguments of the call that hold its schedule
+// and the job.
+type scheduledJob struct {
+	call     *dst.CallExpr
+	schedule dst.Expr // cron spec of the job, nil for timers
+	job      int      // index of the argument that is the job
+	isFunc   bool     // whether the job is a function, or implements cron.Job
+}
+
+// findScheduledJob returns the job registered by a call, if it is c.AddFunc(spec, fn) or c.AddJob(spec, job) on a
+// cron scheduler, or time.AfterFunc(d, fn). It returns nil for other calls.
+func findScheduledJob(call *dst.CallExpr, pkg *decorator.Package) *scheduledJob {
+	if len(call.Args) != 2 {
+		return nil
+	}
+	switch fun := call.Fun.(type) {
+	case *dst.Ident:
+		if fun.Path == "time" && fun.Name == "AfterFunc" {
+			return &scheduledJob{call: call, job: 1, isFunc: true}
+		}
+	case *dst.SelectorExpr:
+		if fun.Sel.Name != "AddFunc" && fun.Sel.Name != "AddJob" {
+			return nil
+		}
+		if pkg == nil || pkg.TypesInfo == nil {
+			return nil
+		}
+		astExpr, ok := pkg.Decorator.Ast.Nodes[fun.X].(ast.Expr)
+		if !ok {
+			return nil
+		}
+		if t := pkg.TypesInfo.TypeOf(astExpr); t == nil || t.String() != "*"+CronPath+".Cron" {
+			return nil
+		}
+		return &scheduledJob{call: call, schedule: call.Args[0], job: 1, isFunc: fun.Sel.Name == "AddFunc"}
+	}
+	return nil
+}
+
+// constantString returns the value of an expression if it is a constant string, ex: "@every 1m"
+func constantString(expr dst.Expr, pkg *decorator.Package) (string, bool) {
+	if lit, ok := expr.(*dst.BasicLit); ok && lit.Kind == token.STRING {
+		value, err := strconv.Unquote(lit.Value)
+		return value, err == nil
+	}
+	if pkg == nil || pkg.TypesInfo == nil {
+		return "", false
+	}
+	astExpr, ok := pkg.Decorator.Ast.Nodes[expr].(ast.Expr)
+	if !ok {
+		return "", false
+	}
+	tv, ok := pkg.TypesInfo.Types[astExpr]
+	if !ok || tv.Value == nil || tv.Value.Kind() != constant.String {
+		return "", false
+	}
+	return constant.StringVal(tv.Value), true
+}
+
+// jobTransaction creates the statements that start a background transaction for a run of a job, end it when the
+// job returns, and record the schedule of the job as an attribute when it is known.
+func jobTransaction(name, schedule string) []dst.Stmt {
+	stmts := []dst.Stmt{
+		startTransaction(backgroundAppVariable, defaultTxnName, name, false),
+		deferEndTransaction(defaultTxnName),
+	}
+	if schedule != "" {
+		stmts = append(stmts, &dst.ExprStmt{
+			X: &dst.CallExpr{
+				Fun: &dst.SelectorExpr{
+					X:   dst.NewIdent(defaultTxnName),
+					Sel: dst.NewIdent("AddAttribute"),
+				},
+				Args: []dst.Expr{stringLit(cronScheduleAttribute), stringLit(schedule)},
+			},
+		})
+	}
+	stmts[len(stmts)-1].Decorations().After = dst.EmptyLine
+	return stmts
+}
+
+// jobName returns the name of the transactions of a job that is a function literal: the first function of the
+// package it calls, or the function it is registered in.
+func (m *InstrumentationManager) jobName(lit *dst.FuncLit, registeredIn *dst.FuncDecl) string {
+	for _, stmt := range lit.Body.List {
+		if invInfo := m.GetPackageFunctionInvocation(stmt); invInfo != nil && invInfo.packageName == m.currentPackage {
+			return invInfo.functionName
+		}
+	}
+	return funcDeclName(registeredIn)
+}
+
+// instrumentJobFunc starts a background transaction for each run of a function registered as a job, named after
+// it. Function literals registered in traced functions are already traced, and only get a transaction of their own.
+// Functions of the package are traced, and called by a function literal that starts the transaction. It returns the
+// instrumented job, or nil if the function can not be instrumented.
+func (m *InstrumentationManager) instrumentJobFunc(fn dst.Expr, schedule string, registeredIn *dst.FuncDecl) dst.Expr {
+	switch v := fn.(type) {
+	case *dst.FuncLit:
+		if v.Type.Params != nil && len(v.Type.Params.List) > 0 {
+			return nil
+		}
+		name := m.jobName(v, registeredIn)
+		if !m.isTracedFunction(registeredIn) {
+			traceFuncLit(m, v, defaultTxnName)
+		}
+		v.Body.List = append(jobTransaction(name, schedule), v.Body.List...)
+		return v
+	case *dst.Ident:
+		if v.Path != "" {
+			return nil
+		}
+		decl := m.GetDeclaration(v.Name)
+		if decl == nil || decl.Recv != nil || (decl.Type.Params != nil && len(decl.Type.Params.List) > 0) {
+			return nil
+		}
+		call := &dst.CallExpr{Fun: dst.NewIdent(v.Name)}
+		invInfo := &invocationInfo{
+			functionName: v.Name,
+			packageName:  m.currentPackage,
+			call:         call,
+		}
+		traceInvokedFunction(m, invInfo)
+		if m.RequiresTransactionArgument(invInfo, defaultTxnName) {
+			call.Args = append(call.Args, dst.NewIdent(defaultTxnName))
+		}
+		return &dst.FuncLit{
+			Type: &dst.FuncType{},
+			Body: &dst.BlockStmt{
+				List: append(jobTransaction(v.Name, schedule), &dst.ExprStmt{X: call}),
+			},
+		}
+	}
+	return nil
+}
+
+// cronJobName returns the name of the transactions of a job that implements cron.Job: the name of its type.
+func cronJobName(job dst.Expr, pkg *decorator.Package) string {
+	if pkg == nil || pkg.TypesInfo == nil {
+		return "cron job"
+	}
+	astExpr, ok := pkg.Decorator.Ast.Nodes[job].(ast.Expr)
+	if !ok {
+		return "cron job"
+	}
+	t := pkg.TypesInfo.TypeOf(astExpr)
+	if ptr, ok := t.(*types.Pointer); ok {
+		t = ptr.Elem()
+	}
+	if named, ok := t.(*types.Named); ok {
+		return named.Obj().Name()
+	}
+	return "cron job"
+}
+
+// instrumentScheduledJob starts a background transaction for each run of a job. Functions are instrumented in place,
+// and other cron jobs are wrapped by a helper that starts it. It returns true if the job was instrumented.
+func (m *InstrumentationManager) instrumentScheduledJob(job *scheduledJob, registeredIn *dst.FuncDecl) bool {
+	pkg := m.GetDecoratorPackage()
+	schedule := ""
+	if job.schedule != nil {
+		schedule, _ = constantString(job.schedule, pkg)
+	}
+	arg := job.call.Args[job.job]
+
+	// cron.FuncJob(fn) is a function registered as a job
+	if conv, ok := arg.(*dst.CallExpr); ok && !job.isFunc && len(conv.Args) == 1 {
+		if fun, ok := conv.Fun.(*dst.Ident); ok && fun.Path == CronPath && fun.Name == "FuncJob" {
+			if instrumented := m.instrumentJobFunc(conv.Args[0], schedule, registeredIn); instrumented != nil {
+				conv.Args[0] = instrumented
+				return true
+			}
+			return false
+		}
+	}
+
+	if job.isFunc {
+		instrumented := m.instrumentJobFunc(arg, schedule, registeredIn)
+		if instrumented == nil {
+			return false
+		}
+		job.call.Args[job.job] = instrumented
+		return true
+	}
+
+	job.call.Args[job.job] = &dst.CallExpr{
+		Fun:  dst.NewIdent(cronJobHelper),
+		Args: []dst.Expr{stringLit(cronJobName(arg, pkg)), stringLit(schedule), arg},
+	}
+	m.AddHelper(cronJobHelper, parseHelperDecls(cronJobHelperSource)...)
+	return true
+}
+
+// isScheduledJobLit returns true if a function literal is a job registered with a scheduler, directly or converted to
+// a cron.FuncJob. Jobs get their own transaction for each run, instead of that of the function they are registered in.
+func isScheduledJobLit(lit *dst.FuncLit, parent dst.Node, pkg *decorator.Package) bool {
+	call, ok := parent.(*dst.CallExpr)
+	if !ok {
+		return false
+	}
+	if fun, ok := call.Fun.(*dst.Ident); ok && fun.Path == CronPath && fun.Name == "FuncJob" {
+		return true
+	}
+	job := findScheduledJob(call, pkg)
+	return job != nil && job.call.Args[job.job] == lit
+}
+
+// InstrumentScheduledJobs starts a background transaction for each run of the jobs registered with a robfig/cron
+// scheduler, c.AddFunc(spec, fn) and c.AddJob(spec, job), and of the functions run by time.AfterFunc. Transactions
+// are named after the job, and record the cron spec of the job when it is a constant. The application is shared with
+// the packages the jobs are registered in.
+func (m *InstrumentationManager) InstrumentScheduledJobs() {
+	pkgNames := make([]string, 0, len(m.packages))
+	for name := range m.packages {
+		pkgNames = append(pkgNames, name)
+	}
+	sort.Strings(pkgNames)
+
+	for _, pkgName := range pkgNames {
+		m.SetPackage(pkgName)
+		pkg := m.packages[pkgName].pkg
+		if !importsSchedulerPackage(pkg) || len(m.sharingAgents()) == 0 {
+			continue
+		}
+		wasModified := false
+		for _, file := range pkg.Syntax {
+			for _, decl := range file.Decls {
+				fn, ok := decl.(*dst.FuncDecl)
+				if !ok || fn.Body == nil {
+					continue
+				}
+				dst.Inspect(fn.Body, func(n dst.Node) bool {
+					call, ok := n.(*dst.CallExpr)
+					if !ok {
+						return true
+					}
+					if job := findScheduledJob(call, pkg); job != nil && m.instrumentScheduledJob(job, fn) {
+						wasModified = true
+					}
+					return true
+				})
+			}
+		}
+		if wasModified {
+			m.shareApplication()
+		}
+	}
+}
+
+// importsSchedulerPackage returns true if a package imports a package that jobs can be scheduled with.
+func importsSchedulerPackage(pkg *decorator.Package) bool {
+	_, importsCron := pkg.Imports[CronPath]
+	_, importsTime := pkg.Imports["time"]
+	return importsCron || importsTime
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dave/dst"
+)
+
+// cronStubFiles are stubs of the cron package, that test applications are built with
+var cronStubFiles = map[string]string{
+	"go.mod": `module parser/tmp
+
+go 1.22
+
+require github.com/robfig/cron/v3 v3.0.1
+
+replace github.com/robfig/cron/v3 => ./stubs/cron
+`,
+	"stubs/cron/go.mod": "module github.com/robfig/cron/v3\n\ngo 1.22\n",
+	"stubs/cron/cron.go": `package cron
+
+type EntryID int
+
+type Job interface {
+	Run()
+}
+
+type FuncJob func()
+
+func (f FuncJob) Run() { f() }
+
+type Cron struct{}
+
+func New() *Cron { return &Cron{} }
+
+func (c *Cron) AddFunc(spec string, cmd func()) (EntryID, error) { return 0, nil }
+func (c *Cron) AddJob(spec string, cmd Job) (EntryID, error)     { return 0, nil }
+func (c *Cron) Start()                                           {}
+`,
+}
+
+func Test_constantString(t *testing.T) {
+	manager := newTestingInstrumentationManager(t, `
+package main
+const every = "@every 1m"
+func main() {
+	spec := "@hourly"
+	_, _ = every, spec
+}
+`)
+	if err := tracePackageFunctionCalls(manager); err != nil {
+		t.Fatal(err)
+	}
+	pkg := manager.GetDecoratorPackage()
+	mainDecl := manager.GetDeclaration("main")
+	// _, _ = every, spec
+	values := mainDecl.Body.List[1].(*dst.AssignStmt).Rhs
+
+	tests := []struct {
+		name   string
+		index  int
+		want   string
+		wantOk bool
+	}{
+		{name: "constant", index: 0, want: "@every 1m", wantOk: true},
+		{name: "variable", index: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := constantString(values[tt.index], pkg)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("constantString() = (%q, %t), want (%q, %t)", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func Test_InstrumentScheduledJobs(t *testing.T) {
+	tests := []struct {
+		name           string
+		files          map[string]string
+		wantContain    map[string][]string
+		wantNotContain map[string][]string
+	}{
+		{
+			name: "cron_jobs",
+			files: map[string]string{
+				"main.go": `
+package main
+
+import (
+	"net/http"
+
+	"github.com/robfig/cron/v3"
+)
+
+const hourly = "@hourly"
+
+type reportJob struct{}
+
+func (reportJob) Run() {}
+
+func main() {
+	c := cron.New()
+	c.AddFunc("@every 1m", func() {
+		sweep()
+	})
+	c.AddFunc(hourly, cleanup)
+	c.AddJob("@daily", reportJob{})
+	c.AddJob("@weekly", cron.FuncJob(cleanup))
+	c.Start()
+	select {}
+}
+
+func sweep() {
+	resp, err := http.Get("http://example.com/sweep")
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+func cleanup() {}
+`,
+			},
+			wantContain: map[string][]string{
+				"parser/tmp": {
+					"panic(nrErr)\n\t}\n\n\tnrApp = NewRelicAgent",
+					"c.AddFunc(\"@every 1m\", func() {\n\t\tnrTxn := nrApp.StartTransaction(\"sweep\")\n\t\tdefer nrTxn.End()\n\t\tnrTxn.AddAttribute(\"cron.schedule\", \"@every 1m\")\n\n\t\tsweep(nrTxn)\n\t})",
+					"c.AddFunc(hourly, func() {\n\t\tnrTxn := nrApp.StartTransaction(\"cleanup\")\n\t\tdefer nrTxn.End()\n\t\tnrTxn.AddAttribute(\"cron.schedule\", \"@hourly\")\n\n\t\tcleanup()\n\t})",
+					`c.AddJob("@daily", newRelicCronJob("reportJob", "@daily", reportJob{}))`,
+					"c.AddJob(\"@weekly\", cron.FuncJob(func() {\n\t\tnrTxn := nrApp.StartTransaction(\"cleanup\")",
+					"func newRelicCronJob(name, schedule string, job cron.Job) cron.Job {",
+					"var nrApp *newrelic.Application",
+				},
+			},
+		},
+		{
+			name: "after_func_in_other_package",
+			files: map[string]string{
+				"main.go": `
+package main
+
+import "parser/tmp/jobs"
+
+func main() {
+	jobs.Schedule()
+	select {}
+}
+`,
+				"jobs/jobs.go": `
+package jobs
+
+import (
+	"net/http"
+	"time"
+)
+
+func Schedule() {
+	time.AfterFunc(time.Minute, func() {
+		http.Get("http://example.com/expire")
+	})
+}
+`,
+			},
+			wantContain: map[string][]string{
+				"parser/tmp": {
+					"jobs.SetNewRelicApplication(NewRelicAgent)",
+				},
+				"parser/tmp/jobs": {
+					"time.AfterFunc(time.Minute, func() {\n\t\tnrTxn := nrApp.StartTransaction(\"Schedule\")\n\t\tdefer nrTxn.End()\n\n",
+					"var nrApp *newrelic.Application",
+				},
+			},
+			wantNotContain: map[string][]string{
+				"parser/tmp/jobs": {
+					"cron.schedule",
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]string{}
+			for name, code := range cronStubFiles {
+				files[name] = code
+			}
+			for name, code := range tt.files {
+				files[name] = code
+			}
+			manager := newTestingMultiPackageManager(t, files)
+			if err := tracePackageFunctionCalls(manager); err != nil {
+				t.Fatal(err)
+			}
+			instrumentPackages(manager, InstrumentMain)
+			manager.InstrumentScheduledJobs()
+			manager.writeHelpers()
+
+			for pkgName, wants := range tt.wantContain {
+				manager.SetPackage(pkgName)
+				got := restoreTestFile(t, manager.GetDecoratorPackage().Syntax[0])
+				for _, want := range wants {
+					if !strings.Contains(got, want) {
+						t.Errorf("expected package %s to contain %q, but got:\n%s", pkgName, want, got)
+					}
+				}
+				for _, notWant := range tt.wantNotContain[pkgName] {
+					if strings.Contains(got, notWant) {
+						t.Errorf("expected package %s not to contain %q, but got:\n%s", pkgName, notWant, got)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strings"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/dstutil"
+)
+
+const (
+	ElasticsearchPath     = "github.com/elastic/go-elasticsearch/"
+	ElasticsearchV7       = ElasticsearchPath + "v7"
+	nrElasticsearchImport = "github.com/newrelic/go-agent/v3/integrations/nrelasticsearch-v7"
+
+	// methods that create an elasticsearch client from a config
+	ElasticsearchNewClient        = "NewClient"
+	ElasticsearchNewTypedClient   = "NewTypedClient"
+	ElasticsearchNewDefaultClient = "NewDefaultClient"
+	ElasticsearchConfig           = "Config"
+
+	// name of the datastore segment round tripper generated for versions without a New Relic integration
+	elasticsearchTransportHelper = "nrElasticsearchTransport"
+)
+
+// elasticsearchTransportSource is a round tripper that records elasticsearch requests as datastore segments. It is added to
+// packages that use a version of the elasticsearch client New Relic does not provide an integration for.
+const elasticsearchTransportSource = `package helper
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// nrElasticsearchTransport records the requests made by an elasticsearch client as New Relic datastore segments.
+type nrElasticsearchTransport struct {
+	next http.RoundTripper
+}
+
+func (t nrElasticsearchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	segment := newrelic.DatastoreSegment{
+		StartTime:    newrelic.FromContext(req.Context()).StartSegmentNow(),
+		Product:      newrelic.DatastoreElasticsearch,
+		Operation:    req.Method,
+		Host:         req.URL.Hostname(),
+		PortPathOrID: req.URL.Port(),
+	}
+	for i, part := range strings.Split(strings.Trim(req.URL.Path, "/"), "/") {
+		if strings.HasPrefix(part, "_") {
+			segment.Operation = strings.TrimPrefix(part, "_")
+			break
+		}
+		if i == 0 {
+			segment.Collection = part
+		}
+	}
+
+	resp, err := next.RoundTrip(req)
+	segment.End()
+	return resp, err
+}
+`
+
+// elasticsearchVersion returns the major version of the elasticsearch client a package path belongs to, ex: "v8".
+func elasticsearchVersion(path string) string {
+	if !strings.HasPrefix(path, ElasticsearchPath) {
+		return ""
+	}
+	version, _, _ := strings.Cut(strings.TrimPrefix(path, ElasticsearchPath), "/")
+	return version
+}
+
+// getElasticsearchClientCall returns the call that creates an elasticsearch client in a statement if it has one.
+func getElasticsearchClientCall(stmt dst.Stmt) (*dst.CallExpr, *dst.Ident) {
+	var call *dst.CallExpr
+	var fun *dst.Ident
+	dst.Inspect(stmt, func(n dst.Node) bool {
+		switch v := n.(type) {
+		case *dst.BlockStmt, *dst.FuncLit:
+			return false
+		case *dst.CallExpr:
+			ident, ok := v.Fun.(*dst.Ident)
+			if ok && elasticsearchVersion(ident.Path) != "" {
+				switch ident.Name {
+				case ElasticsearchNewClient, ElasticsearchNewTypedClient, ElasticsearchNewDefaultClient:
+					call = v
+					fun = ident
+					return false
+				}
+			}
+		}
+		return true
+	})
+	return call, fun
+}
+
+// elasticsearchTransport returns an expression that wraps the transport passed with instrumentation.
+// Version 7 clients use the New Relic elasticsearch integration, other versions use a generated datastore segment round tripper.
+func elasticsearchTransport(manager *InstrumentationManager, version string, transport dst.Expr) dst.Expr {
+	if version == "v7" {
+		manager.AddImport(nrElasticsearchImport)
+		return &dst.CallExpr{
+			Fun: &dst.Ident{
+				Name: "NewRoundTripper",
+				Path: nrElasticsearchImport,
+			},
+			Args: []dst.Expr{transport},
+		}
+	}
+
+	manager.AddImport(newrelicAgentImport)
+	manager.AddHelper(elasticsearchTransportHelper, parseHelperDecls(elasticsearchTransportSource)...)
+	return &dst.CompositeLit{
+		Type: dst.NewIdent(elasticsearchTransportHelper),
+		Elts: []dst.Expr{
+			&dst.KeyValueExpr{
+				Key:   dst.NewIdent("next"),
+				Value: transport,
+			},
+		},
+	}
+}
+
+// wrapConfigLiteralTransport wraps the Transport field of a config composite literal, adding one if it is not set.
+func wrapConfigLiteralTransport(lit *dst.CompositeLit, wrap func(dst.Expr) dst.Expr) {
+	for _, elt := range lit.Elts {
+		kv, ok := elt.(*dst.KeyValueExpr)
+		if !ok {
+			continue
+		}
+		if key, ok := kv.Key.(*dst.Ident); ok && key.Name == "Transport" {
+			kv.Value = wrap(kv.Value)
+			return
+		}
+	}
+
+	lit.Elts = append(lit.Elts, &dst.KeyValueExpr{
+		Key:   dst.NewIdent("Transport"),
+		Value: wrap(dst.NewIdent("nil")),
+		Decs: dst.KeyValueExprDecorations{
+			NodeDecs: dst.NodeDecs{
+				Before: compositeLitSpacing(lit),
+				After:  compositeLitSpacing(lit),
+			},
+		},
+	})
+}
+
+// compositeLitSpacing returns the spacing used between the elements of a composite literal.
+func compositeLitSpacing(lit *dst.CompositeLit) dst.SpaceType {
+	if len(lit.Elts) > 0 && lit.Elts[0].Decorations().Before == dst.NewLine {
+		return dst.NewLine
+	}
+	return dst.None
+}
+
+// InstrumentElasticsearchClient finds elasticsearch clients being created, and wraps the transport in their config
+// with instrumentation that records each request as a datastore segment.
+func InstrumentElasticsearchClient(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
+	// only statements in a block are checked, so that each client is instrumented once
+	stmt, ok := n.(dst.Stmt)
+	if !ok || c.Index() < 0 {
+		return
+	}
+	call, fun := getElasticsearchClientCall(stmt)
+	if call == nil {
+		return
+	}
+
+	version := elasticsearchVersion(fun.Path)
+	wrap := func(transport dst.Expr) dst.Expr {
+		return elasticsearchTransport(manager, version, transport)
+	}
+
+	if fun.Name == ElasticsearchNewDefaultClient {
+		// NewDefaultClient() is equal to NewClient(elasticsearch.Config{})
+		fun.Name = ElasticsearchNewClient
+		call.Args = []dst.Expr{
+			&dst.CompositeLit{
+				Type: &dst.Ident{
+					Name: ElasticsearchConfig,
+					Path: fun.Path,
+				},
+			},
+		}
+	}
+	if len(call.Args) != 1 {
+		return
+	}
+
+	switch cfg := call.Args[0].(type) {
+	case *dst.CompositeLit:
+		wrapConfigLiteralTransport(cfg, wrap)
+	case *dst.UnaryExpr:
+		if lit, ok := cfg.X.(*dst.CompositeLit); ok && cfg.Op == token.AND {
+			wrapConfigLiteralTransport(lit, wrap)
+		}
+	case *dst.Ident, *dst.SelectorExpr:
+		transport := &dst.SelectorExpr{
+			X:   dst.Clone(cfg).(dst.Expr),
+			Sel: dst.NewIdent("Transport"),
+		}
+		c.InsertBefore(&dst.AssignStmt{
+			Lhs: []dst.Expr{dst.Clone(transport).(dst.Expr)},
+			Tok: token.ASSIGN,
+			Rhs: []dst.Expr{wrap(transport)},
+		})
+	}
+}
+
+// isElasticsearchType returns true if the named type is declared in the elasticsearch client module.
+func isElasticsearchType(t types.Type) bool {
+	if ptr, ok := t.(*types.Pointer); ok {
+		t = ptr.Elem()
+	}
+	named, ok := t.(*types.Named)
+	if !ok || named.Obj().Pkg() == nil {
+		return false
+	}
+	return elasticsearchVersion(named.Obj().Pkg().Path()) != ""
+}
+
+// txnContext creates an expression that adds a transaction to a context: newrelic.NewContext(ctx, txn)
+func txnContext(ctx dst.Expr, txnName string) *dst.CallExpr {
+	return &dst.CallExpr{
+		Fun: &dst.Ident{
+			Name: "NewContext",
+			Path: newrelicAgentImport,
+		},
+		Args: []dst.Expr{
+			ctx,
+			dst.NewIdent(txnName),
+		},
+	}
+}
+
+// backgroundContext creates the expression: context.Background()
+func backgroundContext() *dst.CallExpr {
+	return &dst.CallExpr{
+		Fun: &dst.Ident{
+			Name: "Background",
+			Path: "context",
+		},
+	}
+}
+
+// addTxnToElasticsearchCall passes the transaction to an elasticsearch API call through its context, so that
+// the instrumented transport can create a datastore segment for it. It returns true if the call was modified.
+func addTxnToElasticsearchCall(call *dst.CallExpr, pkg *decorator.Package, txnName string) bool {
+	sel, ok := call.Fun.(*dst.SelectorExpr)
+	if !ok {
+		return false
+	}
+	astSel, ok := pkg.Decorator.Ast.Nodes[sel].(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+
+	// typed API and esapi requests: req.Do(ctx, client)
+	if sel.Sel.Name == HttpDo && len(call.Args) > 0 {
+		recv := pkg.TypesInfo.TypeOf(astSel.X)
+		if recv != nil && isElasticsearchType(recv) {
+			call.Args[0] = txnContext(call.Args[0], txnName)
+			return true
+		}
+		return false
+	}
+
+	// esapi functions: es.Search(es.Search.WithContext(ctx), ...)
+	t := pkg.TypesInfo.TypeOf(astSel)
+	if t == nil || !isElasticsearchType(t) {
+		return false
+	}
+	if _, ok := t.Underlying().(*types.Signature); !ok {
+		return false
+	}
+
+	for _, arg := range call.Args {
+		opt, ok := arg.(*dst.CallExpr)
+		if !ok || len(opt.Args) != 1 {
+			continue
+		}
+		if optSel, ok := opt.Fun.(*dst.SelectorExpr); ok && optSel.Sel.Name == "WithContext" {
+			opt.Args[0] = txnContext(opt.Args[0], txnName)
+			return true
+		}
+	}
+
+	call.Args = append(call.Args, &dst.CallExpr{
+		Fun: &dst.SelectorExpr{
+			X:   dst.Clone(sel).(dst.Expr),
+			Sel: dst.NewIdent("WithContext"),
+		},
+		Args: []dst.Expr{
+			txnContext(backgroundContext(), txnName),
+		},
+	})
+	return true
+}
+
+// ElasticsearchCall passes the transaction to elasticsearch API calls made in traced functions, so that they are
+// recorded as datastore segments.
+func ElasticsearchCall(manager *InstrumentationManager, stmt dst.Stmt, c *dstutil.Cursor, txnName string) bool {
+	pkg := manager.GetDecoratorPackage()
+	if pkg == nil || pkg.TypesInfo == nil {
+		return false
+	}
+
+	switch stmt.(type) {
+	case *dst.AssignStmt, *dst.ExprStmt, *dst.ReturnStmt, *dst.DeferStmt:
+	default:
+		return false
+	}
+
+	wasModified := false
+	dst.Inspect(stmt, func(n dst.Node) bool {
+		switch v := n.(type) {
+		case *dst.FuncLit:
+			return false
+		case *dst.CallExpr:
+			if isNewRelicMethod(v) {
+				return false
+			}
+			if addTxnToElasticsearchCall(v, pkg, txnName) {
+				wasModified = true
+				manager.AddImport(newrelicAgentImport)
+				return false
+			}
+		}
+		return true
+	})
+	return wasModified
+}
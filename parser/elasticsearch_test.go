@@ -0,0 +1,145 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/dstutil"
+)
+
+func Test_elasticsearchVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{name: "v7", path: "github.com/elastic/go-elasticsearch/v7", want: "v7"},
+		{name: "v8_subpackage", path: "github.com/elastic/go-elasticsearch/v8/esapi", want: "v8"},
+		{name: "other_package", path: "net/http", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := elasticsearchVersion(tt.path); got != tt.want {
+				t.Errorf("elasticsearchVersion() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// elasticsearchStubFiles are stubs of the elasticsearch clients, that test applications are built with
+var elasticsearchStubFiles = map[string]string{
+	"go.mod": `module parser/tmp
+
+go 1.22
+
+require (
+	github.com/elastic/go-elasticsearch/v7 v7.17.10
+	github.com/elastic/go-elasticsearch/v8 v8.13.0
+)
+
+replace github.com/elastic/go-elasticsearch/v7 => ./stubs/v7
+
+replace github.com/elastic/go-elasticsearch/v8 => ./stubs/v8
+`,
+	"stubs/v7/go.mod":           "module github.com/elastic/go-elasticsearch/v7\n\ngo 1.22\n",
+	"stubs/v7/elasticsearch.go": elasticsearchStubSource,
+	"stubs/v8/go.mod":           "module github.com/elastic/go-elasticsearch/v8\n\ngo 1.22\n",
+	"stubs/v8/elasticsearch.go": elasticsearchStubSource,
+}
+
+const elasticsearchStubSource = `package elasticsearch
+
+import "net/http"
+
+type Config struct {
+	Addresses []string
+	Transport http.RoundTripper
+}
+
+type Client struct{}
+
+func NewClient(cfg Config) (*Client, error) { return &Client{}, nil }
+func NewDefaultClient() (*Client, error)    { return &Client{}, nil }
+`
+
+func Test_InstrumentElasticsearchClient(t *testing.T) {
+	tests := []struct {
+		name        string
+		code        string
+		wantContain []string
+		wantHelper  bool
+	}{
+		{
+			name: "v7_config_variable",
+			code: `
+package main
+import "github.com/elastic/go-elasticsearch/v7"
+func main() {
+	cfg := elasticsearch.Config{}
+	es, err := elasticsearch.NewClient(cfg)
+	_, _ = es, err
+}`,
+			wantContain: []string{"cfg.Transport = nrelasticsearch.NewRoundTripper(cfg.Transport)"},
+		},
+		{
+			name: "v7_config_literal_with_transport",
+			code: `
+package main
+import (
+	"net/http"
+
+	"github.com/elastic/go-elasticsearch/v7"
+)
+func main() {
+	t := http.DefaultTransport
+	es, err := elasticsearch.NewClient(elasticsearch.Config{Transport: t})
+	_, _ = es, err
+}`,
+			wantContain: []string{"elasticsearch.Config{Transport: nrelasticsearch.NewRoundTripper(t)}"},
+		},
+		{
+			name: "v8_default_client",
+			code: `
+package main
+import "github.com/elastic/go-elasticsearch/v8"
+func main() {
+	es, err := elasticsearch.NewDefaultClient()
+	_, _ = es, err
+}`,
+			wantContain: []string{
+				"elasticsearch.NewClient(elasticsearch.Config{Transport: nrElasticsearchTransport{next: nil}})",
+				"func (t nrElasticsearchTransport) RoundTrip(req *http.Request) (*http.Response, error) {",
+			},
+			wantHelper: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]string{"main.go": tt.code}
+			for name, code := range elasticsearchStubFiles {
+				files[name] = code
+			}
+			manager := newTestingMultiPackageManager(t, files)
+			pkg := manager.GetDecoratorPackage()
+			decl := pkg.Syntax[0].Decls[1].(*dst.FuncDecl)
+			dstutil.Apply(decl, nil, func(c *dstutil.Cursor) bool {
+				InstrumentElasticsearchClient(c.Node(), manager, c)
+				return true
+			})
+			manager.writeHelpers()
+
+			if got := len(manager.packages[manager.currentPackage].helpersAdded) > 0; got != tt.wantHelper {
+				t.Errorf("expected helper to be added to package to be %t, but got %t", tt.wantHelper, got)
+			}
+
+			got := restoreTestFile(t, pkg.Syntax[0])
+			for _, want := range tt.wantContain {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected instrumented code to contain %q, but got:\n%s", want, got)
+				}
+			}
+		})
+	}
+}
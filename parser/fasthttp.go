@@ -0,0 +1,380 @@
+package main
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strings"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/dstutil"
+)
+
+const (
+	FastHttpPath       = "github.com/valyala/fasthttp"
+	nrFastHttpImport   = "github.com/newrelic/go-agent/v3/integrations/nrfasthttp"
+	FastHttpCtxType    = "RequestCtx"
+	FastHttpClient     = "Client"
+	FastHttpDo         = "Do"
+	defaultFastHttpCtx = "ctx"
+
+	// helper that wraps the handler a fasthttp server serves every request with
+	wrapFastHttpHandlerHelper = "nrWrapFastHttpHandler"
+
+	// helper that sends a request with a fasthttp client in an external segment of a transaction
+	fastHttpDoHelper = "nrFastHttpDo"
+)
+
+const wrapFastHttpHandlerSource = `package helper
+
+import (
+	"github.com/newrelic/go-agent/v3/integrations/nrfasthttp"
+	"github.com/newrelic/go-agent/v3/newrelic"
+	"github.com/valyala/fasthttp"
+)
+
+// nrWrapFastHttpHandler wraps the handler a fasthttp server serves every request with in a New Relic transaction
+// named after it.
+func nrWrapFastHttpHandler(app *newrelic.Application, name string, handler fasthttp.RequestHandler) fasthttp.RequestHandler {
+	_, wrapped := nrfasthttp.WrapHandleFunc(app, name, handler)
+	return wrapped
+}
+`
+
+const fastHttpDoSource = `package helper
+
+import (
+	"github.com/newrelic/go-agent/v3/newrelic"
+	"github.com/valyala/fasthttp"
+)
+
+// nrFastHttpDo sends a request with a fasthttp client in an external segment of the transaction passed, and adds the
+// distributed tracing headers of the segment to the request.
+func nrFastHttpDo(txn *newrelic.Transaction, client *fasthttp.Client, req *fasthttp.Request, resp *fasthttp.Response) error {
+	seg := &newrelic.ExternalSegment{
+		StartTime: txn.StartSegmentNow(),
+		URL:       req.URI().String(),
+		Procedure: string(req.Header.Method()),
+		Library:   "fasthttp",
+	}
+	defer seg.End()
+	for key, values := range seg.GetOutboundHeaders() {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	err := client.Do(req, resp)
+	if err == nil {
+		seg.SetStatusCode(resp.StatusCode())
+	}
+	return err
+}
+`
+
+// fastHttpCtxParam returns the field of a function declaration that receives a *fasthttp.RequestCtx,
+// if the function is shaped like a fasthttp request handler.
+func fastHttpCtxParam(fnType *dst.FuncType) *dst.Field {
+	if fnType == nil || fnType.Params == nil || len(fnType.Params.List) != 1 {
+		return nil
+	}
+	if fnType.Results != nil && len(fnType.Results.List) > 0 {
+		return nil
+	}
+
+	param := fnType.Params.List[0]
+	if len(param.Names) > 1 {
+		return nil
+	}
+	star, ok := param.Type.(*dst.StarExpr)
+	if !ok {
+		return nil
+	}
+	ident, ok := star.X.(*dst.Ident)
+	if ok && ident.Name == FastHttpCtxType && ident.Path == FastHttpPath {
+		return param
+	}
+	return nil
+}
+
+// isFastHttpHandler returns true if a function declaration is a fasthttp request handler: func(*fasthttp.RequestCtx)
+func isFastHttpHandler(decl *dst.FuncDecl) bool {
+	if decl == nil || decl.Recv != nil {
+		return false
+	}
+	return fastHttpCtxParam(decl.Type) != nil
+}
+
+// isFastHttpHandlerSignature returns true if the type is a function that can be used as a fasthttp.RequestHandler.
+func isFastHttpHandlerSignature(t types.Type) bool {
+	if t == nil {
+		return false
+	}
+	sig, ok := t.Underlying().(*types.Signature)
+	if !ok || sig.Params().Len() != 1 || sig.Results().Len() != 0 {
+		return false
+	}
+	return sig.Params().At(0).Type().String() == "*"+FastHttpPath+"."+FastHttpCtxType
+}
+
+// isFastHttpHandlerExpr returns true if the expression passed refers to a fasthttp request handler. Handlers
+// declared in the current package and function literals are recognized by their signature, everything else by
+// type information.
+func isFastHttpHandlerExpr(expr dst.Expr, manager *InstrumentationManager) bool {
+	switch v := expr.(type) {
+	case *dst.Ident:
+		if v.Path == "" {
+			if decl := manager.GetDeclaration(v.Name); decl != nil {
+				return isFastHttpHandler(decl)
+			}
+		}
+	case *dst.FuncLit:
+		return fastHttpCtxParam(v.Type) != nil
+	}
+
+	pkg := manager.GetDecoratorPackage()
+	if pkg == nil || pkg.TypesInfo == nil {
+		return false
+	}
+	astExpr, ok := pkg.Decorator.Ast.Nodes[expr].(ast.Expr)
+	if !ok {
+		return false
+	}
+	return isFastHttpHandlerSignature(pkg.TypesInfo.TypeOf(astExpr))
+}
+
+// isFastHttpRouteRegistration returns true if the call registers a fasthttp handler for a route, for example
+// with a router: r.GET("/", index). Functions in the fasthttp package itself are ignored since they take an address
+// rather than a route.
+func isFastHttpRouteRegistration(call *dst.CallExpr, manager *InstrumentationManager) bool {
+	if call == nil || len(call.Args) != 2 {
+		return false
+	}
+	if ident, ok := call.Fun.(*dst.Ident); ok && ident.Path == FastHttpPath {
+		return false
+	}
+	if _, ok := call.Fun.(*dst.SelectorExpr); !ok {
+		return false
+	}
+	if lit, ok := call.Args[0].(*dst.BasicLit); !ok || lit.Kind != token.STRING {
+		return false
+	}
+	return isFastHttpHandlerExpr(call.Args[1], manager)
+}
+
+func wrapFastHttpHandler(call *dst.CallExpr, app dst.Expr) {
+	oldArgs := call.Args
+	call.Args = []dst.Expr{
+		&dst.CallExpr{
+			Fun: &dst.Ident{
+				Name: "WrapHandleFunc",
+				Path: nrFastHttpImport,
+			},
+			Args: []dst.Expr{
+				app,
+				oldArgs[0],
+				oldArgs[1],
+			},
+		},
+	}
+}
+
+// fastHttpServedHandler returns the handler argument of a call to a function of the fasthttp package that serves every
+// request with it, ex: fasthttp.ListenAndServe(":8080", index). It returns nil for other calls.
+func fastHttpServedHandler(call *dst.CallExpr, manager *InstrumentationManager) *dst.Expr {
+	ident, ok := call.Fun.(*dst.Ident)
+	if !ok || ident.Path != FastHttpPath || len(call.Args) < 2 {
+		return nil
+	}
+	if !strings.HasPrefix(ident.Name, "ListenAndServe") && !strings.HasPrefix(ident.Name, "Serve") {
+		return nil
+	}
+	handler := &call.Args[len(call.Args)-1]
+	if !isFastHttpHandlerExpr(*handler, manager) {
+		return nil
+	}
+	return handler
+}
+
+// fastHttpHandlerName names the transactions of a handler served by a fasthttp server after the expression it is
+// served by.
+func fastHttpHandlerName(handler dst.Expr) string {
+	switch handler.(type) {
+	case *dst.Ident, *dst.SelectorExpr:
+		return serverHandlerName(handler)
+	}
+	return "RequestHandler"
+}
+
+// wrapFastHttpServedHandler wraps the handler served by fasthttp.ListenAndServe() and the other functions of the
+// fasthttp package that serve requests, so that every request gets a transaction named after the handler. It returns
+// true if the handler was wrapped.
+func wrapFastHttpServedHandler(manager *InstrumentationManager, call *dst.CallExpr, app dst.Expr) bool {
+	handler := fastHttpServedHandler(call, manager)
+	if handler == nil {
+		return false
+	}
+	manager.AddImport(newrelicAgentImport)
+	manager.AddHelper(wrapFastHttpHandlerHelper, parseHelperDecls(wrapFastHttpHandlerSource)...)
+	*handler = &dst.CallExpr{
+		Fun:  dst.NewIdent(wrapFastHttpHandlerHelper),
+		Args: []dst.Expr{app, stringLit(fastHttpHandlerName(*handler)), *handler},
+	}
+	return true
+}
+
+// WrapFastHttpHandleFunc looks for fasthttp handlers being registered to a route, and wraps them with a new relic transaction
+func WrapFastHttpHandleFunc(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
+	callExpr, ok := n.(*dst.CallExpr)
+	if ok && isFastHttpRouteRegistration(callExpr, manager) {
+		wrapFastHttpHandler(callExpr, dst.NewIdent(manager.agentVariableName))
+		manager.AddImport(nrFastHttpImport)
+	}
+}
+
+// WrapFastHttpServedHandler looks for calls to fasthttp.ListenAndServe() and the other functions of the fasthttp
+// package that serve requests, and wraps the handler they serve with a new relic transaction
+func WrapFastHttpServedHandler(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
+	if callExpr, ok := n.(*dst.CallExpr); ok {
+		wrapFastHttpServedHandler(manager, callExpr, dst.NewIdent(manager.agentVariableName))
+	}
+}
+
+// WrapNestedFastHttpHandleFunction wraps fasthttp handlers that are registered inside of functions that are being
+// traced by a transaction.
+func WrapNestedFastHttpHandleFunction(manager *InstrumentationManager, stmt dst.Stmt, c *dstutil.Cursor, txnName string) bool {
+	wasModified := false
+	dst.Inspect(stmt, func(n dst.Node) bool {
+		callExpr, ok := n.(*dst.CallExpr)
+		if !ok {
+			return true
+		}
+		app := &dst.CallExpr{
+			Fun: &dst.SelectorExpr{
+				X:   dst.NewIdent(txnName),
+				Sel: dst.NewIdent("Application"),
+			},
+		}
+		if isFastHttpRouteRegistration(callExpr, manager) {
+			wrapFastHttpHandler(callExpr, app)
+			manager.AddImport(nrFastHttpImport)
+			wasModified = true
+			return false
+		}
+		if wrapFastHttpServedHandler(manager, callExpr, app) {
+			wasModified = true
+			return false
+		}
+		return true
+	})
+	return wasModified
+}
+
+// txnFromFastHttpCtx creates a statement that gets the transaction nrfasthttp stored in the request context
+func txnFromFastHttpCtx(txnVariable, ctxVariable string) *dst.AssignStmt {
+	return &dst.AssignStmt{
+		Decs: dst.AssignStmtDecorations{
+			NodeDecs: dst.NodeDecs{
+				After: dst.EmptyLine,
+			},
+		},
+		Lhs: []dst.Expr{
+			dst.NewIdent(txnVariable),
+		},
+		Tok: token.DEFINE,
+		Rhs: []dst.Expr{
+			&dst.CallExpr{
+				Fun: &dst.Ident{
+					Name: "GetTransaction",
+					Path: nrFastHttpImport,
+				},
+				Args: []dst.Expr{
+					dst.NewIdent(ctxVariable),
+				},
+			},
+		},
+	}
+}
+
+// InstrumentFastHttpHandler recognizes fasthttp request handlers, traces their body, and retrieves the transaction
+// nrfasthttp adds to the *fasthttp.RequestCtx.
+func InstrumentFastHttpHandler(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
+	fn, isFn := n.(*dst.FuncDecl)
+	if !isFn || !isFastHttpHandler(fn) {
+		return
+	}
+
+	txnName := defaultTxnName
+	newFn, ok := TraceFunction(manager, fn, txnName)
+	if ok {
+		// the handler needs a named context in order to retrieve the transaction from it
+		param := fastHttpCtxParam(newFn.Type)
+		if len(param.Names) == 0 || param.Names[0].Name == "_" {
+			param.Names = []*dst.Ident{dst.NewIdent(defaultFastHttpCtx)}
+		}
+
+		newFn.Body.List = append([]dst.Stmt{txnFromFastHttpCtx(txnName, param.Names[0].Name)}, newFn.Body.List...)
+		manager.AddImport(nrFastHttpImport)
+		c.Replace(newFn)
+		manager.UpdateFunctionDeclaration(newFn)
+	}
+}
+
+// getFastHttpClientDo returns the call to the Do method of a fasthttp.Client in the statement passed, if there is one.
+// The returned bool is true when the client is a pointer.
+func getFastHttpClientDo(stmt dst.Stmt, pkg *decorator.Package) (*dst.CallExpr, bool) {
+	if pkg == nil || pkg.TypesInfo == nil {
+		return nil, false
+	}
+
+	var call *dst.CallExpr
+	var isPointer bool
+	dst.Inspect(stmt, func(n dst.Node) bool {
+		v, ok := n.(*dst.CallExpr)
+		if !ok || len(v.Args) != 2 {
+			return true
+		}
+		sel, ok := v.Fun.(*dst.SelectorExpr)
+		if !ok || sel.Sel.Name != FastHttpDo {
+			return true
+		}
+		astExpr, ok := pkg.Decorator.Ast.Nodes[sel.X].(ast.Expr)
+		if !ok {
+			return true
+		}
+		t := pkg.TypesInfo.TypeOf(astExpr)
+		if t == nil {
+			return true
+		}
+		switch t.String() {
+		case "*" + FastHttpPath + "." + FastHttpClient:
+			call = v
+			isPointer = true
+			return false
+		case FastHttpPath + "." + FastHttpClient:
+			call = v
+			return false
+		}
+		return true
+	})
+	return call, isPointer
+}
+
+// ExternalFastHttpCall replaces calls to (*fasthttp.Client).Do with a helper that sends the request in an external
+// segment of the transaction of the traced function.
+func ExternalFastHttpCall(manager *InstrumentationManager, stmt dst.Stmt, c *dstutil.Cursor, txnName string) bool {
+	call, isPointer := getFastHttpClientDo(stmt, manager.GetDecoratorPackage())
+	if call == nil {
+		return false
+	}
+
+	client := call.Fun.(*dst.SelectorExpr).X
+	if !isPointer {
+		client = &dst.UnaryExpr{Op: token.AND, X: client}
+	}
+	manager.AddHelper(fastHttpDoHelper, parseHelperDecls(fastHttpDoSource)...)
+	manager.AddImport(newrelicAgentImport)
+	call.Fun = dst.NewIdent(fastHttpDoHelper)
+	call.Args = append([]dst.Expr{dst.NewIdent(txnName), client}, call.Args...)
+	return true
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"go/token"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dave/dst"
+)
+
+func Test_isFastHttpHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     string
+		wantBool bool
+	}{
+		{
+			name: "valid_handler",
+			code: `
+package main
+import "github.com/valyala/fasthttp"
+func index(ctx *fasthttp.RequestCtx) {
+	ctx.WriteString("hello world")
+}`,
+			wantBool: true,
+		},
+		{
+			name: "unnamed_ctx",
+			code: `
+package main
+import "github.com/valyala/fasthttp"
+func index(*fasthttp.RequestCtx) {
+}`,
+			wantBool: true,
+		},
+		{
+			name: "net_http_handler",
+			code: `
+package main
+import "net/http"
+func index(w http.ResponseWriter, r *http.Request) {
+}`,
+			wantBool: false,
+		},
+		{
+			name: "overloaded_handler",
+			code: `
+package main
+import "github.com/valyala/fasthttp"
+func index(ctx *fasthttp.RequestCtx, x string) {
+	ctx.WriteString(x)
+}`,
+			wantBool: false,
+		},
+		{
+			name: "returns_value",
+			code: `
+package main
+import "github.com/valyala/fasthttp"
+func index(ctx *fasthttp.RequestCtx) error {
+	return nil
+}`,
+			wantBool: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, tt.code)
+			pkg := manager.GetDecoratorPackage()
+			decl, ok := pkg.Syntax[0].Decls[1].(*dst.FuncDecl)
+			if !ok {
+				t.Fatal("code must contain only one function declaration")
+			}
+
+			if gotBool := isFastHttpHandler(decl); gotBool != tt.wantBool {
+				t.Errorf("isFastHttpHandler() = %v, want %v", gotBool, tt.wantBool)
+			}
+		})
+	}
+}
+
+func Test_WrapFastHttpHandleFunc(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     string
+		wantWrap bool
+	}{
+		{
+			name: "router_registration",
+			code: `
+package main
+import "github.com/valyala/fasthttp"
+func main() {
+	r.GET("/", index)
+}
+func index(ctx *fasthttp.RequestCtx) {}`,
+			wantWrap: true,
+		},
+		{
+			name: "listen_and_serve",
+			code: `
+package main
+import "github.com/valyala/fasthttp"
+func main() {
+	fasthttp.ListenAndServe(":8080", index)
+}
+func index(ctx *fasthttp.RequestCtx) {}`,
+			wantWrap: false,
+		},
+		{
+			name: "not_a_handler",
+			code: `
+package main
+import "github.com/valyala/fasthttp"
+func main() {
+	r.GET("/", index)
+}
+func index(s string) {}`,
+			wantWrap: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, tt.code)
+			pkg := manager.GetDecoratorPackage()
+			for _, decl := range pkg.Syntax[0].Decls {
+				if fn, ok := decl.(*dst.FuncDecl); ok {
+					manager.CreateFunctionDeclaration(fn)
+				}
+			}
+
+			call := pkg.Syntax[0].Decls[1].(*dst.FuncDecl).Body.List[0].(*dst.ExprStmt).X.(*dst.CallExpr)
+			WrapFastHttpHandleFunc(call, manager, nil)
+
+			gotWrap := false
+			if len(call.Args) == 1 {
+				wrapper, ok := call.Args[0].(*dst.CallExpr)
+				if ok {
+					ident, ok := wrapper.Fun.(*dst.Ident)
+					gotWrap = ok && ident.Name == "WrapHandleFunc" && ident.Path == nrFastHttpImport
+				}
+			}
+			if gotWrap != tt.wantWrap {
+				t.Errorf("WrapFastHttpHandleFunc() wrapped handler = %v, want %v", gotWrap, tt.wantWrap)
+			}
+		})
+	}
+}
+
+func Test_WrapFastHttpServedHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		code        string
+		wantContain string
+	}{
+		{
+			name: "listen_and_serve",
+			code: `
+package main
+import "github.com/valyala/fasthttp"
+func main() {
+	fasthttp.ListenAndServe(":8080", index)
+}
+func index(ctx *fasthttp.RequestCtx) {}`,
+			wantContain: `fasthttp.ListenAndServe(":8080", nrWrapFastHttpHandler(NewRelicAgent, "index", index))`,
+		},
+		{
+			name: "checked_error",
+			code: `
+package main
+import (
+	"log"
+
+	"github.com/valyala/fasthttp"
+)
+func main() {
+	if err := fasthttp.ListenAndServe(":8080", index); err != nil {
+		log.Fatal(err)
+	}
+}
+func index(ctx *fasthttp.RequestCtx) {}`,
+			wantContain: `if err := fasthttp.ListenAndServe(":8080", nrWrapFastHttpHandler(NewRelicAgent, "index", index)); err != nil {`,
+		},
+		{
+			name: "handler_literal",
+			code: `
+package main
+import (
+	"log"
+
+	"github.com/valyala/fasthttp"
+)
+func main() {
+	log.Fatal(fasthttp.ListenAndServe(":8080", func(ctx *fasthttp.RequestCtx) {}))
+}`,
+			wantContain: `log.Fatal(fasthttp.ListenAndServe(":8080", nrWrapFastHttpHandler(NewRelicAgent, "RequestHandler", func(ctx *fasthttp.RequestCtx) {})))`,
+		},
+		{
+			name: "served_in_traced_function",
+			code: `
+package main
+import "github.com/valyala/fasthttp"
+func main() {
+	serve()
+}
+func serve() {
+	fasthttp.ListenAndServe(":8080", index)
+}
+func index(ctx *fasthttp.RequestCtx) {}`,
+			wantContain: `fasthttp.ListenAndServe(":8080", nrWrapFastHttpHandler(nrTxn.Application(), "index", index))`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, tt.code)
+			if err := tracePackageFunctionCalls(manager); err != nil {
+				t.Fatal(err)
+			}
+			instrumentPackages(manager, InstrumentMain)
+
+			got := restoreTestFile(t, manager.GetDecoratorPackage().Syntax[0])
+			if !strings.Contains(got, tt.wantContain) {
+				t.Errorf("expected instrumented code to contain %q, but got:\n%s", tt.wantContain, got)
+			}
+			if strings.Count(got, "nrWrapFastHttpHandler(") != 1 {
+				t.Errorf("expected the served handler to be wrapped once, but got:\n%s", got)
+			}
+		})
+	}
+}
+
+func Test_txnFromFastHttpCtx(t *testing.T) {
+	want := &dst.AssignStmt{
+		Decs: dst.AssignStmtDecorations{
+			NodeDecs: dst.NodeDecs{
+				After: dst.EmptyLine,
+			},
+		},
+		Lhs: []dst.Expr{dst.NewIdent("txn")},
+		Tok: token.DEFINE,
+		Rhs: []dst.Expr{
+			&dst.CallExpr{
+				Fun: &dst.Ident{
+					Name: "GetTransaction",
+					Path: nrFastHttpImport,
+				},
+				Args: []dst.Expr{dst.NewIdent("requestCtx")},
+			},
+		},
+	}
+
+	if got := txnFromFastHttpCtx("txn", "requestCtx"); !reflect.DeepEqual(got, want) {
+		t.Errorf("txnFromFastHttpCtx() = %v, want %v", got, want)
+	}
+}
+
+// fastHttpStubFiles are stubs of the fasthttp package, that test applications are built with
+var fastHttpStubFiles = map[string]string{
+	"go.mod": `module parser/tmp
+
+go 1.22
+
+require github.com/valyala/fasthttp v1.51.0
+
+replace github.com/valyala/fasthttp => ./stubs/fasthttp
+`,
+	"stubs/fasthttp/go.mod": "module github.com/valyala/fasthttp\n\ngo 1.22\n",
+	"stubs/fasthttp/client.go": `package fasthttp
+
+type URI struct{}
+
+func (u *URI) String() string { return "" }
+
+type RequestHeader struct{}
+
+func (h *RequestHeader) Method() []byte        { return nil }
+func (h *RequestHeader) Add(key, value string) {}
+
+type Request struct {
+	Header RequestHeader
+}
+
+func (req *Request) URI() *URI                { return &URI{} }
+func (req *Request) SetRequestURI(uri string) {}
+
+type Response struct{}
+
+func (resp *Response) StatusCode() int { return 200 }
+
+type Client struct{}
+
+func (c *Client) Do(req *Request, resp *Response) error { return nil }
+`,
+}
+
+func Test_ExternalFastHttpCall(t *testing.T) {
+	tests := []struct {
+		name        string
+		code        string
+		wantContain []string
+	}{
+		{
+			name: "pointer_client",
+			code: `
+package main
+
+import (
+	"log"
+
+	"github.com/valyala/fasthttp"
+)
+
+var client = &fasthttp.Client{}
+
+func fetch(url string) error {
+	req, resp := &fasthttp.Request{}, &fasthttp.Response{}
+	req.SetRequestURI(url)
+	return client.Do(req, resp)
+}
+
+func main() {
+	fetch("http://shop.example")
+	log.Println("done")
+}
+`,
+			wantContain: []string{
+				"\tnrTxn := NewRelicAgent.StartTransaction(\"fetch\")\n\tfetch(\"http://shop.example\", nrTxn)",
+				"\treturn nrFastHttpDo(nrTxn, client, req, resp)\n",
+				"func nrFastHttpDo(txn *newrelic.Transaction, client *fasthttp.Client, req *fasthttp.Request, resp *fasthttp.Response) error {",
+				"StartTime: txn.StartSegmentNow(),",
+			},
+		},
+		{
+			name: "value_client",
+			code: `
+package main
+
+import (
+	"log"
+
+	"github.com/valyala/fasthttp"
+)
+
+func fetch(url string) error {
+	var client fasthttp.Client
+	req, resp := &fasthttp.Request{}, &fasthttp.Response{}
+	req.SetRequestURI(url)
+	err := client.Do(req, resp)
+	return err
+}
+
+func main() {
+	fetch("http://shop.example")
+	log.Println("done")
+}
+`,
+			wantContain: []string{
+				"\terr := nrFastHttpDo(nrTxn, &client, req, resp)\n",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]string{"main.go": tt.code}
+			for name, code := range fastHttpStubFiles {
+				files[name] = code
+			}
+			manager := newTestingMultiPackageManager(t, files)
+			if err := tracePackageFunctionCalls(manager); err != nil {
+				t.Fatal(err)
+			}
+			instrumentPackages(manager, InstrumentMain)
+			manager.writeHelpers()
+
+			got := restoreTestFile(t, manager.GetDecoratorPackage().Syntax[0])
+			for _, want := range tt.wantContain {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected instrumented code to contain %q, but got:\n%s", want, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/dstutil"
+)
+
+const (
+	HtmlTemplateType            = "*html/template.Template"
+	HtmlTemplateExecute         = "Execute"
+	HtmlTemplateExecuteTemplate = "ExecuteTemplate"
+
+	// key the browser monitoring snippet is added to template data with
+	browserTimingHeaderKey = "NewRelicBrowserTimingHeader"
+)
+
+// helpers that execute a template in a segment, by the name of the method they replace
+var templateExecutionHelpers = map[string]string{
+	HtmlTemplateExecute:         "nrExecuteTemplate",
+	HtmlTemplateExecuteTemplate: "nrExecuteNamedTemplate",
+}
+
+const browserTimingHeaderHelper = "nrBrowserTimingHeader"
+
+// templateHelperSources contains the source code of the helpers used to instrument html templates, by helper name.
+var templateHelperSources = map[string]string{
+	"nrExecuteTemplate": `package helper
+
+import (
+	"html/template"
+	"io"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// nrExecuteTemplate applies tmpl to data like tmpl.Execute, recording it as a segment of txn.
+func nrExecuteTemplate(txn *newrelic.Transaction, tmpl *template.Template, wr io.Writer, data any) error {
+	defer txn.StartSegment("template " + tmpl.Name()).End()
+	return tmpl.Execute(wr, data)
+}
+`,
+	"nrExecuteNamedTemplate": `package helper
+
+import (
+	"html/template"
+	"io"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// nrExecuteNamedTemplate applies the template associated with tmpl that has the given name to data like
+// tmpl.ExecuteTemplate, recording it as a segment of txn.
+func nrExecuteNamedTemplate(txn *newrelic.Transaction, tmpl *template.Template, wr io.Writer, name string, data any) error {
+	defer txn.StartSegment("template " + name).End()
+	return tmpl.ExecuteTemplate(wr, name, data)
+}
+`,
+	browserTimingHeaderHelper: `package helper
+
+import (
+	"html/template"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// nrBrowserTimingHeader returns the New Relic browser monitoring snippet for txn, which links page views
+// to the transaction that rendered them when it is placed in the <head> of a page. The snippet is empty when
+// browser monitoring is disabled or the application is not connected.
+func nrBrowserTimingHeader(txn *newrelic.Transaction) template.HTML {
+	return template.HTML(txn.BrowserTimingHeader().WithTags())
+}
+`,
+}
+
+// templateExecution returns the index of the writer and data arguments of a call that executes an html template.
+// The returned bool is false if the call does not execute an html template.
+func templateExecution(call *dst.CallExpr, pkg *decorator.Package) (int, int, bool) {
+	sel, ok := call.Fun.(*dst.SelectorExpr)
+	if !ok || pkg == nil || pkg.TypesInfo == nil {
+		return 0, 0, false
+	}
+
+	var writer, data int
+	switch sel.Sel.Name {
+	case HtmlTemplateExecute:
+		writer, data = 0, 1
+	case HtmlTemplateExecuteTemplate:
+		writer, data = 0, 2
+	default:
+		return 0, 0, false
+	}
+	if len(call.Args) != data+1 {
+		return 0, 0, false
+	}
+
+	astExpr, ok := pkg.Decorator.Ast.Nodes[sel.X].(ast.Expr)
+	if !ok {
+		return 0, 0, false
+	}
+	t := pkg.TypesInfo.TypeOf(astExpr)
+	if t == nil || t.String() != HtmlTemplateType {
+		return 0, 0, false
+	}
+	return writer, data, true
+}
+
+// isResponseWriter returns true if an expression is an http.ResponseWriter.
+func isResponseWriter(expr dst.Expr, pkg *decorator.Package) bool {
+	astExpr, ok := pkg.Decorator.Ast.Nodes[expr].(ast.Expr)
+	if !ok {
+		return false
+	}
+	t := pkg.TypesInfo.TypeOf(astExpr)
+	return t != nil && t.String() == HttpResponseWriterType
+}
+
+// templateDataMapLit returns the map composite literal with string keys that an expression is, if the browser
+// monitoring snippet can be added to it.
+func templateDataMapLit(expr dst.Expr, pkg *decorator.Package) (*dst.CompositeLit, bool) {
+	lit, ok := expr.(*dst.CompositeLit)
+	if !ok {
+		return nil, false
+	}
+	astLit, ok := pkg.Decorator.Ast.Nodes[lit].(ast.Expr)
+	if !ok {
+		return nil, false
+	}
+	t := pkg.TypesInfo.TypeOf(astLit)
+	if t == nil {
+		return nil, false
+	}
+	m, ok := t.Underlying().(*types.Map)
+	if !ok {
+		return nil, false
+	}
+	if key, ok := m.Key().Underlying().(*types.Basic); !ok || key.Kind() != types.String {
+		return nil, false
+	}
+	if !types.IsInterface(m.Elem()) && m.Elem().String() != "html/template.HTML" {
+		return nil, false
+	}
+	return lit, true
+}
+
+// browserTimingHeaderComment returns a comment explaining how to render the browser monitoring snippet in a template.
+func browserTimingHeaderComment(txnName string, addedToData bool, decs *dst.NodeDecs) []string {
+	comment := []string{
+		fmt.Sprintf("// to enable New Relic browser monitoring, render {{.%s}} in the <head> of this page", browserTimingHeaderKey),
+	}
+	if !addedToData {
+		comment = []string{
+			fmt.Sprintf("// to enable New Relic browser monitoring, add %s(%s) to the data of this template", browserTimingHeaderHelper, txnName),
+			"// and render it in the <head> of the page",
+		}
+	}
+	if decs != nil && len(decs.Start.All()) > 0 {
+		comment = append(comment, "//")
+	}
+	return comment
+}
+
+// addBrowserTimingHeader adds the browser monitoring snippet of the transaction to the data of a template that is
+// rendered as an http response. It returns true if the snippet was added to the data.
+func addBrowserTimingHeader(manager *InstrumentationManager, data dst.Expr, txnName string) bool {
+	lit, ok := templateDataMapLit(data, manager.GetDecoratorPackage())
+	if !ok {
+		return false
+	}
+	for _, elt := range lit.Elts {
+		kv, ok := elt.(*dst.KeyValueExpr)
+		if !ok {
+			continue
+		}
+		if key, ok := kv.Key.(*dst.BasicLit); ok && key.Value == fmt.Sprintf("%q", browserTimingHeaderKey) {
+			return true
+		}
+	}
+
+	lit.Elts = append(lit.Elts, &dst.KeyValueExpr{
+		Key: &dst.BasicLit{
+			Kind:  token.STRING,
+			Value: fmt.Sprintf("%q", browserTimingHeaderKey),
+		},
+		Value: &dst.CallExpr{
+			Fun:  dst.NewIdent(browserTimingHeaderHelper),
+			Args: []dst.Expr{dst.NewIdent(txnName)},
+		},
+		Decs: dst.KeyValueExprDecorations{
+			NodeDecs: dst.NodeDecs{
+				Before: compositeLitSpacing(lit),
+				After:  compositeLitSpacing(lit),
+			},
+		},
+	})
+	manager.AddHelper(browserTimingHeaderHelper, parseHelperDecls(templateHelperSources[browserTimingHeaderHelper])...)
+	return true
+}
+
+// TemplateExecution records the execution of html templates in traced functions as segments. When a template is
+// rendered as an http response, the browser monitoring snippet of the transaction is added to its data if it is a
+// map literal, otherwise a comment explains how to add it.
+func TemplateExecution(manager *InstrumentationManager, stmt dst.Stmt, c *dstutil.Cursor, txnName string) bool {
+	// only statements in a block are checked, so that comments are not added inside of other statements
+	pkg := manager.GetDecoratorPackage()
+	if pkg == nil || pkg.TypesInfo == nil || c.Index() < 0 {
+		return false
+	}
+
+	wasModified := false
+	rendersResponse := false
+	addedToData := false
+	dst.Inspect(stmt, func(n dst.Node) bool {
+		switch v := n.(type) {
+		case *dst.FuncLit:
+			return false
+		case *dst.CallExpr:
+			writer, data, ok := templateExecution(v, pkg)
+			if !ok {
+				return true
+			}
+			if isResponseWriter(v.Args[writer], pkg) {
+				rendersResponse = true
+				if addBrowserTimingHeader(manager, v.Args[data], txnName) {
+					addedToData = true
+				}
+			}
+
+			sel := v.Fun.(*dst.SelectorExpr)
+			helper := templateExecutionHelpers[sel.Sel.Name]
+			manager.AddHelper(helper, parseHelperDecls(templateHelperSources[helper])...)
+			manager.AddImport(newrelicAgentImport)
+
+			v.Fun = dst.NewIdent(helper)
+			v.Args = append([]dst.Expr{dst.NewIdent(txnName), sel.X}, v.Args...)
+			wasModified = true
+		}
+		return true
+	})
+
+	if rendersResponse {
+		decs := stmt.Decorations()
+		decs.Start.Prepend(browserTimingHeaderComment(txnName, addedToData, decs)...)
+		// the comment tells the user to add the snippet with the helper, so it must be there to call
+		manager.AddHelper(browserTimingHeaderHelper, parseHelperDecls(templateHelperSources[browserTimingHeaderHelper])...)
+	}
+	return wasModified
+}
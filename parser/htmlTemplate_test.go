@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/dstutil"
+	"golang.org/x/tools/go/packages"
+)
+
+func Test_TemplateExecution(t *testing.T) {
+	tests := []struct {
+		name           string
+		code           string
+		wantContain    []string
+		wantNotContain []string
+	}{
+		{
+			name: "map_literal_data",
+			code: `
+package main
+import (
+	"html/template"
+	"net/http"
+)
+var tmpl = template.Must(template.ParseFiles("index.html"))
+func index(w http.ResponseWriter, r *http.Request) {
+	tmpl.ExecuteTemplate(w, "index.html", map[string]any{"Title": "home"})
+}`,
+			wantContain: []string{
+				"// to enable New Relic browser monitoring, render {{.NewRelicBrowserTimingHeader}} in the <head> of this page",
+				`nrExecuteNamedTemplate(nrTxn, tmpl, w, "index.html", map[string]any{"Title": "home", "NewRelicBrowserTimingHeader": nrBrowserTimingHeader(nrTxn)})`,
+				"func nrExecuteNamedTemplate(txn *newrelic.Transaction, tmpl *template.Template, wr io.Writer, name string, data any) error {",
+				"func nrBrowserTimingHeader(txn *newrelic.Transaction) template.HTML {",
+			},
+		},
+		{
+			name: "struct_data",
+			code: `
+package main
+import (
+	"html/template"
+	"net/http"
+)
+type page struct {
+	Title string
+}
+var tmpl = template.Must(template.ParseFiles("index.html"))
+func index(w http.ResponseWriter, r *http.Request) {
+	if err := tmpl.Execute(w, page{Title: "home"}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}`,
+			wantContain: []string{
+				"// to enable New Relic browser monitoring, add nrBrowserTimingHeader(nrTxn) to the data of this template",
+				`if err := nrExecuteTemplate(nrTxn, tmpl, w, page{Title: "home"}); err != nil {`,
+				"func nrBrowserTimingHeader(txn *newrelic.Transaction) template.HTML {",
+			},
+		},
+		{
+			name: "not_rendered_as_response",
+			code: `
+package main
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+)
+var tmpl = template.Must(template.ParseFiles("index.html"))
+func index(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	tmpl.Execute(&buf, map[string]any{})
+	w.Write(buf.Bytes())
+}`,
+			wantContain:    []string{"nrExecuteTemplate(nrTxn, tmpl, &buf, map[string]any{})"},
+			wantNotContain: []string{"browser monitoring"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, tt.code)
+			pkg := manager.GetDecoratorPackage()
+			for _, decl := range pkg.Syntax[0].Decls {
+				if fn, ok := decl.(*dst.FuncDecl); ok {
+					manager.CreateFunctionDeclaration(fn)
+					dstutil.Apply(fn, nil, func(c *dstutil.Cursor) bool {
+						InstrumentHandleFunction(c.Node(), manager, c)
+						return true
+					})
+				}
+			}
+			manager.writeHelpers()
+
+			got := restoreTestFile(t, pkg.Syntax[0])
+			for _, want := range tt.wantContain {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected instrumented code to contain %q, but got:\n%s", want, got)
+				}
+			}
+			for _, notWant := range tt.wantNotContain {
+				if strings.Contains(got, notWant) {
+					t.Errorf("expected instrumented code not to contain %q, but got:\n%s", notWant, got)
+				}
+			}
+		})
+	}
+}
+
+// agentModule is the version of the agent the helpers added to applications are checked against
+const agentModule = "github.com/newrelic/go-agent/v3 v3.45.0"
+
+func Test_templateHelperSourcesCompile(t *testing.T) {
+	testAppDir := "tmp"
+	defer cleanupTestApp(t, testAppDir)
+	files := map[string]string{
+		"go.mod":  "module parser/tmp\n\ngo 1.22.1\n\nrequire " + agentModule + "\n",
+		"main.go": "package main\n\nfunc main() {}\n",
+	}
+	for name, source := range templateHelperSources {
+		files[name+".go"] = strings.Replace(source, "package helper", "package main", 1)
+	}
+	if err := os.MkdirAll(testAppDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, code := range files {
+		if err := os.WriteFile(filepath.Join(testAppDir, name), []byte(code), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the agent is resolved from the module cache when it can not be downloaded
+	cfg := &packages.Config{
+		Dir:  testAppDir,
+		Mode: loadMode,
+		Env:  append(os.Environ(), "GOFLAGS=-mod=mod", "GOSUMDB=off"),
+	}
+	pkgs, err := packages.Load(cfg, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkg := range pkgs {
+		if _, ok := pkg.Imports[newrelicAgentImport]; !ok {
+			t.Skipf("the agent could not be loaded: %v", pkg.Errors)
+		}
+		for _, err := range pkg.Errors {
+			// dependencies of the agent that are not available do not prevent checking the helpers against it
+			if err.Kind == packages.TypeError && strings.Contains(err.Pos, testAppDir) {
+				t.Errorf("helper does not compile against %s: %v", agentModule, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+)
+
+// isWorkerLoop returns true if a loop repeats a unit of work until the program stops: a loop without a condition,
+// ex: for { job := queue.Next(); process(job) }, or a range over a channel, ex: for range ticker.C { sweep() }
+func isWorkerLoop(loop dst.Stmt, pkg *decorator.Package) bool {
+	switch v := loop.(type) {
+	case *dst.ForStmt:
+		return v.Cond == nil
+	case *dst.RangeStmt:
+		if pkg == nil || pkg.TypesInfo == nil {
+			return false
+		}
+		astExpr, ok := pkg.Decorator.Ast.Nodes[v.X].(ast.Expr)
+		if !ok {
+			return false
+		}
+		t := pkg.TypesInfo.TypeOf(astExpr)
+		if t == nil {
+			return false
+		}
+		_, ok = t.Underlying().(*types.Chan)
+		return ok
+	}
+	return false
+}
+
+// loopBody returns the body of a for or range loop.
+func loopBody(loop dst.Stmt) *dst.BlockStmt {
+	switch v := loop.(type) {
+	case *dst.ForStmt:
+		return v.Body
+	case *dst.RangeStmt:
+		return v.Body
+	}
+	return nil
+}
+
+// iterationCalls returns the calls of a statement to functions of the application that require a transaction,
+// tracing those functions if they have not been traced yet. Calls in function literals, goroutines and deferred
+// calls do not run as part of the iteration, and are not returned.
+func iterationCalls(manager *InstrumentationManager, stmt dst.Stmt, txnVarName string) []*invocationInfo {
+	calls := []*invocationInfo{}
+	dst.Inspect(stmt, func(n dst.Node) bool {
+		switch v := n.(type) {
+		case *dst.FuncLit, *dst.GoStmt, *dst.DeferStmt:
+			return false
+		case *dst.CallExpr:
+			invInfo := manager.GetPackageFunctionInvocation(v)
+			if invInfo == nil || invInfo.call != v {
+				return true
+			}
+			traceInvokedFunction(manager, invInfo)
+			if manager.RequiresTransactionArgument(invInfo, txnVarName) {
+				calls = append(calls, invInfo)
+			}
+		}
+		return true
+	})
+	return calls
+}
+
+// loopLabels returns the labels declared in the body of a loop.
+func loopLabels(body *dst.BlockStmt) map[string]bool {
+	labels := map[string]bool{}
+	dst.Inspect(body, func(n dst.Node) bool {
+		switch v := n.(type) {
+		case *dst.FuncLit:
+			return false
+		case *dst.LabeledStmt:
+			labels[v.Label.Name] = true
+		}
+		return true
+	})
+	return labels
+}
+
+// endsIteration returns true if a statement ends an iteration of a loop early. Labeled continue and break statements
+// end it unless their label is declared in the loop, and unlabeled ones unless they are in a nested loop, or, for
+// break, a nested switch or select.
+func endsIteration(stmt dst.Stmt, innerLabels map[string]bool, nestedLoop, nestedBreak bool, pkg *decorator.Package) bool {
+	branch, ok := stmt.(*dst.BranchStmt)
+	if !ok {
+		return isTerminatingStmt(stmt, pkg)
+	}
+	if branch.Tok != token.CONTINUE && branch.Tok != token.BREAK {
+		return false
+	}
+	if branch.Label != nil {
+		return !innerLabels[branch.Label.Name]
+	}
+	if branch.Tok == token.CONTINUE {
+		return !nestedLoop
+	}
+	return !nestedBreak
+}
+
+// endIterationEarly inserts txn.End() before each statement of a list that ends an iteration of a loop early, in
+// the list and in the blocks nested in it. It returns the updated list.
+func endIterationEarly(list []dst.Stmt, txnVarName string, innerLabels map[string]bool, nestedLoop, nestedBreak bool, pkg *decorator.Package) []dst.Stmt {
+	updated := make([]dst.Stmt, 0, len(list))
+	for _, stmt := range list {
+		if endsIteration(stmt, innerLabels, nestedLoop, nestedBreak, pkg) {
+			// the values returned may be computed by functions the transaction is passed to
+			if ret, ok := stmt.(*dst.ReturnStmt); ok && len(ret.Results) > 0 {
+				updated = append(updated, deferEndTransaction(txnVarName))
+			} else {
+				updated = append(updated, endTransaction(txnVarName))
+			}
+		}
+		updated = append(updated, stmt)
+		endNestedIterationEarly(stmt, txnVarName, innerLabels, nestedLoop, nestedBreak, pkg)
+	}
+	return updated
+}
+
+// endNestedIterationEarly inserts txn.End() in the blocks of a statement before each statement that ends an
+// iteration of a loop early.
+func endNestedIterationEarly(stmt dst.Stmt, txnVarName string, innerLabels map[string]bool, nestedLoop, nestedBreak bool, pkg *decorator.Package) {
+	block := func(b *dst.BlockStmt, loop, breakable bool) {
+		if b != nil {
+			b.List = endIterationEarly(b.List, txnVarName, innerLabels, loop, breakable, pkg)
+		}
+	}
+	switch v := stmt.(type) {
+	case *dst.BlockStmt:
+		block(v, nestedLoop, nestedBreak)
+	case *dst.LabeledStmt:
+		endNestedIterationEarly(v.Stmt, txnVarName, innerLabels, nestedLoop, nestedBreak, pkg)
+	case *dst.IfStmt:
+		block(v.Body, nestedLoop, nestedBreak)
+		if v.Else != nil {
+			endNestedIterationEarly(v.Else, txnVarName, innerLabels, nestedLoop, nestedBreak, pkg)
+		}
+	case *dst.ForStmt:
+		block(v.Body, true, true)
+	case *dst.RangeStmt:
+		block(v.Body, true, true)
+	case *dst.SwitchStmt:
+		block(v.Body, nestedLoop, true)
+	case *dst.TypeSwitchStmt:
+		block(v.Body, nestedLoop, true)
+	case *dst.SelectStmt:
+		block(v.Body, nestedLoop, true)
+	case *dst.CaseClause:
+		v.Body = endIterationEarly(v.Body, txnVarName, innerLabels, nestedLoop, nestedBreak, pkg)
+	case *dst.CommClause:
+		v.Body = endIterationEarly(v.Body, txnVarName, innerLabels, nestedLoop, nestedBreak, pkg)
+	}
+}
+
+// instrumentWorkerLoop starts a background transaction for each iteration of a worker loop of an entry point, named
+// after the first function of the application called in the loop that requires a transaction. The transaction is
+// started right before the statement that calls it, so that waiting for work is not part of it, and is ended at the
+// end of the iteration, and before the continue, break, return and exit statements that end it early. It returns
+// true if the loop was instrumented.
+func instrumentWorkerLoop(manager *InstrumentationManager, loop dst.Stmt) bool {
+	pkg := manager.GetDecoratorPackage()
+	body := loopBody(loop)
+	if body == nil || !isWorkerLoop(loop, pkg) {
+		return false
+	}
+
+	txnVarName := defaultTxnName
+	start := -1
+	list := make([]dst.Stmt, 0, len(body.List)+2)
+	for _, stmt := range body.List {
+		calls := iterationCalls(manager, stmt, txnVarName)
+		if len(calls) > 0 && start < 0 {
+			start = len(list)
+			list = append(list, startTransaction(manager.agentVariableName, txnVarName, calls[0].functionName, false))
+		}
+		for _, invInfo := range calls {
+			invInfo.call.Args = append(invInfo.call.Args, dst.NewIdent(txnVarName))
+		}
+		list = append(list, stmt)
+	}
+	if start < 0 {
+		return false
+	}
+
+	// the statements before the transaction is started can not end it
+	innerLabels := loopLabels(body)
+	iteration := endIterationEarly(list[start+1:], txnVarName, innerLabels, false, false, pkg)
+	body.List = append(list[:start+1], iteration...)
+	if last := body.List[len(body.List)-1]; !endsIteration(last, innerLabels, false, false, pkg) {
+		body.List = append(body.List, endTransaction(txnVarName))
+	}
+	return true
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_InstrumentMain_workerLoops(t *testing.T) {
+	tests := []struct {
+		name           string
+		code           string
+		wantContain    []string
+		wantNotContain []string
+	}{
+		{
+			name: "for_without_condition",
+			code: `
+package main
+import (
+	"net/http"
+	"time"
+)
+func main() {
+	for {
+		url := next()
+		if url == "" {
+			time.Sleep(time.Second)
+			continue
+		}
+		if err := fetch(url); err != nil {
+			continue
+		}
+		if url == "stop" {
+			break
+		}
+		report(url)
+	}
+}
+func next() string {
+	return ""
+}
+func fetch(url string) error {
+	_, err := http.Get(url)
+	return err
+}
+func report(url string) {
+	_, _ = http.Get(url)
+}
+`,
+			wantContain: []string{
+				"url := next()\n\t\tif url == \"\" {\n\t\t\ttime.Sleep(time.Second)\n\t\t\tcontinue\n\t\t}\n\t\tnrTxn := NewRelicAgent.StartTransaction(\"fetch\")",
+				"if err := fetch(url, nrTxn); err != nil {\n\t\t\tnrTxn.End()\n\t\t\tcontinue\n\t\t}",
+				"if url == \"stop\" {\n\t\t\tnrTxn.End()\n\t\t\tbreak\n\t\t}",
+				"report(url, nrTxn)\n\t\tnrTxn.End()\n\t}",
+			},
+		},
+		{
+			name: "range_over_channel",
+			code: `
+package main
+import (
+	"net/http"
+	"time"
+)
+func main() {
+	ticker := time.NewTicker(time.Minute)
+	for range ticker.C {
+		sweep()
+	}
+}
+func sweep() {
+	_, _ = http.Get("http://example.com")
+}
+`,
+			wantContain: []string{
+				"for range ticker.C {\n\t\tnrTxn := NewRelicAgent.StartTransaction(\"sweep\")\n\t\tsweep(nrTxn)\n\t\tnrTxn.End()\n\t}",
+			},
+		},
+		{
+			name: "nested_loops_and_labels",
+			code: `
+package main
+import "net/http"
+func main() {
+jobs:
+	for {
+		for _, url := range urls() {
+			if url == "" {
+				continue
+			}
+			if url == "skip" {
+				continue jobs
+			}
+			switch url {
+			case "done":
+				break
+			case "quit":
+				return
+			}
+			fetch(url)
+		}
+	}
+}
+func urls() []string {
+	return nil
+}
+func fetch(url string) {
+	_, _ = http.Get(url)
+}
+`,
+			wantContain: []string{
+				"jobs:\n\tfor {\n\t\tnrTxn := NewRelicAgent.StartTransaction(\"fetch\")",
+				"if url == \"\" {\n\t\t\t\tcontinue\n\t\t\t}",
+				"if url == \"skip\" {\n\t\t\t\tnrTxn.End()\n\t\t\t\tcontinue jobs\n\t\t\t}",
+				"case \"done\":\n\t\t\t\tbreak\n",
+				"case \"quit\":\n\t\t\t\tnrTxn.End()\n\t\t\t\treturn",
+				"fetch(url, nrTxn)\n\t\t}\n\t\tnrTxn.End()\n\t}",
+			},
+		},
+		{
+			name: "loop_with_condition",
+			code: `
+package main
+import "net/http"
+func main() {
+	for i := 0; i < 3; i++ {
+		fetch("http://example.com")
+	}
+}
+func fetch(url string) {
+	_, _ = http.Get(url)
+}
+`,
+			wantContain: []string{
+				"nrTxn := NewRelicAgent.StartTransaction(\"fetch\")\n\t\tfetch(\"http://example.com\", nrTxn)\n\t\tnrTxn.End()",
+			},
+		},
+		{
+			name: "no_traced_calls",
+			code: `
+package main
+import "time"
+func main() {
+	for range time.Tick(time.Second) {
+		tick()
+	}
+}
+func tick() {}
+`,
+			wantNotContain: []string{
+				"StartTransaction",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, tt.code)
+			if err := tracePackageFunctionCalls(manager); err != nil {
+				t.Fatal(err)
+			}
+			instrumentPackages(manager, InstrumentMain)
+
+			got := restoreTestFile(t, manager.GetDecoratorPackage().Syntax[0])
+			for _, want := range tt.wantContain {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected instrumented code to contain %q, but got:\n%s", want, got)
+				}
+			}
+			for _, notWant := range tt.wantNotContain {
+				if strings.Contains(got, notWant) {
+					t.Errorf("expected instrumented code not to contain %q, but got:\n%s", notWant, got)
+				}
+			}
+		})
+	}
+}
@@ -32,7 +32,8 @@ func main() {
 	}
 
 	manager := NewInstrumentationManager(pkgs, cfg.AppName, cfg.AgentVariableName, cfg.DiffFile, cfg.PackagePath)
-	err = manager.InstrumentPackages(InstrumentMain, InstrumentHandleFunction, InstrumentHttpClient, CannotInstrumentHttpMethod)
+	manager.ApplyConfig(cfg)
+	err = manager.InstrumentPackages(InstrumentMain, InstrumentHandleFunction, InstrumentHttpClient, CannotInstrumentHttpMethod, InstrumentFastHttpHandler, InstrumentElasticsearchClient, InstrumentSdkHttpClient)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+)
+
+// traceInvokedFunction traces the function of the application invoked by a statement of main, if it has not been
+// traced already. Functions that run a command line application are not, since its commands get their own
+// transactions.
+func traceInvokedFunction(manager *InstrumentationManager, invInfo *invocationInfo) {
+	if !manager.ShouldInstrumentFunction(invInfo) || manager.runsCommandLine(invInfo) {
+		return
+	}
+	rootPkg := manager.currentPackage
+	manager.SetPackage(invInfo.packageName)
+	decl := manager.GetDeclaration(invInfo.functionName)
+	_, wasModified := TraceFunction(manager, decl, defaultTxnName)
+	if wasModified {
+		// add transaction to declaration arguments
+		manager.AddTxnArgumentToFunctionDecl(decl, defaultTxnName)
+		manager.AddImport(newrelicAgentImport)
+	}
+	manager.SetPackage(rootPkg)
+}
+
+// setsUpHandlers returns true if an invoked function registers http handlers or builds an http server, such as a
+// function that returns the mux or the server main listens with. Its handlers get transactions of their own when
+// requests are served, so calling it is not a unit of work.
+func (m *InstrumentationManager) setsUpHandlers(inv *invocationInfo) bool {
+	state, ok := m.packages[inv.packageName]
+	if !ok {
+		return false
+	}
+	fn, ok := state.tracedFuncs[inv.functionName]
+	if !ok || fn.body == nil || fn.body.Body == nil {
+		return false
+	}
+	rootPkg := m.currentPackage
+	m.SetPackage(inv.packageName)
+	defer m.SetPackage(rootPkg)
+
+	setsUp := false
+	dst.Inspect(fn.body.Body, func(n dst.Node) bool {
+		switch v := n.(type) {
+		case *dst.CallExpr:
+			method := GetNetHttpMethod(v, state.pkg)
+			if method == HttpHandleFunc || method == HttpMuxHandle || isFastHttpRouteRegistration(v, m) {
+				setsUp = true
+			}
+		case *dst.CompositeLit:
+			if isHttpServerLit(v, state.pkg) {
+				setsUp = true
+			}
+		}
+		return !setsUp
+	})
+	return setsUp
+}
+
+// statementInvocation returns the invocation of a function of the application by a statement that is not an
+// expression: the values of an assignment or a return, the init and condition of an if statement, and the init
+// and tag of a switch statement. Calls in the bodies of if and switch statements are their own statements. Calls
+// to functions that set up the handlers of a server, or build a command line application the statement runs, are
+// not returned.
+func statementInvocation(manager *InstrumentationManager, stmt dst.Stmt) *invocationInfo {
+	nodes := []dst.Node{}
+	switch v := stmt.(type) {
+	case *dst.AssignStmt:
+		for _, expr := range v.Rhs {
+			nodes = append(nodes, expr)
+		}
+	case *dst.ReturnStmt:
+		for _, expr := range v.Results {
+			nodes = append(nodes, expr)
+		}
+	case *dst.IfStmt:
+		nodes = append(nodes, v.Init, v.Cond)
+	case *dst.SwitchStmt:
+		nodes = append(nodes, v.Init, v.Tag)
+	}
+	for _, node := range nodes {
+		if node == nil {
+			continue
+		}
+		if invInfo := manager.GetPackageFunctionInvocation(node); invInfo != nil {
+			if manager.setsUpHandlers(invInfo) || runsCommandLineOf(node, invInfo, manager.GetDecoratorPackage()) {
+				return nil
+			}
+			return invInfo
+		}
+	}
+	return nil
+}
+
+// isTerminatingStmt returns true if a statement leaves the function it is in: a return, a panic, or a call that
+// exits the program.
+func isTerminatingStmt(stmt dst.Stmt, pkg *decorator.Package) bool {
+	switch v := stmt.(type) {
+	case *dst.ReturnStmt:
+		return true
+	case *dst.ExprStmt:
+		if call, ok := v.X.(*dst.CallExpr); ok {
+			if ident, ok := call.Fun.(*dst.Ident); ok && ident.Name == "panic" && ident.Path == "" {
+				return true
+			}
+		}
+		return isExitStmt(v, pkg)
+	}
+	return false
+}
+
+// endTransactionInBranches ends a transaction before the statements that leave the function at the end of the
+// branches of an if or switch statement, since the transaction is otherwise ended after the statement.
+func endTransactionInBranches(stmt dst.Stmt, txnVarName string, pkg *decorator.Package) {
+	endBefore := func(block *dst.BlockStmt) {
+		if block == nil || len(block.List) == 0 || !isTerminatingStmt(block.List[len(block.List)-1], pkg) {
+			return
+		}
+		last := len(block.List) - 1
+		block.List = append(block.List[:last], endTransaction(txnVarName), block.List[last])
+	}
+	switch v := stmt.(type) {
+	case *dst.IfStmt:
+		endBefore(v.Body)
+		switch e := v.Else.(type) {
+		case *dst.BlockStmt:
+			endBefore(e)
+		case *dst.IfStmt:
+			endTransactionInBranches(e, txnVarName, pkg)
+		}
+	case *dst.SwitchStmt:
+		for _, stmt := range v.Body.List {
+			if clause, ok := stmt.(*dst.CaseClause); ok {
+				block := &dst.BlockStmt{List: clause.Body}
+				endBefore(block)
+				clause.Body = block.List
+			}
+		}
+	}
+}
+
+// deferEndTransaction creates the statement: defer txn.End()
+func deferEndTransaction(txnVarName string) *dst.DeferStmt {
+	return &dst.DeferStmt{
+		Call: endTransaction(txnVarName).X.(*dst.CallExpr),
+	}
+}
+
+// hasConstantArgs returns true if the arguments of a call are all literals, so that evaluating them when the call
+// runs instead of when it is deferred does not change the program.
+func hasConstantArgs(call *dst.CallExpr) bool {
+	for _, arg := range call.Args {
+		if _, ok := arg.(*dst.BasicLit); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// deferredTransaction wraps a deferred call to a function of the application in a function literal that starts a
+// transaction when the call runs, and ends it once the call returns:
+//
+//	defer func() {
+//		nrTxn := app.StartTransaction("cleanup")
+//		cleanup(nrTxn)
+//		nrTxn.End()
+//	}()
+func deferredTransaction(manager *InstrumentationManager, deferStmt *dst.DeferStmt, invInfo *invocationInfo, txnVarName string) {
+	call := deferStmt.Call
+	call.Args = append(call.Args, dst.NewIdent(txnVarName))
+	deferStmt.Call = &dst.CallExpr{
+		Fun: &dst.FuncLit{
+			Type: &dst.FuncType{},
+			Body: &dst.BlockStmt{
+				List: []dst.Stmt{
+					startTransaction(manager.agentVariableName, txnVarName, invInfo.functionName, false),
+					&dst.ExprStmt{X: call},
+					endTransaction(txnVarName),
+				},
+			},
+		},
+	}
+}
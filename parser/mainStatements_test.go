@@ -0,0 +1,233 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_InstrumentMain_statements(t *testing.T) {
+	tests := []struct {
+		name           string
+		code           string
+		wantContain    []string
+		wantNotContain []string
+	}{
+		{
+			name: "assignment",
+			code: `
+package main
+import (
+	"log"
+	"net/http"
+)
+func main() {
+	resp, err := fetch("http://example.com")
+	log.Println(resp, err)
+}
+func fetch(url string) (*http.Response, error) {
+	resp, err := http.Get(url)
+	return resp, err
+}
+`,
+			wantContain: []string{
+				"nrTxn := NewRelicAgent.StartTransaction(\"fetch\")\n\tresp, err := fetch(\"http://example.com\", nrTxn)\n\tnrTxn.End()\n\tlog.Println(resp, err)",
+			},
+		},
+		{
+			name: "if_init",
+			code: `
+package main
+import (
+	"log"
+	"net/http"
+)
+func main() {
+	if err := ping("http://example.com"); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("ok")
+}
+func ping(url string) error {
+	_, err := http.Get(url)
+	return err
+}
+`,
+			wantContain: []string{
+				"nrTxn := NewRelicAgent.StartTransaction(\"ping\")\n\tif err := ping(\"http://example.com\", nrTxn); err != nil {\n\t\tnrTxn.End()\n\t\tNewRelicAgent.Shutdown(5 * time.Second)\n\t\tlog.Fatal(err)\n\t}\n\tnrTxn.End()\n\tlog.Println(\"ok\")",
+			},
+		},
+		{
+			name: "if_body_call",
+			code: `
+package main
+import (
+	"log"
+	"net/http"
+)
+func main() {
+	if err := ping("a"); err != nil {
+		cleanup("b")
+	}
+	log.Println("done")
+}
+func ping(url string) error {
+	_, err := http.Get(url)
+	return err
+}
+func cleanup(url string) {
+	_, _ = http.Get(url)
+}
+`,
+			wantContain: []string{
+				"nrTxn := NewRelicAgent.StartTransaction(\"ping\")\n\tif err := ping(\"a\", nrTxn); err != nil {\n\t\tcleanup(\"b\", nrTxn)\n\t}\n\tnrTxn.End()\n\tlog.Println(\"done\")",
+			},
+			wantNotContain: []string{
+				"StartTransaction(\"cleanup\")",
+				"nrTxn.End()\n\tnrTxn.End()",
+			},
+		},
+		{
+			name: "switch_init",
+			code: `
+package main
+import (
+	"log"
+	"net/http"
+)
+func main() {
+	switch err := ping("http://example.com"); {
+	case err != nil:
+		panic(err)
+	default:
+		log.Println("ok")
+	}
+}
+func ping(url string) error {
+	_, err := http.Get(url)
+	return err
+}
+`,
+			wantContain: []string{
+				"nrTxn := NewRelicAgent.StartTransaction(\"ping\")\n\tswitch err := ping(\"http://example.com\", nrTxn); {",
+				"case err != nil:\n\t\tnrTxn.End()\n\t\tpanic(err)",
+				"default:\n\t\tlog.Println(\"ok\")\n\t}\n\tnrTxn.End()",
+			},
+		},
+		{
+			name: "return_from_run",
+			code: `
+package main
+import (
+	"log"
+	"net/http"
+)
+func main() {
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+func run() error {
+	return ping("http://example.com")
+}
+func ping(url string) error {
+	_, err := http.Get(url)
+	return err
+}
+`,
+			wantContain: []string{
+				"nrTxn := NewRelicAgent.StartTransaction(\"ping\")\n\tdefer nrTxn.End()\n\treturn ping(\"http://example.com\", nrTxn)",
+			},
+		},
+		{
+			name: "defer",
+			code: `
+package main
+import (
+	"log"
+	"net/http"
+)
+func main() {
+	defer notify("http://example.com")
+	log.Println("running")
+}
+func notify(url string) {
+	resp, err := http.Get(url)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+`,
+			wantContain: []string{
+				"defer func() {\n\t\tnrTxn := NewRelicAgent.StartTransaction(\"notify\")\n\t\tnotify(\"http://example.com\", nrTxn)\n\t\tnrTxn.End()\n\t}()",
+			},
+		},
+		{
+			name: "defer_with_variable_arguments",
+			code: `
+package main
+import (
+	"log"
+	"net/http"
+)
+func main() {
+	url := "http://example.com"
+	defer notify(url)
+	log.Println("running")
+}
+func notify(url string) {
+	resp, err := http.Get(url)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+`,
+			wantContain: []string{
+				"defer notify(url)",
+			},
+			wantNotContain: []string{
+				"StartTransaction(\"notify\")",
+			},
+		},
+		{
+			name: "untraced_function",
+			code: `
+package main
+import "log"
+func main() {
+	n := count()
+	log.Println(n)
+}
+func count() int {
+	return 1
+}
+`,
+			wantContain: []string{
+				"n := count()",
+			},
+			wantNotContain: []string{
+				"StartTransaction",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, tt.code)
+			if err := tracePackageFunctionCalls(manager); err != nil {
+				t.Fatal(err)
+			}
+			instrumentPackages(manager, InstrumentMain)
+
+			got := restoreTestFile(t, manager.GetDecoratorPackage().Syntax[0])
+			for _, want := range tt.wantContain {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected instrumented code to contain %q, but got:\n%s", want, got)
+				}
+			}
+			for _, notWant := range tt.wantNotContain {
+				if strings.Contains(got, notWant) {
+					t.Errorf("expected instrumented code not to contain %q, but got:\n%s", notWant, got)
+				}
+			}
+		})
+	}
+}
@@ -2,14 +2,17 @@ package main
 
 import (
 	"bytes"
-	"errors"
+	"go/token"
+	"go/types"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 
 	"github.com/dave/dst"
 	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/decorator/resolver/goast"
 	"github.com/dave/dst/decorator/resolver/gopackages"
 	"github.com/dave/dst/dstutil"
 	godiffpatch "github.com/sourcegraph/go-diff-patch"
@@ -37,6 +40,14 @@ type InstrumentationManager struct {
 	agentVariableName string
 	currentPackage    string
 	packages          map[string]*PackageState // stores stateful information on packages by ID
+
+	rewriteHttpMethods bool // rewrite net/http methods that can not be instrumented into instrumented requests
+
+	untracedExternalCalls string       // how external calls made outside of a transaction are handled
+	agentOptions          AgentOptions // options the application created in main is configured with
+
+	wrappedHandlers    map[types.Object]bool // handlers registered through a wrapper that gives them the response writer of their transaction
+	wrappedHandlerLits map[*dst.FuncLit]bool // handler literals registered through such a wrapper
 }
 
 // PackageManager contains state relevant to tracing within a single package.
@@ -44,6 +55,14 @@ type PackageState struct {
 	pkg          *decorator.Package         // the package being instrumented
 	tracedFuncs  map[string]*tracedFunction // maintains state of tracing for functions within the package
 	importsAdded map[string]bool            // tracks imports added to the package
+	helpersAdded map[string][]dst.Decl      // declarations instrumentation depends on, by helper name
+
+	middlewareMuxes map[types.Object]bool    // muxes served through middleware that starts transactions for them
+	handlerRequests map[types.Object]bool    // request parameters of instrumented handlers, whose context carries a transaction
+	tracedDecls     map[string]*dst.FuncDecl // declarations traced by a transaction, by name prefixed by the receiver type of methods
+	statusHandlers  []statusHandler          // instrumented handlers that write status codes
+	agentDecl       *dst.FuncDecl            // function the application is created in
+	appName         string                   // name of the application created in a main package
 }
 
 const (
@@ -65,12 +84,20 @@ func NewInstrumentationManager(pkgs []*decorator.Package, appName, agentVariable
 			pkg:          pkg,
 			tracedFuncs:  map[string]*tracedFunction{},
 			importsAdded: map[string]bool{},
+			helpersAdded: map[string][]dst.Decl{},
 		}
 	}
 
 	return manager
 }
 
+// ApplyConfig sets the instrumentation options chosen by the user.
+func (m *InstrumentationManager) ApplyConfig(cfg *CLIConfig) {
+	m.rewriteHttpMethods = cfg.RewriteHttpMethods
+	m.untracedExternalCalls = cfg.UntracedExternalCalls
+	m.agentOptions = cfg.AgentOptions
+}
+
 func (m *InstrumentationManager) SetPackage(pkgName string) {
 	m.currentPackage = pkgName
 }
@@ -98,6 +125,122 @@ func (m *InstrumentationManager) GetImports(fileName string) []string {
 	return ret
 }
 
+// AddHelper adds declarations that generated code depends on to the current package. A helper is only added once
+// per package, and is appended to the package's source once instrumentation is complete.
+func (m *InstrumentationManager) AddHelper(name string, decls ...dst.Decl) {
+	state, ok := m.packages[m.currentPackage]
+	if !ok || state.helpersAdded == nil {
+		return
+	}
+
+	if _, ok := state.helpersAdded[name]; !ok {
+		state.helpersAdded[name] = decls
+	}
+}
+
+// AddMiddlewareMux records that a mux is served through middleware that starts transactions for its requests.
+func (m *InstrumentationManager) AddMiddlewareMux(mux types.Object) {
+	state, ok := m.packages[m.currentPackage]
+	if !ok || mux == nil {
+		return
+	}
+	if state.middlewareMuxes == nil {
+		state.middlewareMuxes = map[types.Object]bool{}
+	}
+	state.middlewareMuxes[mux] = true
+}
+
+// IsMiddlewareMux returns true if a mux is served through middleware that starts transactions for its requests.
+func (m *InstrumentationManager) IsMiddlewareMux(mux types.Object) bool {
+	state, ok := m.packages[m.currentPackage]
+	return ok && mux != nil && state.middlewareMuxes[mux]
+}
+
+// AddHandlerRequest records the request parameter of an http handler instrumented by InstrumentHandleFunction.
+func (m *InstrumentationManager) AddHandlerRequest(req types.Object) {
+	state, ok := m.packages[m.currentPackage]
+	if !ok || req == nil {
+		return
+	}
+	if state.handlerRequests == nil {
+		state.handlerRequests = map[types.Object]bool{}
+	}
+	state.handlerRequests[req] = true
+}
+
+// IsHandlerRequest returns true if a request is the parameter of an http handler instrumented by InstrumentHandleFunction.
+func (m *InstrumentationManager) IsHandlerRequest(req types.Object) bool {
+	state, ok := m.packages[m.currentPackage]
+	return ok && req != nil && state.handlerRequests[req]
+}
+
+// AddStatusHandler records an instrumented http handler that writes status codes to its response writer.
+func (m *InstrumentationManager) AddStatusHandler(handler statusHandler) {
+	state, ok := m.packages[m.currentPackage]
+	if ok {
+		state.statusHandlers = append(state.statusHandlers, handler)
+	}
+}
+
+// SetAgentFunction records the function of the current package that the application is created in.
+func (m *InstrumentationManager) SetAgentFunction(decl *dst.FuncDecl) {
+	state, ok := m.packages[m.currentPackage]
+	if ok {
+		state.agentDecl = decl
+	}
+}
+
+// AgentFunction returns the function of the current package that the application is created in, if it has one.
+func (m *InstrumentationManager) AgentFunction() *dst.FuncDecl {
+	state, ok := m.packages[m.currentPackage]
+	if !ok {
+		return nil
+	}
+	return state.agentDecl
+}
+
+// writeHelpers appends the helpers added to each package to the first file in that package.
+func (m *InstrumentationManager) writeHelpers() {
+	for _, state := range m.packages {
+		if len(state.helpersAdded) == 0 || len(state.pkg.Syntax) == 0 {
+			continue
+		}
+
+		names := make([]string, 0, len(state.helpersAdded))
+		for name := range state.helpersAdded {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		file := state.pkg.Syntax[0]
+		for _, name := range names {
+			for _, decl := range state.helpersAdded[name] {
+				decl.Decorations().Before = dst.EmptyLine
+				file.Decls = append(file.Decls, decl)
+			}
+		}
+	}
+}
+
+// parseHelperDecls parses the source code of a helper into declarations that can be added to a package.
+// Identifiers from imported packages are resolved, so their imports are added when the package is restored.
+func parseHelperDecls(src string) []dst.Decl {
+	dec := decorator.NewDecoratorWithImports(token.NewFileSet(), "helper", goast.New())
+	file, err := dec.Parse(src)
+	if err != nil {
+		log.Fatalf("failed to parse helper source: %v", err)
+	}
+
+	decls := []dst.Decl{}
+	for _, decl := range file.Decls {
+		if gen, ok := decl.(*dst.GenDecl); ok && gen.Tok == token.IMPORT {
+			continue
+		}
+		decls = append(decls, decl)
+	}
+	return decls
+}
+
 // Returns Decorator Package for the current package being instrumented
 func (m *InstrumentationManager) GetDecoratorPackage() *decorator.Package {
 	state, ok := m.packages[m.currentPackage]
@@ -138,6 +281,11 @@ func (m *InstrumentationManager) UpdateFunctionDeclaration(decl *dst.FuncDecl) {
 			t.body = decl
 			t.traced = true
 		}
+		// methods of different types can share a name
+		if state.tracedDecls == nil {
+			state.tracedDecls = map[string]*dst.FuncDecl{}
+		}
+		state.tracedDecls[funcDeclName(decl)] = decl
 	}
 }
 
@@ -368,30 +516,32 @@ func (m *InstrumentationManager) InstrumentPackages(instrumentationFunctions ...
 	}
 
 	instrumentPackages(m, instrumentationFunctions...)
+	m.InstrumentCliCommands()
+	m.InstrumentScheduledJobs()
+	m.InstrumentUntracedHandlers()
+	m.UseTxnResponseWriters()
+	reportUntracedExternalCalls(m.InstrumentUntracedExternalCalls(), m.UntracedExternalCalls())
+	m.writeHelpers()
 
 	return nil
 }
 
 // traceFunctionCalls discovers and sets up tracing for all function calls in the current package
 func tracePackageFunctionCalls(manager *InstrumentationManager) error {
-	hasMain := false
+	if err := manager.selectBinaries(); err != nil {
+		return err
+	}
+
 	for packageName, pkg := range manager.packages {
 		manager.SetPackage(packageName)
 		for _, file := range pkg.pkg.Syntax {
 			for _, decl := range file.Decls {
 				if fn, isFn := decl.(*dst.FuncDecl); isFn {
 					manager.CreateFunctionDeclaration(fn)
-					if fn.Name.Name == "main" {
-						hasMain = true
-					}
 				}
 			}
 		}
 	}
-
-	if !hasMain {
-		return errors.New("cannot find a main method for this application")
-	}
 	return nil
 }
 
@@ -403,16 +553,15 @@ func instrumentPackages(manager *InstrumentationManager, instrumentationFunction
 	for pkgName, pkgState := range manager.packages {
 		manager.SetPackage(pkgName)
 		for _, file := range pkgState.pkg.Syntax {
+			// package level declarations, such as variables, are instrumented along with functions
 			for _, decl := range file.Decls {
-				if fn, isFn := decl.(*dst.FuncDecl); isFn {
-					dstutil.Apply(fn, nil, func(c *dstutil.Cursor) bool {
-						n := c.Node()
-						for _, instFunc := range instrumentationFunctions {
-							instFunc(n, manager, c)
-						}
-						return true
-					})
-				}
+				dstutil.Apply(decl, nil, func(c *dstutil.Cursor) bool {
+					n := c.Node()
+					for _, instFunc := range instrumentationFunctions {
+						instFunc(n, manager, c)
+					}
+					return true
+				})
 			}
 		}
 	}
@@ -3,7 +3,13 @@ package main
 import (
 	"fmt"
 	"go/ast"
+	"go/constant"
 	"go/token"
+	"go/types"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/dave/dst"
 	"github.com/dave/dst/decorator"
@@ -14,10 +20,14 @@ const (
 	NetHttp = "net/http"
 
 	// Methods that can be instrumented
-	HttpHandleFunc = "HandleFunc"
-	HttpMuxHandle  = "Handle"
-	HttpNewRequest = "NewRequest"
-	HttpDo         = "Do"
+	HttpHandleFunc            = "HandleFunc"
+	HttpMuxHandle             = "Handle"
+	HttpNewRequest            = "NewRequest"
+	HttpNewRequestWithContext = "NewRequestWithContext"
+	HttpError                 = "Error"
+	HttpWriteHeader           = "WriteHeader"
+	HttpResponseWriterType    = "net/http.ResponseWriter"
+	HttpDo                    = "Do"
 
 	// methods cannot be instrumented
 	HttpGet      = "Get"
@@ -32,6 +42,19 @@ const (
 	// http client type
 	HttpClientType = `*net/http.Client`
 	HttpPath       = `net/http`
+
+	// http server and handler types
+	HttpServerType        = "net/http.Server"
+	HttpHandlerType       = "Handler"
+	HttpServeHTTP         = "ServeHTTP"
+	HttpServerField       = "Handler"
+	HttpServeMuxType      = "*net/http.ServeMux"
+	HttpListenAndServe    = "ListenAndServe"
+	HttpListenAndServeTLS = "ListenAndServeTLS"
+
+	// names given to unnamed handler parameters
+	defaultRequestName        = "r"
+	defaultResponseWriterName = "w"
 )
 
 func typeOfIdent(ident *dst.Ident, pkg *decorator.Package) string {
@@ -109,37 +132,250 @@ func GetNetHttpMethod(n *dst.CallExpr, pkg *decorator.Package) string {
 	return ""
 }
 
+// helpers that wrap a handler with a transaction named independently of the pattern it is registered with
+const (
+	wrapHandleFuncHelper    = "nrWrapHandleFunc"
+	wrapHandleHelper        = "nrWrapHandle"
+	wrapServerHandlerHelper = "nrWrapServerHandler"
+)
+
+const wrapHandleFuncSource = `package helper
+
+import (
+	"net/http"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// nrWrapHandleFunc wraps handler with a New Relic transaction named after the route it serves.
+func nrWrapHandleFunc(app *newrelic.Application, route string, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	_, wrapped := newrelic.WrapHandleFunc(app, route, handler)
+	return wrapped
+}
+`
+
+const wrapHandleSource = `package helper
+
+import (
+	"net/http"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// nrWrapHandle wraps handler with a New Relic transaction named after the route it serves.
+func nrWrapHandle(app *newrelic.Application, route string, handler http.Handler) http.Handler {
+	_, wrapped := newrelic.WrapHandle(app, route, handler)
+	return wrapped
+}
+`
+
+const wrapServerHandlerSource = `package helper
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// nrWrapServerHandler starts a New Relic transaction for each request served by handler. When the requests are routed
+// by mux, transactions are named after the pattern of the route that matches the request.
+func nrWrapServerHandler(app *newrelic.Application, name string, mux *http.ServeMux, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if newrelic.FromContext(r.Context()) != nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		route := name
+		if mux != nil {
+			if _, pattern := mux.Handler(r); pattern != "" {
+				if _, path, hasMethod := strings.Cut(pattern, " "); hasMethod {
+					pattern = path
+				}
+				route = pattern
+			}
+		}
+
+		txn := app.StartTransaction(r.Method + " " + route)
+		defer txn.End()
+
+		w = txn.SetWebResponse(w)
+		txn.SetWebRequestHTTP(r)
+		handler.ServeHTTP(w, newrelic.RequestWithTransactionContext(r, txn))
+	})
+}
+`
+
+// patternConstant returns the value of a route pattern if it is known at instrumentation time.
+func patternConstant(pattern dst.Expr, pkg *decorator.Package) (string, bool) {
+	if lit, ok := pattern.(*dst.BasicLit); ok && lit.Kind == token.STRING {
+		value, err := strconv.Unquote(lit.Value)
+		return value, err == nil
+	}
+
+	if pkg == nil || pkg.TypesInfo == nil {
+		return "", false
+	}
+	astExpr, ok := pkg.Decorator.Ast.Nodes[pattern].(ast.Expr)
+	if !ok {
+		return "", false
+	}
+	tv, ok := pkg.TypesInfo.Types[astExpr]
+	if ok && tv.Value != nil && tv.Value.Kind() == constant.String {
+		return constant.StringVal(tv.Value), true
+	}
+	return "", false
+}
+
+var formatVerb = regexp.MustCompile(`%[-+# 0-9.\[\]*]*[a-zA-Z%]`)
+
+// patternFallbackName creates a readable name for a route pattern that can not be resolved at instrumentation time.
+// Variables are named in braces, and values formatted at runtime are replaced by a wildcard.
+func patternFallbackName(pattern dst.Expr, pkg *decorator.Package) string {
+	if value, ok := patternConstant(pattern, pkg); ok {
+		return value
+	}
+
+	switch v := pattern.(type) {
+	case *dst.Ident:
+		return "{" + v.Name + "}"
+	case *dst.SelectorExpr:
+		if name := selectorName(v); name != "" {
+			return "{" + name + "}"
+		}
+	case *dst.BinaryExpr:
+		if v.Op == token.ADD {
+			return patternFallbackName(v.X, pkg) + patternFallbackName(v.Y, pkg)
+		}
+	case *dst.ParenExpr:
+		return patternFallbackName(v.X, pkg)
+	case *dst.CallExpr:
+		fun, ok := v.Fun.(*dst.Ident)
+		if ok && fun.Path == "fmt" && fun.Name == "Sprintf" && len(v.Args) > 0 {
+			if format, ok := patternConstant(v.Args[0], pkg); ok {
+				return formatVerb.ReplaceAllStringFunc(format, func(verb string) string {
+					if verb == "%%" {
+						return "%"
+					}
+					return "*"
+				})
+			}
+		}
+	}
+	return "*"
+}
+
+// selectorName returns the dotted name of a selector expression made of identifiers, ex: "cfg.Routes.Index".
+func selectorName(sel *dst.SelectorExpr) string {
+	switch x := sel.X.(type) {
+	case *dst.Ident:
+		return x.Name + "." + sel.Sel.Name
+	case *dst.SelectorExpr:
+		if name := selectorName(x); name != "" {
+			return name + "." + sel.Sel.Name
+		}
+	}
+	return ""
+}
+
+// splitPatternMethod splits a Go 1.22 ServeMux pattern, "[METHOD ][HOST]/[PATH]", into its method and route.
+func splitPatternMethod(pattern string) (string, string) {
+	pattern = strings.TrimSpace(pattern)
+	i := strings.IndexAny(pattern, " \t")
+	if i < 0 {
+		return "", pattern
+	}
+	return pattern[:i], strings.TrimSpace(pattern[i:])
+}
+
+// httpRouteName returns the transaction name for a route registered with the pattern passed, and whether that name can be
+// the pattern itself. The agent prefixes transaction names with the request method, so methods are removed from names
+// to keep them consistent, ex: "GET /items/{id}" is named "/items/{id}".
+func httpRouteName(pattern dst.Expr, pkg *decorator.Package) (string, bool) {
+	value, isConstant := patternConstant(pattern, pkg)
+	if !isConstant {
+		value = patternFallbackName(pattern, pkg)
+	}
+
+	method, route := splitPatternMethod(value)
+	return route, isConstant && method == ""
+}
+
+// wrapHandlerRegistration wraps the handler passed to http.HandleFunc() or http.Handle() with a transaction
+// started by the application in app. It returns true if the call was modified.
+func wrapHandlerRegistration(manager *InstrumentationManager, callExpr *dst.CallExpr, app dst.Expr) bool {
+	funcName := GetNetHttpMethod(callExpr, manager.GetDecoratorPackage())
+	if (funcName != HttpHandleFunc && funcName != HttpMuxHandle) || len(callExpr.Args) != 2 {
+		return false
+	}
+
+	pattern, handler := callExpr.Args[0], callExpr.Args[1]
+	// the handler gets the response writer of its transaction from its wrapper, or from the one of the mux it is
+	// routed by when the mux is served through middleware
+	manager.addWrappedHandler(handler)
+	if isWrappedHandler(handler) || isMiddlewareMuxRegistration(callExpr, manager) {
+		return false
+	}
+
+	route, usePattern := httpRouteName(pattern, manager.GetDecoratorPackage())
+	manager.AddImport(newrelicAgentImport)
+	if usePattern {
+		// Instrument handle funcs, and handlers with the wrapper that matches their type
+		wrapper := "WrapHandleFunc"
+		if funcName == HttpMuxHandle {
+			wrapper = "WrapHandle"
+		}
+		callExpr.Args = []dst.Expr{
+			&dst.CallExpr{
+				Fun: &dst.Ident{
+					Name: wrapper,
+					Path: newrelicAgentImport,
+				},
+				Args: []dst.Expr{
+					app,
+					pattern,
+					handler,
+				},
+			},
+		}
+		return true
+	}
+
+	// the pattern is kept for routing, and the transaction is named by a helper
+	helper := wrapHandleFuncHelper
+	if funcName == HttpMuxHandle {
+		helper = wrapHandleHelper
+		manager.AddHelper(helper, parseHelperDecls(wrapHandleSource)...)
+	} else {
+		manager.AddHelper(helper, parseHelperDecls(wrapHandleFuncSource)...)
+	}
+	callExpr.Args = []dst.Expr{
+		pattern,
+		&dst.CallExpr{
+			Fun: dst.NewIdent(helper),
+			Args: []dst.Expr{
+				app,
+				&dst.BasicLit{
+					Kind:  token.STRING,
+					Value: strconv.Quote(route),
+				},
+				handler,
+			},
+		},
+	}
+	return true
+}
+
 // WrapHandleFunc looks for an instance of http.HandleFunc() and wraps it with a new relic transaction
 func WrapHandleFunc(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
 	callExpr, ok := n.(*dst.CallExpr)
 	if ok {
-		funcName := GetNetHttpMethod(callExpr, manager.GetDecoratorPackage())
-		switch funcName {
-		case HttpHandleFunc, HttpMuxHandle:
-			if len(callExpr.Args) == 2 {
-				// Instrument handle funcs
-				oldArgs := callExpr.Args
-				callExpr.Args = []dst.Expr{
-					&dst.CallExpr{
-						Fun: &dst.Ident{
-							Name: "WrapHandleFunc",
-							Path: newrelicAgentImport,
-						},
-						Args: []dst.Expr{
-							&dst.Ident{
-								Name: manager.agentVariableName,
-							},
-							oldArgs[0],
-							oldArgs[1],
-						},
-					},
-				}
-			}
-		}
+		wrapHandlerRegistration(manager, callExpr, dst.NewIdent(manager.agentVariableName))
 	}
 }
 
-func txnFromContext(txnVariable string) *dst.AssignStmt {
+func txnFromContext(txnVariable, requestVariable string) *dst.AssignStmt {
 	return &dst.AssignStmt{
 		Decs: dst.AssignStmtDecorations{
 			NodeDecs: dst.NodeDecs{
@@ -162,7 +398,7 @@ func txnFromContext(txnVariable string) *dst.AssignStmt {
 					&dst.CallExpr{
 						Fun: &dst.SelectorExpr{
 							X: &dst.Ident{
-								Name: "r",
+								Name: requestVariable,
 							},
 							Sel: &dst.Ident{
 								Name: "Context",
@@ -176,65 +412,547 @@ func txnFromContext(txnVariable string) *dst.AssignStmt {
 }
 
 // txnFromCtx injects a line of code that extracts a transaction from the context into the body of a function
-func defineTxnFromCtx(fn *dst.FuncDecl, txnVariable string) {
+func defineTxnFromCtx(fn *dst.FuncDecl, txnVariable, requestVariable string) {
 	stmts := make([]dst.Stmt, len(fn.Body.List)+1)
-	stmts[0] = txnFromContext(txnVariable)
+	stmts[0] = txnFromContext(txnVariable, requestVariable)
 	for i, stmt := range fn.Body.List {
 		stmts[i+1] = stmt
 	}
 	fn.Body.List = stmts
 }
 
-func isHttpHandler(decl *dst.FuncDecl, pkg *decorator.Package) bool {
-	if pkg == nil {
+// httpHandlerParams returns the response writer and request parameters of a function type if it has the
+// parameters of an http handler. Parameter types are resolved with type information, so aliased imports of
+// net/http are recognized, and the parameters can be declared in any order.
+func httpHandlerParams(fnType *dst.FuncType, pkg *decorator.Package) (*dst.Field, *dst.Field) {
+	if fnType == nil || fnType.Params == nil || pkg == nil || pkg.TypesInfo == nil {
+		return nil, nil
+	}
+
+	params := fnType.Params.List
+	if len(params) != 2 || len(params[0].Names) > 1 || len(params[1].Names) > 1 {
+		return nil, nil
+	}
+
+	var rw, req *dst.Field
+	for _, param := range params {
+		astExpr, ok := pkg.Decorator.Ast.Nodes[param.Type].(ast.Expr)
+		if !ok {
+			continue
+		}
+		t := pkg.TypesInfo.TypeOf(astExpr)
+		if t == nil {
+			continue
+		}
+		switch t.String() {
+		case "net/http.ResponseWriter":
+			rw = param
+		case "*net/http.Request":
+			req = param
+		}
+	}
+	if rw == nil || req == nil {
+		return nil, nil
+	}
+	return rw, req
+}
+
+// isHttpHandler returns true if a function declaration has the parameters of an http handler, along with the
+// identifier of its request parameter. The identifier is nil when the request parameter is unnamed.
+func isHttpHandler(decl *dst.FuncDecl, pkg *decorator.Package) (*dst.Ident, bool) {
+	if decl == nil {
+		return nil, false
+	}
+	_, req := httpHandlerParams(decl.Type, pkg)
+	if req == nil {
+		return nil, false
+	}
+	if len(req.Names) == 0 {
+		return nil, true
+	}
+	return req.Names[0], true
+}
+
+// handlerRequestName returns the name of the request parameter of an http handler. If the request is unnamed or
+// blank, it is given a name so that the transaction can be retrieved from its context.
+func handlerRequestName(fnType *dst.FuncType, pkg *decorator.Package) string {
+	rw, req := httpHandlerParams(fnType, pkg)
+	if req == nil {
+		return defaultRequestName
+	}
+	if len(req.Names) == 1 && req.Names[0].Name != "_" {
+		return req.Names[0].Name
+	}
+
+	name := defaultRequestName
+	if len(rw.Names) == 1 && rw.Names[0].Name == name {
+		name = "req"
+	}
+	// go does not allow named and unnamed parameters to be mixed
+	if len(rw.Names) == 0 {
+		rw.Names = []*dst.Ident{dst.NewIdent(defaultResponseWriterName)}
+	}
+	req.Names = []*dst.Ident{dst.NewIdent(name)}
+	return name
+}
+
+// isHttpHandlerSignature returns true if a type is a function with the signature of an http handler: func(http.ResponseWriter, *http.Request)
+func isHttpHandlerSignature(t types.Type) bool {
+	if t == nil {
+		return false
+	}
+	sig, ok := t.Underlying().(*types.Signature)
+	if !ok || sig.Params().Len() != 2 || sig.Results().Len() != 0 {
+		return false
+	}
+	return sig.Params().At(0).Type().String() == "net/http.ResponseWriter" && sig.Params().At(1).Type().String() == "*net/http.Request"
+}
+
+// isHttpHandlerLit returns true if a function literal is an http handler, such as the handler returned by a handler factory:
+//
+//	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { ... })
+func isHttpHandlerLit(lit *dst.FuncLit, pkg *decorator.Package) bool {
+	if lit == nil || pkg == nil || pkg.TypesInfo == nil {
+		return false
+	}
+	astLit, ok := pkg.Decorator.Ast.Nodes[lit].(*ast.FuncLit)
+	if !ok {
+		return false
+	}
+	return isHttpHandlerSignature(pkg.TypesInfo.TypeOf(astLit))
+}
+
+// netHttpHandlerInterface returns the net/http.Handler interface if the package imports net/http.
+func netHttpHandlerInterface(pkg *decorator.Package) *types.Interface {
+	if pkg == nil || pkg.Types == nil {
+		return nil
+	}
+	for _, imp := range pkg.Types.Imports() {
+		if imp.Path() != NetHttp {
+			continue
+		}
+		obj := imp.Scope().Lookup(HttpHandlerType)
+		if obj == nil {
+			return nil
+		}
+		iface, _ := obj.Type().Underlying().(*types.Interface)
+		return iface
+	}
+	return nil
+}
+
+// isServeHTTPMethod returns true if a function declaration is the ServeHTTP method of a type that implements http.Handler.
+func isServeHTTPMethod(decl *dst.FuncDecl, pkg *decorator.Package) bool {
+	if decl == nil || decl.Recv == nil || decl.Name.Name != HttpServeHTTP || pkg == nil || pkg.TypesInfo == nil {
 		return false
 	}
+	handler := netHttpHandlerInterface(pkg)
+	if handler == nil {
+		return false
+	}
+	astDecl, ok := pkg.Decorator.Ast.Nodes[decl].(*ast.FuncDecl)
+	if !ok {
+		return false
+	}
+	fn, ok := pkg.TypesInfo.Defs[astDecl.Name].(*types.Func)
+	if !ok {
+		return false
+	}
+	recv := fn.Type().(*types.Signature).Recv()
+	return recv != nil && types.Implements(recv.Type(), handler)
+}
+
+// handlerTypeName returns the name of the type of a handler expression if it is a type that implements http.Handler
+// through its own ServeHTTP method. Handlers from net/http, such as *http.ServeMux, are not included.
+func handlerTypeName(handler dst.Expr, pkg *decorator.Package) (string, bool) {
+	iface := netHttpHandlerInterface(pkg)
+	if iface == nil || pkg.TypesInfo == nil {
+		return "", false
+	}
+	astExpr, ok := pkg.Decorator.Ast.Nodes[handler].(ast.Expr)
+	if !ok {
+		return "", false
+	}
+	t := pkg.TypesInfo.TypeOf(astExpr)
+	if t == nil || !types.Implements(t, iface) {
+		return "", false
+	}
+	if ptr, ok := t.(*types.Pointer); ok {
+		t = ptr.Elem()
+	}
+	named, ok := t.(*types.Named)
+	if !ok || named.Obj().Pkg() == nil || named.Obj().Pkg().Path() == NetHttp {
+		return "", false
+	}
+	return named.Obj().Name(), true
+}
+
+// isHttpServerLit returns true if a composite literal creates an http.Server
+func isHttpServerLit(lit *dst.CompositeLit, pkg *decorator.Package) bool {
+	if pkg == nil || pkg.TypesInfo == nil {
+		return false
+	}
+	astLit, ok := pkg.Decorator.Ast.Nodes[lit].(*ast.CompositeLit)
+	if !ok {
+		return false
+	}
+	t := pkg.TypesInfo.TypeOf(astLit)
+	return t != nil && t.String() == HttpServerType
+}
+
+// isWrappedHandler returns true if a handler has already been wrapped by one of the transaction naming helpers.
+func isWrappedHandler(handler dst.Expr) bool {
+	wrapped, ok := handler.(*dst.CallExpr)
+	if !ok {
+		return false
+	}
+	fun, ok := wrapped.Fun.(*dst.Ident)
+	return ok && (fun.Name == wrapHandleFuncHelper || fun.Name == wrapHandleHelper || fun.Name == wrapServerHandlerHelper)
+}
+
+// isServeMux returns true if an expression is an *http.ServeMux
+func isServeMux(expr dst.Expr, pkg *decorator.Package) bool {
+	if pkg == nil || pkg.TypesInfo == nil {
+		return false
+	}
+	astExpr, ok := pkg.Decorator.Ast.Nodes[expr].(ast.Expr)
+	if !ok {
+		return false
+	}
+	t := pkg.TypesInfo.TypeOf(astExpr)
+	return t != nil && t.String() == HttpServeMuxType
+}
+
+// serverHandler returns the handler served by an http.Server composite literal, or a call to http.ListenAndServe(),
+// as a pointer so that it can be replaced.
+func serverHandler(n dst.Node, pkg *decorator.Package) *dst.Expr {
+	switch v := n.(type) {
+	case *dst.CompositeLit:
+		if !isHttpServerLit(v, pkg) {
+			return nil
+		}
+		for _, elt := range v.Elts {
+			kv, ok := elt.(*dst.KeyValueExpr)
+			if !ok {
+				continue
+			}
+			if key, ok := kv.Key.(*dst.Ident); ok && key.Name == HttpServerField {
+				return &kv.Value
+			}
+		}
+	case *dst.CallExpr:
+		ident, ok := v.Fun.(*dst.Ident)
+		if !ok || ident.Path != NetHttp || len(v.Args) == 0 {
+			return nil
+		}
+		if ident.Name == HttpListenAndServe || ident.Name == HttpListenAndServeTLS {
+			return &v.Args[len(v.Args)-1]
+		}
+	}
+	return nil
+}
+
+// handlerArg returns the argument of a call that is an http.Handler, such as the next handler passed to a middleware.
+func handlerArg(call *dst.CallExpr, pkg *decorator.Package) dst.Expr {
+	iface := netHttpHandlerInterface(pkg)
+	if iface == nil || pkg.TypesInfo == nil {
+		return nil
+	}
+	for _, arg := range call.Args {
+		astArg, ok := pkg.Decorator.Ast.Nodes[arg].(ast.Expr)
+		if !ok {
+			continue
+		}
+		if t := pkg.TypesInfo.TypeOf(astArg); t != nil && types.Implements(t, iface) {
+			return arg
+		}
+	}
+	return nil
+}
+
+// middlewareChain follows a chain of middleware, ex: tracing(id)(logging(logger)(router)), and returns the names
+// of the middleware functions called along with the innermost handler.
+func middlewareChain(handler dst.Expr, pkg *decorator.Package) ([]string, dst.Expr) {
+	middleware := []string{}
+	for {
+		call, ok := handler.(*dst.CallExpr)
+		if !ok {
+			return middleware, handler
+		}
+		next := handlerArg(call, pkg)
+		if next == nil {
+			return middleware, handler
+		}
+
+		fun := call.Fun
+		for {
+			inner, ok := fun.(*dst.CallExpr)
+			if !ok {
+				break
+			}
+			fun = inner.Fun
+		}
+		if ident, ok := fun.(*dst.Ident); ok && ident.Path == "" {
+			middleware = append(middleware, ident.Name)
+		}
+		handler = next
+	}
+}
+
+// middlewareMux returns the mux at the end of a middleware chain, if the handler passed is one.
+func middlewareMux(handler dst.Expr, pkg *decorator.Package) *dst.Ident {
+	if _, ok := handler.(*dst.CallExpr); !ok {
+		return nil
+	}
+	_, inner := middlewareChain(handler, pkg)
+	ident, ok := inner.(*dst.Ident)
+	if ok && isServeMux(ident, pkg) {
+		return ident
+	}
+	return nil
+}
+
+// identObject returns the object an identifier refers to, including identifiers qualified by their package
+func identObject(ident *dst.Ident, pkg *decorator.Package) types.Object {
+	if pkg == nil || pkg.TypesInfo == nil {
+		return nil
+	}
+	switch v := pkg.Decorator.Ast.Nodes[ident].(type) {
+	case *ast.Ident:
+		return pkg.TypesInfo.ObjectOf(v)
+	case *ast.SelectorExpr:
+		return pkg.TypesInfo.ObjectOf(v.Sel)
+	}
+	return nil
+}
+
+// FindMiddlewareMuxes records the muxes that are served through middleware by the function passed. Transactions for these
+// muxes are started by the middleware wrapper, so the routes registered on them are not wrapped.
+func FindMiddlewareMuxes(fn *dst.FuncDecl, manager *InstrumentationManager) {
+	pkg := manager.GetDecoratorPackage()
+	dst.Inspect(fn, func(n dst.Node) bool {
+		handler := serverHandler(n, pkg)
+		if handler == nil {
+			return true
+		}
+		if mux := middlewareMux(*handler, pkg); mux != nil {
+			manager.AddMiddlewareMux(identObject(mux, pkg))
+		}
+		return true
+	})
+}
+
+// isMiddlewareMuxRegistration returns true if a call registers a route on a mux that is served through middleware.
+func isMiddlewareMuxRegistration(call *dst.CallExpr, manager *InstrumentationManager) bool {
+	sel, ok := call.Fun.(*dst.SelectorExpr)
+	if !ok {
+		return false
+	}
+	ident, ok := sel.X.(*dst.Ident)
+	return ok && manager.IsMiddlewareMux(identObject(ident, manager.GetDecoratorPackage()))
+}
+
+// middlewareSegment creates a statement that records the execution of a middleware as a segment:
+//
+//	defer newrelic.FromContext(r.Context()).StartSegment("logging").End()
+func middlewareSegment(name, requestVariable string) *dst.DeferStmt {
+	return &dst.DeferStmt{
+		Decs: dst.DeferStmtDecorations{
+			NodeDecs: dst.NodeDecs{
+				After: dst.EmptyLine,
+			},
+		},
+		Call: &dst.CallExpr{
+			Fun: &dst.SelectorExpr{
+				X: &dst.CallExpr{
+					Fun: &dst.SelectorExpr{
+						X: &dst.CallExpr{
+							Fun: &dst.Ident{
+								Name: "FromContext",
+								Path: newrelicAgentImport,
+							},
+							Args: []dst.Expr{
+								&dst.CallExpr{
+									Fun: &dst.SelectorExpr{
+										X:   dst.NewIdent(requestVariable),
+										Sel: dst.NewIdent("Context"),
+									},
+								},
+							},
+						},
+						Sel: dst.NewIdent("StartSegment"),
+					},
+					Args: []dst.Expr{
+						&dst.BasicLit{
+							Kind:  token.STRING,
+							Value: strconv.Quote(name),
+						},
+					},
+				},
+				Sel: dst.NewIdent("End"),
+			},
+		},
+	}
+}
+
+// hasMiddlewareSegment returns true if a middleware segment has already been added to the body of a handler
+func hasMiddlewareSegment(body *dst.BlockStmt) bool {
+	for _, stmt := range body.List {
+		deferStmt, ok := stmt.(*dst.DeferStmt)
+		if !ok {
+			continue
+		}
+		if sel, ok := deferStmt.Call.Fun.(*dst.SelectorExpr); ok && sel.Sel.Name == "End" {
+			if call, ok := sel.X.(*dst.CallExpr); ok && isNewRelicMethod(call) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// instrumentMiddleware adds a segment to the handlers returned by each middleware function in a chain, so that the time
+// spent in the middleware is recorded in the transaction.
+func instrumentMiddleware(manager *InstrumentationManager, middleware []string) {
+	pkg := manager.GetDecoratorPackage()
+	for _, name := range middleware {
+		decl := manager.GetDeclaration(name)
+		if decl == nil {
+			continue
+		}
+		dst.Inspect(decl.Body, func(n dst.Node) bool {
+			lit, ok := n.(*dst.FuncLit)
+			if !ok || !isHttpHandlerLit(lit, pkg) {
+				return true
+			}
+			if !hasMiddlewareSegment(lit.Body) {
+				lit.Body.List = append([]dst.Stmt{middlewareSegment(name, handlerRequestName(lit.Type, pkg))}, lit.Body.List...)
+				manager.AddImport(newrelicAgentImport)
+			}
+			return false
+		})
+	}
+}
+
+// serverHandlerName names the transactions of a server handler after the expression it is served by.
+func serverHandlerName(handler dst.Expr) string {
+	switch v := handler.(type) {
+	case *dst.Ident:
+		return v.Name
+	case *dst.SelectorExpr:
+		if name := selectorName(v); name != "" {
+			return name
+		}
+	}
+	return HttpServeHTTP
+}
+
+// wrapServerHandler wraps the handler served by an http.Server, or http.ListenAndServe(), so that every request gets a transaction.
+// Handlers that are a type implementing http.Handler get a transaction named after the type, and middleware chains
+// are wrapped by a middleware that starts a transaction. Muxes are not wrapped, since their routes are. It returns true if
+// the handler was modified.
+func wrapServerHandler(manager *InstrumentationManager, n dst.Node, app dst.Expr) bool {
+	pkg := manager.GetDecoratorPackage()
+	handler := serverHandler(n, pkg)
+	if handler == nil || isWrappedHandler(*handler) || isServeMux(*handler, pkg) {
+		return false
+	}
+	if ident, ok := (*handler).(*dst.Ident); ok && ident.Name == "nil" {
+		return false
+	}
+
+	manager.AddImport(newrelicAgentImport)
+	if name, ok := handlerTypeName(*handler, pkg); ok {
+		manager.addWrappedHandler(*handler)
+		manager.AddHelper(wrapHandleHelper, parseHelperDecls(wrapHandleSource)...)
+		*handler = &dst.CallExpr{
+			Fun: dst.NewIdent(wrapHandleHelper),
+			Args: []dst.Expr{
+				app,
+				&dst.BasicLit{
+					Kind:  token.STRING,
+					Value: strconv.Quote(name),
+				},
+				*handler,
+			},
+		}
+		return true
+	}
+
+	middleware, inner := middlewareChain(*handler, pkg)
+	instrumentMiddleware(manager, middleware)
+	manager.addWrappedHandler(inner)
+
+	name, ok := handlerTypeName(inner, pkg)
+	if !ok {
+		name = serverHandlerName(inner)
+	}
+	var mux dst.Expr = dst.NewIdent("nil")
+	if isServeMux(inner, pkg) {
+		mux = dst.Clone(inner).(dst.Expr)
+	}
+
+	manager.AddHelper(wrapServerHandlerHelper, parseHelperDecls(wrapServerHandlerSource)...)
+	*handler = &dst.CallExpr{
+		Fun: dst.NewIdent(wrapServerHandlerHelper),
+		Args: []dst.Expr{
+			app,
+			&dst.BasicLit{
+				Kind:  token.STRING,
+				Value: strconv.Quote(name),
+			},
+			mux,
+			*handler,
+		},
+	}
+	return true
+}
 
-	params := decl.Type.Params.List
-	if len(params) == 2 {
-		var rw, req bool
-		for _, param := range params {
-			ident, ok := param.Type.(*dst.Ident)
-			star, okStar := param.Type.(*dst.StarExpr)
-			if ok {
-				astNode := pkg.Decorator.Ast.Nodes[ident]
-				astIdent, ok := astNode.(*ast.SelectorExpr)
-				if ok && pkg.TypesInfo != nil {
-					paramType := pkg.TypesInfo.Types[astIdent]
-					t := paramType.Type.String()
-					if t == "net/http.ResponseWriter" {
-						rw = true
-					}
-				}
-			} else if okStar {
-				astNode := pkg.Decorator.Ast.Nodes[star]
-				astStar, ok := astNode.(*ast.StarExpr)
-				if ok && pkg.TypesInfo != nil {
-					paramType := pkg.TypesInfo.Types[astStar]
-					t := paramType.Type.String()
-					if t == "*net/http.Request" {
-						req = true
-					}
-				}
-			}
-		}
-		return rw && req
-	}
-	return false
+// WrapServerHandler looks for http.Server literals and calls to http.ListenAndServe(), and wraps the handlers they serve with
+// a new relic transaction
+func WrapServerHandler(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
+	wrapServerHandler(manager, n, dst.NewIdent(manager.agentVariableName))
 }
 
 // Recognize if a function is a handler func based on its contents, and inject instrumentation.
 // This function discovers entrypoints to tracing for a given transaction and should trace all the way
 // down the call chain of the function it is invoked on.
 func InstrumentHandleFunction(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
-	fn, isFn := n.(*dst.FuncDecl)
-	if isFn && isHttpHandler(fn, manager.GetDecoratorPackage()) {
-		txnName := "nrTxn"
-		newFn, ok := TraceFunction(manager, fn, txnName)
-		if ok {
-			defineTxnFromCtx(newFn, txnName)
-			c.Replace(newFn)
-			manager.UpdateFunctionDeclaration(newFn)
+	txnName := defaultTxnName
+	switch v := n.(type) {
+	case *dst.FuncDecl:
+		pkg := manager.GetDecoratorPackage()
+		req, isHandler := isHttpHandler(v, pkg)
+		if isHandler || isServeHTTPMethod(v, pkg) {
+			manager.AddHandlerRequest(handlerRequestObject(v.Type, pkg))
+			obj := identObject(v.Name, pkg)
+			newFn, ok := TraceFunction(manager, v, txnName)
+			if ok {
+				reqName := ""
+				if req != nil {
+					reqName = req.Name
+				}
+				if reqName == "" || reqName == "_" {
+					reqName = handlerRequestName(newFn.Type, pkg)
+				}
+				defineTxnFromCtx(newFn, txnName, reqName)
+				c.Replace(newFn)
+				manager.UpdateFunctionDeclaration(newFn)
+			}
+			if w := writesHttpStatus(newFn.Body, pkg); w != "" {
+				manager.AddStatusHandler(statusHandler{decl: newFn, obj: obj, writer: w, txnDefined: ok})
+			}
+		}
+	case *dst.FuncLit:
+		if isHttpHandlerLit(v, manager.GetDecoratorPackage()) {
+			manager.AddHandlerRequest(handlerRequestObject(v.Type, manager.GetDecoratorPackage()))
+			newFn, ok := traceFuncLit(manager, v, txnName)
+			if ok {
+				defineTxnFromCtx(newFn, txnName, handlerRequestName(v.Type, manager.GetDecoratorPackage()))
+			}
+			if w := writesHttpStatus(newFn.Body, manager.GetDecoratorPackage()); w != "" {
+				manager.AddStatusHandler(statusHandler{decl: newFn, lit: v, writer: w, txnDefined: ok})
+			}
 		}
 	}
 }
@@ -287,14 +1005,127 @@ func isNetHttpClientDefinition(stmt *dst.AssignStmt) bool {
 	return false
 }
 
-// InstrumentHttpClient automatically injects a newrelic roundtripper into any newly created http client
-// looks for the following pattern: client := &http.Client{}
+// isNetHttpClientType returns true if an expression is an http.Client or a pointer to one, and whether it is a pointer
+func isNetHttpClientType(expr dst.Expr, pkg *decorator.Package) (bool, bool) {
+	if pkg == nil || pkg.TypesInfo == nil {
+		return false, false
+	}
+	astExpr, ok := pkg.Decorator.Ast.Nodes[expr].(ast.Expr)
+	if !ok {
+		return false, false
+	}
+	t := pkg.TypesInfo.TypeOf(astExpr)
+	if t == nil {
+		return false, false
+	}
+	switch t.String() {
+	case HttpClientType:
+		return true, true
+	case strings.TrimPrefix(HttpClientType, "*"):
+		return true, false
+	}
+	return false, false
+}
+
+// isNewRoundTripper returns true if an expression is a call to newrelic.NewRoundTripper()
+func isNewRoundTripper(expr dst.Expr) bool {
+	call, ok := expr.(*dst.CallExpr)
+	if !ok {
+		return false
+	}
+	ident, ok := call.Fun.(*dst.Ident)
+	return ok && ident.Name == "NewRoundTripper" && ident.Path == newrelicAgentImport
+}
+
+// wrapClientTransport wraps the Transport of an http.Client composite literal with a newrelic roundtripper, preserving
+// any custom transport that is already set. It returns true if the literal was modified.
+func wrapClientTransport(lit *dst.CompositeLit) bool {
+	for _, elt := range lit.Elts {
+		kv, ok := elt.(*dst.KeyValueExpr)
+		if !ok {
+			continue
+		}
+		if key, ok := kv.Key.(*dst.Ident); ok && key.Name == "Transport" && isNewRoundTripper(kv.Value) {
+			return false
+		}
+	}
+
+	wrapConfigLiteralTransport(lit, func(transport dst.Expr) dst.Expr {
+		return &dst.CallExpr{
+			Fun: &dst.Ident{
+				Name: "NewRoundTripper",
+				Path: newrelicAgentImport,
+			},
+			Args: []dst.Expr{transport},
+		}
+	})
+	return true
+}
+
+// isLocalFunctionCall returns true if a call is to a function declared in the package being instrumented
+func isLocalFunctionCall(call *dst.CallExpr, manager *InstrumentationManager) bool {
+	ident, ok := call.Fun.(*dst.Ident)
+	return ok && ident.Path == "" && manager.GetDeclaration(ident.Name) != nil
+}
+
+// InstrumentHttpClient automatically injects a newrelic roundtripper into any newly created http client.
+// Clients defined with the following pattern get the roundtripper in a new statement: client := &http.Client{}
+// All other http.Client literals, such as package variables, struct fields and clients returned by constructors, get
+// it in their Transport field, and clients returned by functions from other packages get it after they are assigned.
 func InstrumentHttpClient(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
-	stmt, ok := n.(*dst.AssignStmt)
-	if ok && isNetHttpClientDefinition(stmt) && c.Index() >= 0 && n.Decorations() != nil {
-		c.InsertAfter(injectRoundTripper(stmt.Lhs[0], n.Decorations().After)) // add roundtripper to transports
-		stmt.Decs.After = dst.None
-		manager.AddImport(newrelicAgentImport)
+	pkg := manager.GetDecoratorPackage()
+	switch v := n.(type) {
+	case *dst.AssignStmt:
+		if isNetHttpClientDefinition(v) && c.Index() >= 0 && n.Decorations() != nil {
+			c.InsertAfter(injectRoundTripper(v.Lhs[0], n.Decorations().After)) // add roundtripper to transports
+			v.Decs.After = dst.None
+			manager.AddImport(newrelicAgentImport)
+			return
+		}
+		if len(v.Lhs) != 1 || len(v.Rhs) != 1 || c.Index() < 0 {
+			return
+		}
+		call, ok := v.Rhs[0].(*dst.CallExpr)
+		if !ok || isLocalFunctionCall(call, manager) {
+			return
+		}
+		if fun, ok := call.Fun.(*dst.Ident); ok && fun.Name == instrumentClientHelper {
+			return
+		}
+		// clients returned by other packages may be shared, so a copy of them is instrumented
+		if isClient, isPointer := isNetHttpClientType(call, pkg); isClient && isPointer {
+			v.Rhs[0] = &dst.CallExpr{
+				Fun:  dst.NewIdent(instrumentClientHelper),
+				Args: []dst.Expr{call},
+			}
+			manager.AddImport(newrelicAgentImport)
+			manager.AddHelper(instrumentClientHelper, parseHelperDecls(instrumentClientSource)...)
+		}
+	case *dst.UnaryExpr:
+		lit, ok := v.X.(*dst.CompositeLit)
+		if !ok || v.Op != token.AND {
+			return
+		}
+		if isClient, _ := isNetHttpClientType(lit, pkg); !isClient {
+			return
+		}
+		// client := &http.Client{} is instrumented by the assignment
+		if stmt, ok := c.Parent().(*dst.AssignStmt); ok && isNetHttpClientDefinition(stmt) {
+			return
+		}
+		if wrapClientTransport(lit) {
+			manager.AddImport(newrelicAgentImport)
+		}
+	case *dst.CompositeLit:
+		if _, ok := c.Parent().(*dst.UnaryExpr); ok {
+			return
+		}
+		if isClient, _ := isNetHttpClientType(v, pkg); !isClient {
+			return
+		}
+		if wrapClientTransport(v) {
+			manager.AddImport(newrelicAgentImport)
+		}
 	}
 }
 
@@ -351,6 +1182,175 @@ func CannotInstrumentHttpMethod(n dst.Node, manager *InstrumentationManager, c *
 	}
 }
 
+// httpMethodHelpers are the helpers that replace net/http methods that can not be instrumented, by method name.
+// Each helper creates the same request as the method it replaces, and sends it through an instrumented copy of http.DefaultClient.
+var httpMethodHelpers = map[string]string{
+	HttpGet:      "nrHttpGet",
+	HttpPost:     "nrHttpPost",
+	HttpHead:     "nrHttpHead",
+	HttpPostForm: "nrHttpPostForm",
+}
+
+const httpDoHelper = "nrHttpDo"
+
+// httpMethodHelperSources contains the source code of the helpers in httpMethodHelpers, and the helper they depend on.
+var httpMethodHelperSources = map[string]string{
+	httpDoHelper: `package helper
+
+import (
+	"net/http"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// nrHttpDo sends req with http.DefaultClient, recording it as an external segment of txn.
+func nrHttpDo(txn *newrelic.Transaction, req *http.Request) (*http.Response, error) {
+	client := *http.DefaultClient
+	client.Transport = newrelic.NewRoundTripper(client.Transport)
+	return client.Do(newrelic.RequestWithTransactionContext(req, txn))
+}
+`,
+	"nrHttpGet": `package helper
+
+import (
+	"net/http"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// nrHttpGet issues a GET to the specified URL like http.Get, recording it as an external segment of txn.
+func nrHttpGet(txn *newrelic.Transaction, url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return nrHttpDo(txn, req)
+}
+`,
+	"nrHttpHead": `package helper
+
+import (
+	"net/http"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// nrHttpHead issues a HEAD to the specified URL like http.Head, recording it as an external segment of txn.
+func nrHttpHead(txn *newrelic.Transaction, url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return nrHttpDo(txn, req)
+}
+`,
+	"nrHttpPost": `package helper
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// nrHttpPost issues a POST to the specified URL like http.Post, recording it as an external segment of txn.
+func nrHttpPost(txn *newrelic.Transaction, url, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return nrHttpDo(txn, req)
+}
+`,
+	"nrHttpPostForm": `package helper
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// nrHttpPostForm issues a POST to the specified URL like http.PostForm, with data's keys and values URL-encoded
+// as the request body, recording it as an external segment of txn.
+func nrHttpPostForm(txn *newrelic.Transaction, url string, data url.Values) (*http.Response, error) {
+	return nrHttpPost(txn, url, "application/x-www-form-urlencoded", strings.NewReader(data.Encode()))
+}
+`,
+}
+
+// removeCannotTraceComment removes the comment left by CannotInstrumentHttpMethod from a statement.
+func removeCannotTraceComment(method string, decs *dst.NodeDecs) {
+	comment := map[string]bool{}
+	for _, line := range cannotTraceOutboundHttp(method, nil) {
+		comment[line] = true
+	}
+
+	start := decs.Start.All()
+	if len(start) == 0 || !comment[start[0]] {
+		return
+	}
+	i := 0
+	for i < len(start) && comment[start[i]] {
+		i++
+	}
+	// a separator is added between the comment and existing comments
+	if i < len(start) && start[i] == "//" {
+		i++
+	}
+	decs.Start.Replace(start[i:]...)
+}
+
+// RewriteHttpMethodCall replaces calls to the net/http methods http.Get, http.Post, http.Head and http.PostForm in traced
+// functions with helpers that send the same request through an instrumented client, so that they are recorded as external
+// segments and carry distributed tracing headers. This transformation is opt-in, and changes nothing unless it is enabled.
+func RewriteHttpMethodCall(manager *InstrumentationManager, stmt dst.Stmt, c *dstutil.Cursor, txnName string) bool {
+	if !manager.rewriteHttpMethods {
+		return false
+	}
+	method, ok := isNetHttpMethodCannotInstrument(stmt)
+	if !ok {
+		return false
+	}
+
+	wasModified := false
+	dst.Inspect(stmt, func(n dst.Node) bool {
+		switch v := n.(type) {
+		case *dst.FuncLit:
+			return false
+		case *dst.CallExpr:
+			ident, ok := v.Fun.(*dst.Ident)
+			if !ok || ident.Path != NetHttp {
+				return true
+			}
+			helper, ok := httpMethodHelpers[ident.Name]
+			if !ok {
+				return true
+			}
+
+			manager.AddHelper(httpDoHelper, parseHelperDecls(httpMethodHelperSources[httpDoHelper])...)
+			if ident.Name == HttpPostForm {
+				manager.AddHelper(httpMethodHelpers[HttpPost], parseHelperDecls(httpMethodHelperSources[httpMethodHelpers[HttpPost]])...)
+			}
+			manager.AddHelper(helper, parseHelperDecls(httpMethodHelperSources[helper])...)
+			manager.AddImport(newrelicAgentImport)
+
+			v.Fun = dst.NewIdent(helper)
+			v.Args = append([]dst.Expr{dst.NewIdent(txnName)}, v.Args...)
+			wasModified = true
+			return false
+		}
+		return true
+	})
+
+	if wasModified {
+		removeCannotTraceComment(method, stmt.Decorations())
+	}
+	return wasModified
+}
+
 func startExternalSegment(request dst.Expr, txnVar, segmentVar string, nodeDecs *dst.NodeDecs) *dst.AssignStmt {
 	// copy all preceeding decorations from the previous node
 	decs := dst.AssignStmtDecorations{}
@@ -482,6 +1482,120 @@ func getHttpResponseVariable(manager *InstrumentationManager, stmt dst.Stmt) dst
 	return expression
 }
 
+// precedingStmts returns the statements that come before the current statement in the block it belongs to.
+func precedingStmts(c *dstutil.Cursor) []dst.Stmt {
+	if c.Index() < 0 {
+		return nil
+	}
+	var stmts []dst.Stmt
+	switch v := c.Parent().(type) {
+	case *dst.BlockStmt:
+		stmts = v.List
+	case *dst.CaseClause:
+		stmts = v.Body
+	case *dst.CommClause:
+		stmts = v.Body
+	}
+	if c.Index() > len(stmts) {
+		return nil
+	}
+	return stmts[:c.Index()]
+}
+
+// requestConstruction follows a request variable back to the call it was last assigned from in the enclosing block.
+func requestConstruction(request dst.Expr, c *dstutil.Cursor) *dst.CallExpr {
+	ident, ok := request.(*dst.Ident)
+	if !ok {
+		return nil
+	}
+	stmts := precedingStmts(c)
+	for i := len(stmts) - 1; i >= 0; i-- {
+		assign, ok := stmts[i].(*dst.AssignStmt)
+		if !ok || len(assign.Rhs) != 1 {
+			continue
+		}
+		if lhs, ok := assign.Lhs[0].(*dst.Ident); ok && lhs.Name == ident.Name {
+			call, _ := assign.Rhs[0].(*dst.CallExpr)
+			return call
+		}
+	}
+	return nil
+}
+
+// isHandlerRequestContext returns true if an expression gets the context of the request served by a handler
+// instrumented by InstrumentHandleFunction: r.Context(). The handler gets its transaction from that context, so it
+// already carries it. The context of other requests does not.
+func isHandlerRequestContext(ctx dst.Expr, manager *InstrumentationManager) bool {
+	call, ok := ctx.(*dst.CallExpr)
+	if !ok || len(call.Args) != 0 {
+		return false
+	}
+	sel, ok := call.Fun.(*dst.SelectorExpr)
+	if !ok || sel.Sel.Name != "Context" {
+		return false
+	}
+	ident, ok := sel.X.(*dst.Ident)
+	if !ok {
+		return false
+	}
+	pkg := manager.GetDecoratorPackage()
+	if pkg == nil || pkg.TypesInfo == nil {
+		return false
+	}
+	astIdent, ok := pkg.Decorator.Ast.Nodes[ident].(*ast.Ident)
+	if !ok {
+		return false
+	}
+	return manager.IsHandlerRequest(pkg.TypesInfo.Uses[astIdent])
+}
+
+// handlerRequestObject returns the object of the request parameter of an http handler, if it is named.
+func handlerRequestObject(fnType *dst.FuncType, pkg *decorator.Package) types.Object {
+	_, req := httpHandlerParams(fnType, pkg)
+	if req == nil || len(req.Names) != 1 {
+		return nil
+	}
+	astIdent, ok := pkg.Decorator.Ast.Nodes[req.Names[0]].(*ast.Ident)
+	if !ok {
+		return nil
+	}
+	return pkg.TypesInfo.Defs[astIdent]
+}
+
+// addTxnToRequestConstruction passes the transaction to a request through the context it is created with. The first
+// bool returned is true if the request carries the transaction, and the second is true if the construction was modified
+// to add it. Requests created with the context of the request an instrumented handler serves, or that already have a
+// transaction, are not modified.
+func addTxnToRequestConstruction(construction *dst.CallExpr, txnName string, manager *InstrumentationManager) (bool, bool) {
+	if construction == nil {
+		return false, false
+	}
+	fun, ok := construction.Fun.(*dst.Ident)
+	if !ok || fun.Path == "" {
+		return false, false
+	}
+
+	// req = newrelic.RequestWithTransactionContext(req, txn)
+	if fun.Path == newrelicAgentImport && fun.Name == "RequestWithTransactionContext" {
+		return true, false
+	}
+	if fun.Path != NetHttp || fun.Name != HttpNewRequestWithContext || len(construction.Args) == 0 {
+		return false, false
+	}
+
+	ctx := construction.Args[0]
+	if call, ok := ctx.(*dst.CallExpr); ok {
+		if ident, ok := call.Fun.(*dst.Ident); ok && ident.Path == newrelicAgentImport && ident.Name == "NewContext" {
+			return true, false
+		}
+	}
+	if isHandlerRequestContext(ctx, manager) {
+		return true, false
+	}
+	construction.Args[0] = txnContext(ctx, txnName)
+	return true, true
+}
+
 // ExternalHttpCall finds and instruments external net/http calls to the method http.Do.
 // It returns a modified function body, and the number of lines that were added.
 func ExternalHttpCall(manager *InstrumentationManager, stmt dst.Stmt, c *dstutil.Cursor, txnName string) bool {
@@ -515,6 +1629,13 @@ func ExternalHttpCall(manager *InstrumentationManager, stmt dst.Stmt, c *dstutil
 			}
 			return true
 		} else {
+			// requests created with a context get the transaction from it
+			if carriesTxn, modified := addTxnToRequestConstruction(requestConstruction(requestObject, c), txnName, manager); carriesTxn {
+				if modified {
+					manager.AddImport(newrelicAgentImport)
+				}
+				return modified
+			}
 			c.InsertBefore(addTxnToRequestContext(requestObject, txnName, stmt.Decorations()))
 			manager.AddImport(newrelicAgentImport)
 			return true
@@ -523,43 +1644,207 @@ func ExternalHttpCall(manager *InstrumentationManager, stmt dst.Stmt, c *dstutil
 	return false
 }
 
+// httpStatusWrite returns the status code and message written to a response by a statement that is a call to
+// http.Error(w, msg, code) or w.WriteHeader(code), along with the response writer. The message is nil for WriteHeader.
+func httpStatusWrite(stmt dst.Stmt, pkg *decorator.Package) (dst.Expr, dst.Expr, dst.Expr) {
+	exprStmt, ok := stmt.(*dst.ExprStmt)
+	if !ok || pkg == nil || pkg.TypesInfo == nil {
+		return nil, nil, nil
+	}
+	call, ok := exprStmt.X.(*dst.CallExpr)
+	if !ok {
+		return nil, nil, nil
+	}
+
+	switch fun := call.Fun.(type) {
+	case *dst.Ident:
+		if fun.Name == HttpError && fun.Path == NetHttp && len(call.Args) == 3 {
+			return call.Args[2], call.Args[1], call.Args[0]
+		}
+	case *dst.SelectorExpr:
+		if fun.Sel.Name != HttpWriteHeader || len(call.Args) != 1 {
+			return nil, nil, nil
+		}
+		astExpr, ok := pkg.Decorator.Ast.Nodes[fun.X].(ast.Expr)
+		if !ok {
+			return nil, nil, nil
+		}
+		if t := pkg.TypesInfo.TypeOf(astExpr); t != nil && t.String() == HttpResponseWriterType {
+			return call.Args[0], nil, fun.X
+		}
+	}
+	return nil, nil, nil
+}
+
+// writesHttpStatus returns the name of the response writer a function body writes status codes to, if it does.
+func writesHttpStatus(body *dst.BlockStmt, pkg *decorator.Package) string {
+	name := ""
+	dst.Inspect(body, func(n dst.Node) bool {
+		if _, ok := n.(*dst.FuncLit); ok {
+			return false
+		}
+		stmt, ok := n.(dst.Stmt)
+		if !ok || name != "" {
+			return name == ""
+		}
+		if _, _, w := httpStatusWrite(stmt, pkg); w != nil {
+			if ident, ok := w.(*dst.Ident); ok {
+				name = ident.Name
+			}
+		}
+		return true
+	})
+	return name
+}
+
+// useTxnResponseWriter replaces a handler's response writer with one from the transaction, so that the status codes
+// it writes are reported: w = nrTxn.SetWebResponse(w)
+func useTxnResponseWriter(fn *dst.FuncDecl, txnName, writerName string) {
+	setWebResponse := &dst.AssignStmt{
+		Lhs: []dst.Expr{dst.NewIdent(writerName)},
+		Tok: token.ASSIGN,
+		Rhs: []dst.Expr{
+			&dst.CallExpr{
+				Fun: &dst.SelectorExpr{
+					X:   dst.NewIdent(txnName),
+					Sel: dst.NewIdent("SetWebResponse"),
+				},
+				Args: []dst.Expr{dst.NewIdent(writerName)},
+			},
+		},
+		Decs: dst.AssignStmtDecorations{
+			NodeDecs: dst.NodeDecs{
+				After: dst.EmptyLine,
+			},
+		},
+	}
+
+	// the transaction is defined by the first statement in the handler
+	fn.Body.List[0].Decorations().After = dst.NewLine
+	fn.Body.List = append([]dst.Stmt{fn.Body.List[0], setWebResponse}, fn.Body.List[1:]...)
+}
+
+// statusHandler is an instrumented http handler that writes status codes to its response writer.
+type statusHandler struct {
+	decl       *dst.FuncDecl // the handler, or the declaration its literal is traced as
+	obj        types.Object  // the function or method of a declared handler
+	lit        *dst.FuncLit  // the handler literal
+	writer     string        // name of the response writer
+	txnDefined bool          // whether tracing the handler defined its transaction
+}
+
+// addWrappedHandler records a handler registered through a wrapper that gives it the response writer of its
+// transaction, such as newrelic.WrapHandle. Conversions and wrappers, ex: http.HandlerFunc(index), are followed to the
+// handler they wrap, and calls to functions of the package to the handler literals they return.
+func (m *InstrumentationManager) addWrappedHandler(handler dst.Expr) {
+	pkg := m.GetDecoratorPackage()
+	switch v := handler.(type) {
+	case *dst.FuncLit:
+		if m.wrappedHandlerLits == nil {
+			m.wrappedHandlerLits = map[*dst.FuncLit]bool{}
+		}
+		m.wrappedHandlerLits[v] = true
+		return
+	case *dst.CallExpr:
+		if fun, ok := v.Fun.(*dst.Ident); ok && fun.Path == "" {
+			if decl := m.GetDeclaration(fun.Name); decl != nil && decl.Recv == nil && decl.Body != nil {
+				dst.Inspect(decl.Body, func(n dst.Node) bool {
+					switch ret := n.(type) {
+					case *dst.FuncLit:
+						return false
+					case *dst.ReturnStmt:
+						for _, result := range ret.Results {
+							m.addWrappedHandler(result)
+						}
+					}
+					return true
+				})
+				return
+			}
+		}
+		if len(v.Args) > 0 {
+			m.addWrappedHandler(v.Args[len(v.Args)-1])
+		}
+		return
+	}
+	if pkg == nil || pkg.TypesInfo == nil {
+		return
+	}
+
+	var obj types.Object
+	switch v := handler.(type) {
+	case *dst.Ident:
+		obj = identObject(v, pkg)
+	case *dst.SelectorExpr:
+		obj = identObject(v.Sel, pkg)
+	}
+	if _, isFunc := obj.(*types.Func); !isFunc {
+		// handlers that are a value of a type implementing http.Handler are served by its ServeHTTP method
+		astExpr, ok := pkg.Decorator.Ast.Nodes[handler].(ast.Expr)
+		if !ok {
+			return
+		}
+		t := pkg.TypesInfo.TypeOf(astExpr)
+		if t == nil {
+			return
+		}
+		obj, _, _ = types.LookupFieldOrMethod(t, true, nil, HttpServeHTTP)
+		if _, isFunc := obj.(*types.Func); !isFunc {
+			return
+		}
+	}
+	if m.wrappedHandlers == nil {
+		m.wrappedHandlers = map[types.Object]bool{}
+	}
+	m.wrappedHandlers[obj] = true
+}
+
+// UseTxnResponseWriters replaces the response writer of the instrumented handlers that write status codes with the
+// one of their transaction, so that the codes are reported. Handlers registered through a wrapper already write to it,
+// and are not modified. Handlers that tracing did not define a transaction in get it from the context of their request.
+func (m *InstrumentationManager) UseTxnResponseWriters() {
+	pkgNames := make([]string, 0, len(m.packages))
+	for name := range m.packages {
+		pkgNames = append(pkgNames, name)
+	}
+	sort.Strings(pkgNames)
+
+	for _, pkgName := range pkgNames {
+		m.SetPackage(pkgName)
+		for _, handler := range m.packages[pkgName].statusHandlers {
+			if m.wrappedHandlerLits[handler.lit] || m.wrappedHandlers[handler.obj] {
+				continue
+			}
+			if !handler.txnDefined {
+				defineTxnFromCtx(handler.decl, defaultTxnName, handlerRequestName(handler.decl.Type, m.GetDecoratorPackage()))
+				m.AddImport(newrelicAgentImport)
+			}
+			useTxnResponseWriter(handler.decl, defaultTxnName, handler.writer)
+		}
+	}
+}
+
 // WrapHandleFunction is a function that wraps net/http.HandeFunc() declarations inside of functions
 // that are being traced by a transaction.
 func WrapNestedHandleFunction(manager *InstrumentationManager, stmt dst.Stmt, c *dstutil.Cursor, txnName string) bool {
 	wasModified := false
-	pkg := manager.GetDecoratorPackage()
 	dst.Inspect(stmt, func(n dst.Node) bool {
+		app := &dst.CallExpr{
+			Fun: &dst.SelectorExpr{
+				X:   dst.NewIdent(txnName),
+				Sel: dst.NewIdent("Application"),
+			},
+		}
 		switch v := n.(type) {
 		case *dst.CallExpr:
-			callExpr := v
-			funcName := GetNetHttpMethod(callExpr, pkg)
-			switch funcName {
-			case HttpHandleFunc, HttpMuxHandle:
-				if len(callExpr.Args) == 2 {
-					// Instrument handle funcs
-					oldArgs := callExpr.Args
-					callExpr.Args = []dst.Expr{
-						&dst.CallExpr{
-							Fun: &dst.Ident{
-								Name: "WrapHandleFunc",
-								Path: newrelicAgentImport,
-							},
-							Args: []dst.Expr{
-								&dst.CallExpr{
-									Fun: &dst.SelectorExpr{
-										X:   dst.NewIdent(txnName),
-										Sel: dst.NewIdent("Application"),
-									},
-								},
-								oldArgs[0],
-								oldArgs[1],
-							},
-						},
-					}
-					wasModified = true
-					manager.AddImport(newrelicAgentImport)
-					return false
-				}
+			if wrapHandlerRegistration(manager, v, app) || wrapServerHandler(manager, v, app) {
+				wasModified = true
+				return false
+			}
+		case *dst.CompositeLit:
+			if wrapServerHandler(manager, v, app) {
+				wasModified = true
+				return false
 			}
 		}
 		return true
@@ -3,9 +3,11 @@ package main
 import (
 	"go/token"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/dave/dst"
+	"github.com/dave/dst/dstutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -227,6 +229,7 @@ func Test_isHttpHandler(t *testing.T) {
 		name     string
 		code     string
 		wantBool bool
+		wantReq  string
 	}{
 		{
 			name: "http_get",
@@ -247,6 +250,49 @@ func index(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, "hello world")
 }`,
 			wantBool: true,
+			wantReq:  "r",
+		},
+		{
+			name: "renamed_request",
+			code: `
+package main
+import "net/http"
+func index(w http.ResponseWriter, req *http.Request) {
+	io.WriteString(w, "hello world")
+}`,
+			wantBool: true,
+			wantReq:  "req",
+		},
+		{
+			name: "aliased_import",
+			code: `
+package main
+import nethttp "net/http"
+func index(w nethttp.ResponseWriter, r *nethttp.Request) {
+	io.WriteString(w, "hello world")
+}`,
+			wantBool: true,
+			wantReq:  "r",
+		},
+		{
+			name: "unnamed_params",
+			code: `
+package main
+import "net/http"
+func index(http.ResponseWriter, *http.Request) {
+}`,
+			wantBool: true,
+		},
+		{
+			name: "blank_request",
+			code: `
+package main
+import "net/http"
+func index(w http.ResponseWriter, _ *http.Request) {
+	io.WriteString(w, "hello world")
+}`,
+			wantBool: true,
+			wantReq:  "_",
 		},
 		{
 			name: "overloaded_handler",
@@ -275,9 +321,16 @@ func index(w http.ResponseWriter, r *http.Request, x string) {
 				t.Fatal("code must contain only one function declaration")
 			}
 
-			gotBool := isHttpHandler(decl, pkgs[0])
+			gotReq, gotBool := isHttpHandler(decl, pkgs[0])
 			if gotBool != tt.wantBool {
-				t.Errorf("isNetHttpMethodCannotInstrument() = %v, want %v", gotBool, tt.wantBool)
+				t.Errorf("isHttpHandler() = %v, want %v", gotBool, tt.wantBool)
+			}
+			gotName := ""
+			if gotReq != nil {
+				gotName = gotReq.Name
+			}
+			if gotName != tt.wantReq {
+				t.Errorf("isHttpHandler() returned request %q, want %q", gotName, tt.wantReq)
 			}
 		})
 	}
@@ -867,8 +920,8 @@ func Test_defineTxnFromCtx(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			expectStmt := txnFromContext(tt.args.txnVariable)
-			defineTxnFromCtx(tt.args.fn, tt.args.txnVariable)
+			expectStmt := txnFromContext(tt.args.txnVariable, "r")
+			defineTxnFromCtx(tt.args.fn, tt.args.txnVariable, "r")
 			if !reflect.DeepEqual(tt.args.fn.Body.List[0], expectStmt) {
 				t.Errorf("expected the function body to contain the statement %v but got %v", expectStmt, tt.args.fn.Body.List[0])
 			}
@@ -978,3 +1031,971 @@ func main() {
 		})
 	}
 }
+
+func Test_httpRouteName(t *testing.T) {
+	tests := []struct {
+		name           string
+		code           string
+		wantName       string
+		wantUsePattern bool
+	}{
+		{
+			name: "literal_pattern",
+			code: `
+package main
+import "net/http"
+func main() {
+	http.HandleFunc("/items", index)
+}`,
+			wantName:       "/items",
+			wantUsePattern: true,
+		},
+		{
+			name: "method_and_wildcard_pattern",
+			code: `
+package main
+import "net/http"
+func main() {
+	http.HandleFunc("GET  /items/{id}", index)
+}`,
+			wantName:       "/items/{id}",
+			wantUsePattern: false,
+		},
+		{
+			name: "constant_pattern",
+			code: `
+package main
+import "net/http"
+const itemRoute = "POST /items"
+func main() {
+	http.HandleFunc(itemRoute, index)
+}`,
+			wantName:       "/items",
+			wantUsePattern: false,
+		},
+		{
+			name: "sprintf_pattern",
+			code: `
+package main
+import (
+	"fmt"
+	"net/http"
+)
+func main() {
+	http.HandleFunc(fmt.Sprintf("GET /%s/items/%d", version, 100), index)
+}`,
+			wantName:       "/*/items/*",
+			wantUsePattern: false,
+		},
+		{
+			name: "variable_pattern",
+			code: `
+package main
+import "net/http"
+func main() {
+	route := "/items"
+	http.HandleFunc(route, index)
+}`,
+			wantName:       "{route}",
+			wantUsePattern: false,
+		},
+		{
+			name: "concatenated_pattern",
+			code: `
+package main
+import "net/http"
+func main() {
+	http.HandleFunc(cfg.Prefix+"/items", index)
+}`,
+			wantName:       "{cfg.Prefix}/items",
+			wantUsePattern: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, tt.code)
+			pkg := manager.GetDecoratorPackage()
+
+			var pattern dst.Expr
+			dst.Inspect(pkg.Syntax[0], func(n dst.Node) bool {
+				call, ok := n.(*dst.CallExpr)
+				if ok && GetNetHttpMethod(call, pkg) == HttpHandleFunc {
+					pattern = call.Args[0]
+					return false
+				}
+				return true
+			})
+			if pattern == nil {
+				t.Fatal("code must contain a call to http.HandleFunc()")
+			}
+
+			gotName, gotUsePattern := httpRouteName(pattern, pkg)
+			if gotName != tt.wantName {
+				t.Errorf("httpRouteName() name = %q, want %q", gotName, tt.wantName)
+			}
+			if gotUsePattern != tt.wantUsePattern {
+				t.Errorf("httpRouteName() usePattern = %t, want %t", gotUsePattern, tt.wantUsePattern)
+			}
+		})
+	}
+}
+
+func Test_WrapHandleFunc(t *testing.T) {
+	tests := []struct {
+		name        string
+		code        string
+		wantContain string
+	}{
+		{
+			name: "wrap_literal_pattern",
+			code: `
+package main
+import "net/http"
+func main() {
+	http.HandleFunc("/", index)
+}
+func index(w http.ResponseWriter, r *http.Request) {}`,
+			wantContain: `http.HandleFunc(newrelic.WrapHandleFunc(NewRelicAgent, "/", index))`,
+		},
+		{
+			name: "wrap_method_pattern",
+			code: `
+package main
+import "net/http"
+func main() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /items/{id}", index)
+}
+func index(w http.ResponseWriter, r *http.Request) {}`,
+			wantContain: `mux.HandleFunc("GET /items/{id}", nrWrapHandleFunc(NewRelicAgent, "/items/{id}", index))`,
+		},
+		{
+			name: "wrap_handler_factory",
+			code: `
+package main
+import "net/http"
+func main() {
+	mux := http.NewServeMux()
+	mux.Handle("/", index())
+}
+func index() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+}`,
+			wantContain: `mux.Handle(newrelic.WrapHandle(NewRelicAgent, "/", index()))`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, tt.code)
+			pkg := manager.GetDecoratorPackage()
+			dst.Inspect(pkg.Syntax[0].Decls[1], func(n dst.Node) bool {
+				WrapHandleFunc(n, manager, nil)
+				return true
+			})
+			manager.writeHelpers()
+
+			got := restoreTestFile(t, pkg.Syntax[0])
+			if !strings.Contains(got, tt.wantContain) {
+				t.Errorf("expected instrumented code to contain %q, but got:\n%s", tt.wantContain, got)
+			}
+		})
+	}
+}
+
+func Test_InstrumentHandleFunctionLiteral(t *testing.T) {
+	tests := []struct {
+		name        string
+		code        string
+		wantContain []string
+	}{
+		{
+			name: "handler_factory",
+			code: `
+package main
+import (
+	"errors"
+	"net/http"
+)
+func index() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := errors.New("oops")
+		w.Write([]byte(err.Error()))
+	})
+}`,
+			wantContain: []string{
+				"nrTxn := newrelic.FromContext(r.Context())",
+				"nrTxn.NoticeError(err)",
+			},
+		},
+		{
+			name: "inline_literal",
+			code: `
+package main
+import (
+	"errors"
+	"net/http"
+)
+func main() {
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		err := errors.New("oops")
+		w.Write([]byte(err.Error()))
+	})
+}`,
+			wantContain: []string{
+				"nrTxn := newrelic.FromContext(r.Context())",
+				"nrTxn.NoticeError(err)",
+			},
+		},
+		{
+			name: "incoming_request_context",
+			code: `
+package main
+import "net/http"
+func main() {
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		client := &http.Client{}
+		req, _ := http.NewRequestWithContext(r.Context(), "GET", "https://example.com", nil)
+		client.Do(req)
+	})
+}`,
+			wantContain: []string{
+				"nrTxn := newrelic.FromContext(r.Context())",
+				`req, _ := http.NewRequestWithContext(r.Context(), "GET", "https://example.com", nil)`,
+			},
+		},
+		{
+			name: "blank_request",
+			code: `
+package main
+import (
+	"errors"
+	"net/http"
+)
+func index() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		err := errors.New("oops")
+		w.Write([]byte(err.Error()))
+	})
+}`,
+			wantContain: []string{
+				"func(w http.ResponseWriter, r *http.Request) {",
+				"nrTxn := newrelic.FromContext(r.Context())",
+			},
+		},
+		{
+			name: "unnamed_params",
+			code: `
+package main
+import (
+	"errors"
+	"net/http"
+)
+func main() {
+	http.HandleFunc("/", func(http.ResponseWriter, *http.Request) {
+		err := errors.New("oops")
+		println(err.Error())
+	})
+}`,
+			wantContain: []string{
+				"func(w http.ResponseWriter, r *http.Request) {",
+				"nrTxn := newrelic.FromContext(r.Context())",
+			},
+		},
+		{
+			name: "not_a_handler",
+			code: `
+package main
+import "errors"
+func main() {
+	f := func(s string) {
+		err := errors.New(s)
+		println(err.Error())
+	}
+	f("oops")
+}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, tt.code)
+			pkg := manager.GetDecoratorPackage()
+			dstutil.Apply(pkg.Syntax[0].Decls[1], nil, func(c *dstutil.Cursor) bool {
+				InstrumentHandleFunction(c.Node(), manager, c)
+				return true
+			})
+
+			got := restoreTestFile(t, pkg.Syntax[0])
+			if len(tt.wantContain) == 0 && strings.Contains(got, "nrTxn") {
+				t.Errorf("expected code not to be instrumented, but got:\n%s", got)
+			}
+			for _, want := range tt.wantContain {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected instrumented code to contain %q, but got:\n%s", want, got)
+				}
+			}
+		})
+	}
+}
+
+func Test_isServeHTTPMethod(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     string
+		wantBool bool
+	}{
+		{
+			name: "value_receiver",
+			code: `
+package main
+import "net/http"
+type handler struct{}
+func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {}`,
+			wantBool: true,
+		},
+		{
+			name: "pointer_receiver",
+			code: `
+package main
+import "net/http"
+type handler struct{}
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {}`,
+			wantBool: true,
+		},
+		{
+			name: "wrong_signature",
+			code: `
+package main
+import "net/http"
+type handler struct{}
+func (h handler) ServeHTTP(r *http.Request) {}`,
+			wantBool: false,
+		},
+		{
+			name: "other_method",
+			code: `
+package main
+import "net/http"
+type handler struct{}
+func (h handler) Index(w http.ResponseWriter, r *http.Request) {}`,
+			wantBool: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, tt.code)
+			pkg := manager.GetDecoratorPackage()
+			decl, ok := pkg.Syntax[0].Decls[2].(*dst.FuncDecl)
+			if !ok {
+				t.Fatal("code must declare a type followed by a method")
+			}
+			if got := isServeHTTPMethod(decl, pkg); got != tt.wantBool {
+				t.Errorf("isServeHTTPMethod() = %v, want %v", got, tt.wantBool)
+			}
+		})
+	}
+}
+
+func Test_WrapServerHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		code        string
+		wantContain []string
+	}{
+		{
+			name: "handler_type",
+			code: `
+package main
+import "net/http"
+func main() {
+	server := &http.Server{Addr: ":8080", Handler: &api{}}
+	server.ListenAndServe()
+}
+type api struct{}
+func (a *api) ServeHTTP(w http.ResponseWriter, r *http.Request) {}`,
+			wantContain: []string{`&http.Server{Addr: ":8080", Handler: nrWrapHandle(NewRelicAgent, "api", &api{})}`},
+		},
+		{
+			name: "serve_mux",
+			code: `
+package main
+import "net/http"
+func main() {
+	mux := http.NewServeMux()
+	server := &http.Server{Addr: ":8080", Handler: mux}
+	server.ListenAndServe()
+}`,
+			wantContain: []string{`&http.Server{Addr: ":8080", Handler: mux}`},
+		},
+		{
+			name: "default_serve_mux",
+			code: `
+package main
+import "net/http"
+func main() {
+	http.ListenAndServe(":8080", nil)
+}`,
+			wantContain: []string{`http.ListenAndServe(":8080", nil)`},
+		},
+		{
+			name: "middleware_chain",
+			code: `
+package main
+import "net/http"
+func main() {
+	mux := http.NewServeMux()
+	http.ListenAndServe(":8080", logging(mux))
+}
+func logging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+	})
+}`,
+			wantContain: []string{
+				`http.ListenAndServe(":8080", nrWrapServerHandler(NewRelicAgent, "mux", mux, logging(mux)))`,
+				`defer newrelic.FromContext(r.Context()).StartSegment("logging").End()`,
+				`func nrWrapServerHandler(app *newrelic.Application, name string, mux *http.ServeMux, handler http.Handler) http.Handler {`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, tt.code)
+			pkg := manager.GetDecoratorPackage()
+			for _, decl := range pkg.Syntax[0].Decls {
+				if fn, ok := decl.(*dst.FuncDecl); ok {
+					manager.CreateFunctionDeclaration(fn)
+				}
+			}
+			dst.Inspect(pkg.Syntax[0].Decls[1], func(n dst.Node) bool {
+				WrapServerHandler(n, manager, nil)
+				return true
+			})
+			manager.writeHelpers()
+
+			got := restoreTestFile(t, pkg.Syntax[0])
+			for _, want := range tt.wantContain {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected instrumented code to contain %q, but got:\n%s", want, got)
+				}
+			}
+		})
+	}
+}
+
+func Test_InstrumentHandleFunction(t *testing.T) {
+	tests := []struct {
+		name        string
+		code        string
+		wantContain []string
+	}{
+		{
+			name: "named_request",
+			code: `
+package main
+import (
+	"errors"
+	"net/http"
+)
+func index(w http.ResponseWriter, req *http.Request) {
+	err := errors.New("oops")
+	w.Write([]byte(err.Error()))
+}`,
+			wantContain: []string{"nrTxn := newrelic.FromContext(req.Context())"},
+		},
+		{
+			name: "reversed_params",
+			code: `
+package main
+import (
+	"errors"
+	"net/http"
+)
+func index(r *http.Request, w http.ResponseWriter) {
+	err := errors.New("oops")
+	w.Write([]byte(err.Error()))
+}`,
+			wantContain: []string{"nrTxn := newrelic.FromContext(r.Context())"},
+		},
+		{
+			name: "blank_request",
+			code: `
+package main
+import (
+	"errors"
+	nethttp "net/http"
+)
+func index(r nethttp.ResponseWriter, _ *nethttp.Request) {
+	err := errors.New("oops")
+	r.Write([]byte(err.Error()))
+}`,
+			wantContain: []string{
+				"func index(r nethttp.ResponseWriter, req *nethttp.Request) {",
+				"nrTxn := newrelic.FromContext(req.Context())",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, tt.code)
+			pkg := manager.GetDecoratorPackage()
+			dstutil.Apply(pkg.Syntax[0], nil, func(c *dstutil.Cursor) bool {
+				InstrumentHandleFunction(c.Node(), manager, c)
+				return true
+			})
+
+			got := restoreTestFile(t, pkg.Syntax[0])
+			for _, want := range tt.wantContain {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected instrumented code to contain %q, but got:\n%s", want, got)
+				}
+			}
+		})
+	}
+}
+
+func Test_FindMiddlewareMuxes(t *testing.T) {
+	code := `
+package main
+import "net/http"
+func main() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", index)
+	other := http.NewServeMux()
+	other.HandleFunc("/", index)
+	server := &http.Server{Handler: logging(mux)}
+	server.ListenAndServe()
+	http.ListenAndServe(":8080", other)
+}
+func index(w http.ResponseWriter, r *http.Request) {}
+func logging(next http.Handler) http.Handler {
+	return next
+}`
+	manager := newTestingInstrumentationManager(t, code)
+	pkg := manager.GetDecoratorPackage()
+	main := pkg.Syntax[0].Decls[1].(*dst.FuncDecl)
+	FindMiddlewareMuxes(main, manager)
+
+	muxRegistration := main.Body.List[1].(*dst.ExprStmt).X.(*dst.CallExpr)
+	if !isMiddlewareMuxRegistration(muxRegistration, manager) {
+		t.Error("expected routes of a mux served through middleware to be recognized")
+	}
+	otherRegistration := main.Body.List[3].(*dst.ExprStmt).X.(*dst.CallExpr)
+	if isMiddlewareMuxRegistration(otherRegistration, manager) {
+		t.Error("expected routes of a mux served directly not to be recognized")
+	}
+}
+
+func Test_RewriteHttpMethodCall(t *testing.T) {
+	tests := []struct {
+		name        string
+		code        string
+		disabled    bool
+		wantContain []string
+	}{
+		{
+			name: "get",
+			code: `
+package main
+import "net/http"
+func main() {
+	resp, err := http.Get("https://example.com")
+}`,
+			wantContain: []string{
+				`resp, err := nrHttpGet(nrTxn, "https://example.com")`,
+				`req, err := http.NewRequest(http.MethodGet, url, nil)`,
+				`return client.Do(newrelic.RequestWithTransactionContext(req, txn))`,
+			},
+		},
+		{
+			name: "post_content_type",
+			code: `
+package main
+import (
+	"net/http"
+	"strings"
+)
+func main() {
+	resp, err := http.Post("https://example.com", "application/json", strings.NewReader("{}"))
+}`,
+			wantContain: []string{
+				`resp, err := nrHttpPost(nrTxn, "https://example.com", "application/json", strings.NewReader("{}"))`,
+				`req.Header.Set("Content-Type", contentType)`,
+			},
+		},
+		{
+			name: "post_form",
+			code: `
+package main
+import (
+	"net/http"
+	"net/url"
+)
+func main() {
+	resp, err := http.PostForm("https://example.com", url.Values{"key": {"value"}})
+}`,
+			wantContain: []string{
+				`resp, err := nrHttpPostForm(nrTxn, "https://example.com", url.Values{"key": {"value"}})`,
+				`return nrHttpPost(txn, url, "application/x-www-form-urlencoded", strings.NewReader(data.Encode()))`,
+				`func nrHttpPost(`,
+			},
+		},
+		{
+			name:     "disabled",
+			disabled: true,
+			code: `
+package main
+import "net/http"
+func main() {
+	resp, err := http.Get("https://example.com")
+}`,
+			wantContain: []string{`resp, err := http.Get("https://example.com")`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, tt.code)
+			manager.rewriteHttpMethods = !tt.disabled
+			pkg := manager.GetDecoratorPackage()
+			stmt := pkg.Syntax[0].Decls[1].(*dst.FuncDecl).Body.List[0]
+
+			if got := RewriteHttpMethodCall(manager, stmt, nil, "nrTxn"); got == tt.disabled {
+				t.Errorf("RewriteHttpMethodCall() = %v, want %v", got, !tt.disabled)
+			}
+			manager.writeHelpers()
+
+			got := restoreTestFile(t, pkg.Syntax[0])
+			for _, want := range tt.wantContain {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected instrumented code to contain %q, but got:\n%s", want, got)
+				}
+			}
+		})
+	}
+}
+
+func Test_removeCannotTraceComment(t *testing.T) {
+	decs := &dst.NodeDecs{}
+	decs.Start.Append("// existing comment")
+	decs.Start.Prepend(cannotTraceOutboundHttp(HttpGet, decs)...)
+
+	removeCannotTraceComment(HttpGet, decs)
+	assert.Equal(t, []string{"// existing comment"}, decs.Start.All())
+}
+
+func Test_InstrumentHttpClient(t *testing.T) {
+	tests := []struct {
+		name        string
+		code        string
+		wantContain []string
+	}{
+		{
+			name: "client_definition",
+			code: `
+package main
+import "net/http"
+func main() {
+	client := &http.Client{}
+	client.Get("https://example.com")
+}`,
+			wantContain: []string{
+				"client := &http.Client{}\n\tclient.Transport = newrelic.NewRoundTripper(client.Transport)",
+			},
+		},
+		{
+			name: "package_variable",
+			code: `
+package main
+import (
+	"net/http"
+	"time"
+)
+var client = &http.Client{Timeout: 5 * time.Second}
+func main() {}`,
+			wantContain: []string{"var client = &http.Client{Timeout: 5 * time.Second, Transport: newrelic.NewRoundTripper(nil)}"},
+		},
+		{
+			name: "struct_field_custom_transport",
+			code: `
+package main
+import "net/http"
+type service struct {
+	httpClient *http.Client
+}
+func main() {
+	s := service{}
+	s.httpClient = &http.Client{Transport: &http.Transport{}}
+}`,
+			wantContain: []string{"s.httpClient = &http.Client{Transport: newrelic.NewRoundTripper(&http.Transport{})}"},
+		},
+		{
+			name: "constructor",
+			code: `
+package main
+import "net/http"
+func newClient() *http.Client {
+	return &http.Client{
+		CheckRedirect: nil,
+	}
+}
+func main() {
+	client := newClient()
+	client.Get("https://example.com")
+}`,
+			wantContain: []string{
+				"return &http.Client{\n\t\tCheckRedirect: nil,\n\t\tTransport:     newrelic.NewRoundTripper(nil),\n\t}",
+				"client := newClient()\n\tclient.Get",
+			},
+		},
+		{
+			name: "client_of_another_package",
+			code: `
+package main
+import "net/http/httptest"
+func main() {
+	srv := httptest.NewServer(nil)
+	client := srv.Client()
+	client.Get(srv.URL)
+}`,
+			wantContain: []string{"client := nrInstrumentClient(srv.Client())\n\tclient.Get(srv.URL)"},
+		},
+		{
+			name: "client_value",
+			code: `
+package main
+import "net/http"
+func main() {
+	client := http.Client{}
+	client.Get("https://example.com")
+}`,
+			wantContain: []string{"client := http.Client{Transport: newrelic.NewRoundTripper(nil)}"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, tt.code)
+			pkg := manager.GetDecoratorPackage()
+			for _, decl := range pkg.Syntax[0].Decls {
+				if fn, ok := decl.(*dst.FuncDecl); ok {
+					manager.CreateFunctionDeclaration(fn)
+				}
+			}
+			for _, decl := range pkg.Syntax[0].Decls {
+				dstutil.Apply(decl, nil, func(c *dstutil.Cursor) bool {
+					InstrumentHttpClient(c.Node(), manager, c)
+					return true
+				})
+			}
+
+			got := restoreTestFile(t, pkg.Syntax[0])
+			for _, want := range tt.wantContain {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected instrumented code to contain %q, but got:\n%s", want, got)
+				}
+			}
+		})
+	}
+}
+
+func Test_ExternalHttpCallRequestContext(t *testing.T) {
+	tests := []struct {
+		name        string
+		code        string
+		wantContain []string
+		wantMissing string
+	}{
+		{
+			name: "new_request",
+			code: `
+package main
+import "net/http"
+func main() {
+	client := &http.Client{}
+	req, _ := http.NewRequest("GET", "https://example.com", nil)
+	client.Do(req)
+}`,
+			wantContain: []string{"req = newrelic.RequestWithTransactionContext(req, nrTxn)"},
+		},
+		{
+			name: "new_request_with_context",
+			code: `
+package main
+import (
+	"context"
+	"net/http"
+)
+func main() {
+	client := &http.Client{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "https://example.com", nil)
+	client.Do(req)
+}`,
+			wantContain: []string{`req, _ := http.NewRequestWithContext(newrelic.NewContext(ctx, nrTxn), "GET", "https://example.com", nil)`},
+			wantMissing: "RequestWithTransactionContext",
+		},
+		{
+			name: "request_context_outside_handler",
+			code: `
+package main
+import "net/http"
+func forward(r *http.Request) {
+	client := &http.Client{}
+	req, _ := http.NewRequestWithContext(r.Context(), "GET", "https://example.com", nil)
+	client.Do(req)
+}`,
+			wantContain: []string{`req, _ := http.NewRequestWithContext(newrelic.NewContext(r.Context(), nrTxn), "GET", "https://example.com", nil)`},
+			wantMissing: "RequestWithTransactionContext",
+		},
+		{
+			name: "request_already_has_transaction",
+			code: `
+package main
+import (
+	"net/http"
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+func main() {
+	client := &http.Client{}
+	req, _ := http.NewRequest("GET", "https://example.com", nil)
+	req = newrelic.RequestWithTransactionContext(req, nrTxn)
+	client.Do(req)
+}`,
+			wantContain: []string{"req = newrelic.RequestWithTransactionContext(req, nrTxn)\n\tclient.Do(req)"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, tt.code)
+			pkg := manager.GetDecoratorPackage()
+			decl := pkg.Syntax[0].Decls[len(pkg.Syntax[0].Decls)-1].(*dst.FuncDecl)
+			dstutil.Apply(decl.Body, nil, func(c *dstutil.Cursor) bool {
+				if stmt, ok := c.Node().(dst.Stmt); ok {
+					ExternalHttpCall(manager, stmt, c, "nrTxn")
+				}
+				return true
+			})
+
+			got := restoreTestFile(t, pkg.Syntax[0])
+			for _, want := range tt.wantContain {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected instrumented code to contain %q, but got:\n%s", want, got)
+				}
+			}
+			if tt.wantMissing != "" && strings.Contains(got, tt.wantMissing) {
+				t.Errorf("expected instrumented code not to contain %q, but got:\n%s", tt.wantMissing, got)
+			}
+		})
+	}
+}
+
+func Test_UseTxnResponseWriters(t *testing.T) {
+	tests := []struct {
+		name           string
+		code           string
+		wantContain    []string
+		wantNotContain []string
+	}{
+		{
+			name: "unregistered_handler",
+			code: `
+package main
+import "net/http"
+func index(rw http.ResponseWriter, r *http.Request) {
+	req, _ := http.NewRequest("GET", "https://example.com", nil)
+	if _, err := http.DefaultClient.Do(req); err != nil {
+		http.Error(rw, "oops", http.StatusInternalServerError)
+	}
+}
+func main() {}`,
+			wantContain: []string{"nrTxn := newrelic.FromContext(r.Context())\n\trw = nrTxn.SetWebResponse(rw)\n"},
+		},
+		{
+			name: "untraced_handler",
+			code: `
+package main
+import "net/http"
+func index(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
+func main() {}`,
+			wantContain: []string{"func index(w http.ResponseWriter, r *http.Request) {\n\tnrTxn := newrelic.FromContext(r.Context())\n\tw = nrTxn.SetWebResponse(w)\n"},
+		},
+		{
+			name: "wrapped_handler",
+			code: `
+package main
+import "net/http"
+func index(rw http.ResponseWriter, r *http.Request) {
+	req, _ := http.NewRequest("GET", "https://example.com", nil)
+	if _, err := http.DefaultClient.Do(req); err != nil {
+		http.Error(rw, "oops", http.StatusInternalServerError)
+	}
+}
+func main() {
+	http.HandleFunc("/", index)
+	http.ListenAndServe(":8000", nil)
+}`,
+			wantContain:    []string{"nrTxn := newrelic.FromContext(r.Context())", `http.HandleFunc(newrelic.WrapHandleFunc(NewRelicAgent, "/", index))`},
+			wantNotContain: []string{"SetWebResponse"},
+		},
+		{
+			name: "wrapped_handler_type",
+			code: `
+package main
+import "net/http"
+type api struct{}
+func (a *api) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
+func main() {
+	http.ListenAndServe(":8000", &api{})
+}`,
+			wantNotContain: []string{"SetWebResponse"},
+		},
+		{
+			name: "wrapped_handler_literal",
+			code: `
+package main
+import "net/http"
+func main() {
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	http.ListenAndServe(":8000", nil)
+}`,
+			wantNotContain: []string{"SetWebResponse"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, tt.code)
+			if err := tracePackageFunctionCalls(manager); err != nil {
+				t.Fatal(err)
+			}
+			instrumentPackages(manager, InstrumentMain, InstrumentHandleFunction)
+			manager.UseTxnResponseWriters()
+
+			got := restoreTestFile(t, manager.GetDecoratorPackage().Syntax[0])
+			for _, want := range tt.wantContain {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected instrumented code to contain %q, but got:\n%s", want, got)
+				}
+			}
+			for _, notWant := range tt.wantNotContain {
+				if strings.Contains(got, notWant) {
+					t.Errorf("expected instrumented code not to contain %q, but got:\n%s", notWant, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"go/ast"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/dstutil"
+)
+
+const (
+	ExecCmdType        = "*os/exec.Cmd"
+	ExecRun            = "Run"
+	ExecOutput         = "Output"
+	ExecCombinedOutput = "CombinedOutput"
+
+	// name of the helpers that start and end command segments, which the helpers in execCommandHelpers depend on
+	execCommandHelperName = "nrCommandSegment"
+)
+
+// execCommandHelpers are the helpers that run a command in a segment, by the name of the method of exec.Cmd they replace
+var execCommandHelpers = map[string]string{
+	ExecRun:            "nrRunCommand",
+	ExecOutput:         "nrCommandOutput",
+	ExecCombinedOutput: "nrCommandCombinedOutput",
+}
+
+// execCommandHelperSources contains the source code of the helpers in execCommandHelpers, and the helpers they depend on.
+var execCommandHelperSources = map[string]string{
+	execCommandHelperName: `package helper
+
+import (
+	"errors"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// nrCommandName returns the name of the executable cmd runs.
+func nrCommandName(cmd *exec.Cmd) string {
+	if len(cmd.Args) > 0 {
+		return filepath.Base(cmd.Args[0])
+	}
+	return filepath.Base(cmd.Path)
+}
+
+// nrStartCommandSegment starts a segment of txn named after the executable cmd runs.
+func nrStartCommandSegment(txn *newrelic.Transaction, cmd *exec.Cmd) *newrelic.Segment {
+	return txn.StartSegment("exec " + nrCommandName(cmd))
+}
+
+// nrEndCommandSegment records the exit code of cmd on its segment and ends it. Commands that fail to run, or
+// exit with a non-zero status, are recorded as errors of txn.
+func nrEndCommandSegment(txn *newrelic.Transaction, segment *newrelic.Segment, cmd *exec.Cmd, err error) {
+	if cmd.ProcessState != nil {
+		segment.AddAttribute("exitCode", cmd.ProcessState.ExitCode())
+	}
+	segment.End()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		txn.NoticeError(newrelic.Error{
+			Message: nrCommandName(cmd) + ": " + err.Error(),
+			Class:   "ExitError",
+			Attributes: map[string]interface{}{
+				"exitCode": exitErr.ExitCode(),
+			},
+		})
+	} else if err != nil {
+		txn.NoticeError(err)
+	}
+}
+`,
+	"nrRunCommand": `package helper
+
+import (
+	"os/exec"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// nrRunCommand runs cmd like cmd.Run, recording it as a segment of txn.
+func nrRunCommand(txn *newrelic.Transaction, cmd *exec.Cmd) error {
+	segment := nrStartCommandSegment(txn, cmd)
+	err := cmd.Run()
+	nrEndCommandSegment(txn, segment, cmd, err)
+	return err
+}
+`,
+	"nrCommandOutput": `package helper
+
+import (
+	"os/exec"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// nrCommandOutput runs cmd and returns its standard output like cmd.Output, recording it as a segment of txn.
+func nrCommandOutput(txn *newrelic.Transaction, cmd *exec.Cmd) ([]byte, error) {
+	segment := nrStartCommandSegment(txn, cmd)
+	out, err := cmd.Output()
+	nrEndCommandSegment(txn, segment, cmd, err)
+	return out, err
+}
+`,
+	"nrCommandCombinedOutput": `package helper
+
+import (
+	"os/exec"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// nrCommandCombinedOutput runs cmd and returns its combined standard output and standard error like
+// cmd.CombinedOutput, recording it as a segment of txn.
+func nrCommandCombinedOutput(txn *newrelic.Transaction, cmd *exec.Cmd) ([]byte, error) {
+	segment := nrStartCommandSegment(txn, cmd)
+	out, err := cmd.CombinedOutput()
+	nrEndCommandSegment(txn, segment, cmd, err)
+	return out, err
+}
+`,
+}
+
+// isExecCommandRun returns true if a call runs an external command with exec.Cmd, and the name of the method called.
+func isExecCommandRun(call *dst.CallExpr, pkg *decorator.Package) (string, bool) {
+	sel, ok := call.Fun.(*dst.SelectorExpr)
+	if !ok || len(call.Args) != 0 || pkg == nil || pkg.TypesInfo == nil {
+		return "", false
+	}
+	if _, ok := execCommandHelpers[sel.Sel.Name]; !ok {
+		return "", false
+	}
+	astExpr, ok := pkg.Decorator.Ast.Nodes[sel.X].(ast.Expr)
+	if !ok {
+		return "", false
+	}
+	t := pkg.TypesInfo.TypeOf(astExpr)
+	if t == nil || t.String() != ExecCmdType {
+		return "", false
+	}
+	return sel.Sel.Name, true
+}
+
+// ExecCommandCall records external commands run with exec.Cmd in traced functions as segments named after
+// the executable, ex: "exec git". The exit code of the command is recorded as an attribute of the segment, and
+// commands that fail are recorded as errors.
+func ExecCommandCall(manager *InstrumentationManager, stmt dst.Stmt, c *dstutil.Cursor, txnName string) bool {
+	pkg := manager.GetDecoratorPackage()
+	wasModified := false
+	dst.Inspect(stmt, func(n dst.Node) bool {
+		switch v := n.(type) {
+		case *dst.FuncLit:
+			return false
+		case *dst.CallExpr:
+			method, ok := isExecCommandRun(v, pkg)
+			if !ok {
+				return true
+			}
+			helper := execCommandHelpers[method]
+			manager.AddHelper(execCommandHelperName, parseHelperDecls(execCommandHelperSources[execCommandHelperName])...)
+			manager.AddHelper(helper, parseHelperDecls(execCommandHelperSources[helper])...)
+			manager.AddImport(newrelicAgentImport)
+
+			v.Args = []dst.Expr{dst.NewIdent(txnName), v.Fun.(*dst.SelectorExpr).X}
+			v.Fun = dst.NewIdent(helper)
+			wasModified = true
+		}
+		return true
+	})
+	return wasModified
+}
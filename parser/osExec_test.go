@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dave/dst"
+)
+
+func Test_ExecCommandCall(t *testing.T) {
+	tests := []struct {
+		name           string
+		code           string
+		wantContain    []string
+		wantNotContain []string
+	}{
+		{
+			name: "run_command_variable",
+			code: `
+package main
+import "os/exec"
+func main() {
+	deploy()
+}
+func deploy() error {
+	cmd := exec.Command("git", "pull")
+	err := cmd.Run()
+	return err
+}`,
+			wantContain: []string{
+				"err := nrRunCommand(nrTxn, cmd)",
+				"func nrRunCommand(txn *newrelic.Transaction, cmd *exec.Cmd) error {",
+				`return txn.StartSegment("exec " + nrCommandName(cmd))`,
+				`segment.AddAttribute("exitCode", cmd.ProcessState.ExitCode())`,
+			},
+			wantNotContain: []string{"nrTxn.NoticeError(err)"},
+		},
+		{
+			name: "output_in_if_statement",
+			code: `
+package main
+import "os/exec"
+func main() {
+	version()
+}
+func version() string {
+	if out, err := exec.Command("go", "version").Output(); err == nil {
+		return string(out)
+	}
+	return ""
+}`,
+			wantContain: []string{
+				`if out, err := nrCommandOutput(nrTxn, exec.Command("go", "version")); err == nil {`,
+				"func nrCommandOutput(txn *newrelic.Transaction, cmd *exec.Cmd) ([]byte, error) {",
+			},
+		},
+		{
+			name: "combined_output_returned",
+			code: `
+package main
+import "os/exec"
+func main() {
+	build()
+}
+func build() ([]byte, error) {
+	return exec.Command("make").CombinedOutput()
+}`,
+			wantContain: []string{`return nrCommandCombinedOutput(nrTxn, exec.Command("make"))`},
+		},
+		{
+			name: "other_run_method",
+			code: `
+package main
+type job struct{}
+func (j *job) Run() error { return nil }
+func main() {
+	start()
+}
+func start() error {
+	j := &job{}
+	err := j.Run()
+	return err
+}`,
+			wantContain:    []string{"err := j.Run()", "nrTxn.NoticeError(err)"},
+			wantNotContain: []string{"nrRunCommand"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, tt.code)
+			pkg := manager.GetDecoratorPackage()
+			for _, decl := range pkg.Syntax[0].Decls {
+				if fn, ok := decl.(*dst.FuncDecl); ok {
+					manager.CreateFunctionDeclaration(fn)
+				}
+			}
+			instrumentPackages(manager, InstrumentMain)
+			manager.writeHelpers()
+
+			got := restoreTestFile(t, pkg.Syntax[0])
+			for _, want := range tt.wantContain {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected instrumented code to contain %q, but got:\n%s", want, got)
+				}
+			}
+			for _, notWant := range tt.wantNotContain {
+				if strings.Contains(got, notWant) {
+					t.Errorf("expected instrumented code not to contain %q, but got:\n%s", notWant, got)
+				}
+			}
+		})
+	}
+}
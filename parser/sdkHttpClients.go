@@ -0,0 +1,287 @@
+package main
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"path"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/dstutil"
+)
+
+// sdkHttpClientArgument describes a function from a third-party SDK that accepts an *http.Client as an argument.
+type sdkHttpClientArgument struct {
+	path  string // import path of the package the function is declared in, "*" matches a major version, ex: "v60"
+	name  string // name of the function
+	index int    // index of the *http.Client argument
+	key   string // qualified name of the argument that must precede the client, if any, ex: a context key
+}
+
+// sdkHttpClientArguments are the constructors and options of known SDKs that accept an *http.Client. The clients passed to
+// them are instrumented so that the requests made by the SDK are recorded as external segments.
+var sdkHttpClientArguments = []sdkHttpClientArgument{
+	// client := github.NewClient(httpClient)
+	{path: "github.com/google/go-github/github", name: "NewClient", index: 0},
+	{path: "github.com/google/go-github/*/github", name: "NewClient", index: 0},
+	// option.WithHTTPClient(httpClient), used by Google Cloud client libraries
+	{path: "google.golang.org/api/option", name: "WithHTTPClient", index: 0},
+	// slack.New(token, slack.OptionHTTPClient(httpClient))
+	{path: "github.com/slack-go/slack", name: "OptionHTTPClient", index: 0},
+	// stripe.SetHTTPClient(httpClient)
+	{path: "github.com/stripe/stripe-go", name: "SetHTTPClient", index: 0},
+	{path: "github.com/stripe/stripe-go/*", name: "SetHTTPClient", index: 0},
+	// oauth2 uses the client stored in the context: context.WithValue(ctx, oauth2.HTTPClient, httpClient)
+	{path: "context", name: "WithValue", index: 2, key: "golang.org/x/oauth2.HTTPClient"},
+}
+
+const instrumentClientHelper = "nrInstrumentClient"
+
+const instrumentClientSource = `package helper
+
+import (
+	"net/http"
+	"reflect"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// nrInstrumentClient returns a copy of client that records the requests it makes as New Relic external segments.
+// Clients whose transport is already a New Relic round tripper are returned as they are.
+func nrInstrumentClient(client *http.Client) *http.Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if client.Transport != nil && reflect.TypeOf(client.Transport) == reflect.TypeOf(newrelic.NewRoundTripper(nil)) {
+		return client
+	}
+	instrumented := *client
+	instrumented.Transport = newrelic.NewRoundTripper(instrumented.Transport)
+	return &instrumented
+}
+`
+
+// getSdkHttpClientArgument returns the SDK function a call is made to, if it accepts an *http.Client.
+func getSdkHttpClientArgument(call *dst.CallExpr) (sdkHttpClientArgument, bool) {
+	fun, ok := call.Fun.(*dst.Ident)
+	if !ok || fun.Path == "" {
+		return sdkHttpClientArgument{}, false
+	}
+	for _, arg := range sdkHttpClientArguments {
+		if arg.name != fun.Name || arg.index >= len(call.Args) {
+			continue
+		}
+		if match, _ := path.Match(arg.path, fun.Path); !match {
+			continue
+		}
+		if arg.key != "" {
+			key, ok := call.Args[arg.index-1].(*dst.Ident)
+			if !ok || key.Path+"."+key.Name != arg.key {
+				continue
+			}
+		}
+		return arg, true
+	}
+	return sdkHttpClientArgument{}, false
+}
+
+// acceptsHttpClient verifies the argument of a call accepts an *http.Client with type information: the parameter is
+// an *http.Client, or an interface it implements, ex: slack's httpClient. Calls to packages that could not be loaded
+// are trusted to match the table.
+func acceptsHttpClient(call *dst.CallExpr, index int, pkg *decorator.Package) bool {
+	if pkg == nil || pkg.TypesInfo == nil {
+		return true
+	}
+	astFun, ok := pkg.Decorator.Ast.Nodes[call.Fun].(ast.Expr)
+	if !ok {
+		return true
+	}
+	sig, ok := pkg.TypesInfo.TypeOf(astFun).(*types.Signature)
+	if !ok || sig.Params().Len() <= index {
+		return true
+	}
+	param := sig.Params().At(index).Type()
+	if sig.Variadic() && index == sig.Params().Len()-1 {
+		if slice, ok := param.(*types.Slice); ok {
+			param = slice.Elem()
+		}
+	}
+	client := lookupHttpClient(pkg.Types)
+	if client == nil {
+		// net/http is not imported by the package or its dependencies, so only an empty interface can accept a client
+		iface, ok := param.Underlying().(*types.Interface)
+		return ok && iface.Empty()
+	}
+	return types.AssignableTo(types.NewPointer(client), param)
+}
+
+// lookupHttpClient returns the http.Client type, from the net/http package imported by a package or its dependencies.
+// It returns nil if net/http is not imported.
+func lookupHttpClient(pkg *types.Package) types.Type {
+	if pkg == nil {
+		return nil
+	}
+	visited := map[*types.Package]bool{}
+	queue := []*types.Package{pkg}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if visited[current] {
+			continue
+		}
+		visited[current] = true
+		if current.Path() == NetHttp {
+			if obj, ok := current.Scope().Lookup("Client").(*types.TypeName); ok {
+				return obj.Type()
+			}
+			return nil
+		}
+		queue = append(queue, current.Imports()...)
+	}
+	return nil
+}
+
+// isHttpClientLit returns true if an expression creates an http.Client with a composite literal, which is instrumented by InstrumentHttpClient.
+func isHttpClientLit(expr dst.Expr) bool {
+	if unary, ok := expr.(*dst.UnaryExpr); ok && unary.Op == token.AND {
+		expr = unary.X
+	}
+	lit, ok := expr.(*dst.CompositeLit)
+	if !ok {
+		return false
+	}
+	ident, ok := lit.Type.(*dst.Ident)
+	return ok && ident.Name == "Client" && ident.Path == NetHttp
+}
+
+// isInstrumentedClient returns true if a client passed to an SDK is already instrumented. Clients created in the
+// enclosing block, or by a package variable, are instrumented where they are created.
+func isInstrumentedClient(client dst.Expr, manager *InstrumentationManager, c *dstutil.Cursor) bool {
+	switch v := client.(type) {
+	case *dst.UnaryExpr, *dst.CompositeLit:
+		return isHttpClientLit(v)
+	case *dst.CallExpr:
+		if fun, ok := v.Fun.(*dst.Ident); ok && fun.Name == instrumentClientHelper {
+			return true
+		}
+		return isLocalFunctionCall(v, manager)
+	case *dst.Ident:
+		stmts := precedingStmts(c)
+		for i := len(stmts) - 1; i >= 0; i-- {
+			assign, ok := stmts[i].(*dst.AssignStmt)
+			if !ok || len(assign.Rhs) != 1 {
+				continue
+			}
+			if lhs, ok := assign.Lhs[0].(*dst.Ident); !ok || lhs.Name != v.Name {
+				continue
+			}
+			// clients returned by a call are instrumented after they are assigned to a single variable
+			if call, ok := assign.Rhs[0].(*dst.CallExpr); ok {
+				return isLocalFunctionCall(call, manager) || len(assign.Lhs) == 1
+			}
+			return isHttpClientLit(assign.Rhs[0])
+		}
+		return isPackageClientLit(v.Name, manager.GetDecoratorPackage())
+	}
+	return false
+}
+
+// isPackageClientLit returns true if a package variable is created with an http.Client composite literal.
+func isPackageClientLit(name string, pkg *decorator.Package) bool {
+	if pkg == nil {
+		return false
+	}
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*dst.GenDecl)
+			if !ok || gen.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				valueSpec, ok := spec.(*dst.ValueSpec)
+				if !ok {
+					continue
+				}
+				for i, ident := range valueSpec.Names {
+					if ident.Name == name && i < len(valueSpec.Values) {
+						return isHttpClientLit(valueSpec.Values[i])
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// instrumentSdkHttpClient instruments the client passed to an SDK call. A nil client is replaced with an instrumented
+// client, and other clients are wrapped with a helper that returns an instrumented copy of them.
+func instrumentSdkHttpClient(call *dst.CallExpr, manager *InstrumentationManager, c *dstutil.Cursor) bool {
+	arg, ok := getSdkHttpClientArgument(call)
+	if !ok || !acceptsHttpClient(call, arg.index, manager.GetDecoratorPackage()) {
+		return false
+	}
+
+	client := call.Args[arg.index]
+	if ident, ok := client.(*dst.Ident); ok && ident.Name == "nil" {
+		call.Args[arg.index] = &dst.UnaryExpr{
+			Op: token.AND,
+			X: &dst.CompositeLit{
+				Type: &dst.Ident{
+					Name: "Client",
+					Path: NetHttp,
+				},
+				Elts: []dst.Expr{
+					&dst.KeyValueExpr{
+						Key: dst.NewIdent("Transport"),
+						Value: &dst.CallExpr{
+							Fun: &dst.Ident{
+								Name: "NewRoundTripper",
+								Path: newrelicAgentImport,
+							},
+							Args: []dst.Expr{dst.NewIdent("nil")},
+						},
+					},
+				},
+			},
+		}
+		manager.AddImport(newrelicAgentImport)
+		return true
+	}
+	if isInstrumentedClient(client, manager, c) {
+		return false
+	}
+
+	call.Args[arg.index] = &dst.CallExpr{
+		Fun:  dst.NewIdent(instrumentClientHelper),
+		Args: []dst.Expr{client},
+	}
+	manager.AddImport(newrelicAgentImport)
+	manager.AddHelper(instrumentClientHelper, parseHelperDecls(instrumentClientSource)...)
+	return true
+}
+
+// InstrumentSdkHttpClient finds the http clients passed to the constructors and options of known SDKs, and instruments
+// them so that the requests the SDKs make are recorded as external segments.
+func InstrumentSdkHttpClient(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
+	switch n.(type) {
+	case dst.Stmt:
+		// only statements in a block are checked, so that clients created earlier in the block can be found
+		if c.Index() < 0 {
+			return
+		}
+	case *dst.ValueSpec:
+	default:
+		return
+	}
+
+	dst.Inspect(n, func(node dst.Node) bool {
+		switch v := node.(type) {
+		case *dst.BlockStmt, *dst.FuncLit:
+			return false
+		case *dst.CallExpr:
+			instrumentSdkHttpClient(v, manager, c)
+		}
+		return true
+	})
+}
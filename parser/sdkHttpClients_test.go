@@ -0,0 +1,297 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/dstutil"
+)
+
+func Test_getSdkHttpClientArgument(t *testing.T) {
+	tests := []struct {
+		name      string
+		call      *dst.CallExpr
+		wantOk    bool
+		wantIndex int
+	}{
+		{
+			name: "versioned_go_github",
+			call: &dst.CallExpr{
+				Fun:  &dst.Ident{Name: "NewClient", Path: "github.com/google/go-github/v60/github"},
+				Args: []dst.Expr{dst.NewIdent("nil")},
+			},
+			wantOk: true,
+		},
+		{
+			name: "other_package",
+			call: &dst.CallExpr{
+				Fun:  &dst.Ident{Name: "NewClient", Path: "github.com/example/sdk"},
+				Args: []dst.Expr{dst.NewIdent("nil")},
+			},
+			wantOk: false,
+		},
+		{
+			name: "oauth2_context",
+			call: &dst.CallExpr{
+				Fun: &dst.Ident{Name: "WithValue", Path: "context"},
+				Args: []dst.Expr{
+					dst.NewIdent("ctx"),
+					&dst.Ident{Name: "HTTPClient", Path: "golang.org/x/oauth2"},
+					dst.NewIdent("client"),
+				},
+			},
+			wantOk:    true,
+			wantIndex: 2,
+		},
+		{
+			name: "other_context_value",
+			call: &dst.CallExpr{
+				Fun: &dst.Ident{Name: "WithValue", Path: "context"},
+				Args: []dst.Expr{
+					dst.NewIdent("ctx"),
+					dst.NewIdent("key"),
+					dst.NewIdent("client"),
+				},
+			},
+			wantOk: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := getSdkHttpClientArgument(tt.call)
+			if ok != tt.wantOk {
+				t.Fatalf("getSdkHttpClientArgument() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if ok && got.index != tt.wantIndex {
+				t.Errorf("getSdkHttpClientArgument() index = %d, want %d", got.index, tt.wantIndex)
+			}
+		})
+	}
+}
+
+// sdkStubFiles are stubs of the SDKs that accept an *http.Client, that test applications are built with, so that the
+// parameters clients are passed to are resolved
+var sdkStubFiles = map[string]string{
+	"go.mod": `module parser/tmp
+
+go 1.22
+
+require (
+	github.com/google/go-github/v60 v60.0.0
+	github.com/slack-go/slack v0.12.0
+	golang.org/x/oauth2 v0.15.0
+	google.golang.org/api v0.150.0
+)
+
+replace github.com/google/go-github/v60 => ./stubs/github
+
+replace github.com/slack-go/slack => ./stubs/slack
+
+replace golang.org/x/oauth2 => ./stubs/oauth2
+
+replace google.golang.org/api => ./stubs/api
+`,
+	"stubs/github/go.mod": "module github.com/google/go-github/v60\n\ngo 1.22\n",
+	"stubs/github/github/github.go": `package github
+
+import "net/http"
+
+type Client struct{}
+
+func NewClient(httpClient *http.Client) *Client { return &Client{} }
+`,
+	"stubs/slack/go.mod": "module github.com/slack-go/slack\n\ngo 1.22\n",
+	"stubs/slack/slack.go": `package slack
+
+import "net/http"
+
+type httpClient interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+type Client struct{}
+
+type Option func(*Client)
+
+func OptionHTTPClient(client httpClient) func(*Client) { return func(*Client) {} }
+
+func New(token string, options ...Option) *Client { return &Client{} }
+`,
+	"stubs/oauth2/go.mod": "module golang.org/x/oauth2\n\ngo 1.22\n",
+	"stubs/oauth2/oauth2.go": `package oauth2
+
+type contextKey struct{}
+
+var HTTPClient contextKey
+`,
+	"stubs/api/go.mod": "module google.golang.org/api\n\ngo 1.22\n",
+	"stubs/api/option/option.go": `package option
+
+import "net/http"
+
+type ClientOption interface{}
+
+func WithHTTPClient(client *http.Client) ClientOption { return nil }
+
+// WithHTTPClientName is not in the table, and is used to check that table entries match by name
+func WithHTTPClientName(name string) ClientOption { return nil }
+`,
+}
+
+func Test_acceptsHttpClient(t *testing.T) {
+	tests := []struct {
+		name string
+		call string
+		want bool
+	}{
+		{name: "client_pointer", call: "github.NewClient(nil)", want: true},
+		{name: "interface_implemented_by_client", call: "slack.OptionHTTPClient(http.DefaultClient)", want: true},
+		{name: "empty_interface", call: "context.WithValue(context.Background(), oauth2.HTTPClient, http.DefaultClient)", want: true},
+		{name: "other_type", call: "option.WithHTTPClientName(\"client\")", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]string{}
+			for name, code := range sdkStubFiles {
+				files[name] = code
+			}
+			files["main.go"] = `package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/go-github/v60/github"
+	"github.com/slack-go/slack"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+)
+
+var (
+	_ = context.Background
+	_ = http.DefaultClient
+	_ = github.NewClient
+	_ = slack.New
+	_ = oauth2.HTTPClient
+	_ = option.WithHTTPClient
+)
+
+func main() {
+	_ = ` + tt.call + `
+}
+`
+			manager := newTestingMultiPackageManager(t, files)
+			pkg := manager.GetDecoratorPackage()
+			if len(pkg.Errors) > 0 {
+				t.Fatalf("failed to load test application: %v", pkg.Errors)
+			}
+			var call *dst.CallExpr
+			for _, decl := range pkg.Syntax[0].Decls {
+				if fn, ok := decl.(*dst.FuncDecl); ok && fn.Name.Name == "main" {
+					call = fn.Body.List[0].(*dst.AssignStmt).Rhs[0].(*dst.CallExpr)
+				}
+			}
+			index := len(call.Args) - 1
+			if got := acceptsHttpClient(call, index, pkg); got != tt.want {
+				t.Errorf("acceptsHttpClient() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_InstrumentSdkHttpClient(t *testing.T) {
+	tests := []struct {
+		name        string
+		code        string
+		wantContain []string
+	}{
+		{
+			name: "nil_client",
+			code: `
+package main
+import "github.com/google/go-github/v60/github"
+func main() {
+	client := github.NewClient(nil)
+	_ = client
+}`,
+			wantContain: []string{"client := github.NewClient(&http.Client{Transport: newrelic.NewRoundTripper(nil)})"},
+		},
+		{
+			name: "existing_client",
+			code: `
+package main
+import (
+	"net/http"
+	"github.com/slack-go/slack"
+)
+func main() {
+	api := slack.New("token", slack.OptionHTTPClient(http.DefaultClient))
+	_ = api
+}`,
+			wantContain: []string{
+				`api := slack.New("token", slack.OptionHTTPClient(nrInstrumentClient(http.DefaultClient)))`,
+				"func nrInstrumentClient(client *http.Client) *http.Client {",
+			},
+		},
+		{
+			name: "client_created_in_block",
+			code: `
+package main
+import (
+	"net/http"
+	"google.golang.org/api/option"
+)
+func main() {
+	client := &http.Client{}
+	opt := option.WithHTTPClient(client)
+	_ = opt
+}`,
+			wantContain: []string{"opt := option.WithHTTPClient(client)"},
+		},
+		{
+			name: "oauth2_context_client",
+			code: `
+package main
+import (
+	"context"
+	"net/http"
+	"golang.org/x/oauth2"
+)
+var sharedClient *http.Client
+func main() {
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, sharedClient)
+	_ = ctx
+}`,
+			wantContain: []string{"ctx := context.WithValue(context.Background(), oauth2.HTTPClient, nrInstrumentClient(sharedClient))"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]string{"main.go": tt.code}
+			for name, code := range sdkStubFiles {
+				files[name] = code
+			}
+			manager := newTestingMultiPackageManager(t, files)
+			pkg := manager.GetDecoratorPackage()
+			if len(pkg.Errors) > 0 {
+				t.Fatalf("failed to load test application: %v", pkg.Errors)
+			}
+			for _, decl := range pkg.Syntax[0].Decls {
+				dstutil.Apply(decl, nil, func(c *dstutil.Cursor) bool {
+					InstrumentSdkHttpClient(c.Node(), manager, c)
+					return true
+				})
+			}
+			manager.writeHelpers()
+
+			got := restoreTestFile(t, pkg.Syntax[0])
+			for _, want := range tt.wantContain {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected instrumented code to contain %q, but got:\n%s", want, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"go/ast"
+	"go/token"
+	"strings"
+	"time"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/dstutil"
+)
+
+const (
+	defaultShutdownTimeout = 5 * time.Second
+
+	signalPath = "os/signal"
+)
+
+// deferShutdown creates the statement: defer app.Shutdown(timeout)
+func deferShutdown(agentVariableName string, timeout time.Duration) *dst.DeferStmt {
+	return &dst.DeferStmt{
+		Call: shutdownAgent(agentVariableName, timeout).X.(*dst.CallExpr),
+		Decs: dst.DeferStmtDecorations{
+			NodeDecs: dst.NodeDecs{
+				After: dst.EmptyLine,
+			},
+		},
+	}
+}
+
+// agentShutdownIndex returns the index of the statement that defers the shutdown of the application in the body of
+// a function, or -1 if the function does not shut it down.
+func agentShutdownIndex(fn *dst.FuncDecl, agentVariableName string) int {
+	for i, stmt := range fn.Body.List {
+		deferStmt, ok := stmt.(*dst.DeferStmt)
+		if !ok {
+			continue
+		}
+		sel, ok := deferStmt.Call.Fun.(*dst.SelectorExpr)
+		if !ok || sel.Sel.Name != "Shutdown" {
+			continue
+		}
+		if ident, ok := sel.X.(*dst.Ident); ok && ident.Name == agentVariableName {
+			return i
+		}
+	}
+	return -1
+}
+
+// isExitCall returns true if a call exits the program without running deferred functions: os.Exit, log.Fatal,
+// or the Fatal methods of log and zap loggers.
+func isExitCall(call *dst.CallExpr, pkg *decorator.Package) bool {
+	switch fun := call.Fun.(type) {
+	case *dst.Ident:
+		return (fun.Path == "os" && fun.Name == "Exit") || (fun.Path == "log" && strings.HasPrefix(fun.Name, "Fatal"))
+	case *dst.SelectorExpr:
+		if !strings.HasPrefix(fun.Sel.Name, "Fatal") || pkg == nil || pkg.TypesInfo == nil {
+			return false
+		}
+		astExpr, ok := pkg.Decorator.Ast.Nodes[fun.X].(ast.Expr)
+		if !ok {
+			return false
+		}
+		t := pkg.TypesInfo.TypeOf(astExpr)
+		if t == nil {
+			return false
+		}
+		switch t.String() {
+		case loggerLog, loggerZap, loggerZapSugared:
+			return true
+		}
+	}
+	return false
+}
+
+// isExitStmt returns true if a statement is a call that exits the program.
+func isExitStmt(stmt dst.Stmt, pkg *decorator.Package) bool {
+	exprStmt, ok := stmt.(*dst.ExprStmt)
+	if !ok {
+		return false
+	}
+	call, ok := exprStmt.X.(*dst.CallExpr)
+	return ok && isExitCall(call, pkg)
+}
+
+// signalReceivers returns the variables that signals are delivered through in a function: the channels passed to
+// signal.Notify, and the contexts created by signal.NotifyContext.
+func signalReceivers(body *dst.BlockStmt) map[string]bool {
+	receivers := map[string]bool{}
+	dst.Inspect(body, func(n dst.Node) bool {
+		switch v := n.(type) {
+		case *dst.CallExpr:
+			fun, ok := v.Fun.(*dst.Ident)
+			if !ok || fun.Path != signalPath || fun.Name != "Notify" || len(v.Args) == 0 {
+				return true
+			}
+			if ident, ok := v.Args[0].(*dst.Ident); ok {
+				receivers[ident.Name] = true
+			}
+		case *dst.AssignStmt:
+			if len(v.Rhs) != 1 || len(v.Lhs) == 0 {
+				return true
+			}
+			call, ok := v.Rhs[0].(*dst.CallExpr)
+			if !ok {
+				return true
+			}
+			if fun, ok := call.Fun.(*dst.Ident); ok && fun.Path == signalPath && fun.Name == "NotifyContext" {
+				if ident, ok := v.Lhs[0].(*dst.Ident); ok && ident.Name != "_" {
+					receivers[ident.Name] = true
+				}
+			}
+		}
+		return true
+	})
+	return receivers
+}
+
+// receivesSignal returns true if a statement waits for a signal: <-quit, sig := <-quit, or <-ctx.Done()
+func receivesSignal(stmt dst.Stmt, receivers map[string]bool) bool {
+	var expr dst.Expr
+	switch v := stmt.(type) {
+	case *dst.ExprStmt:
+		expr = v.X
+	case *dst.AssignStmt:
+		if len(v.Rhs) != 1 {
+			return false
+		}
+		expr = v.Rhs[0]
+	default:
+		return false
+	}
+
+	recv, ok := expr.(*dst.UnaryExpr)
+	if !ok || recv.Op != token.ARROW {
+		return false
+	}
+	switch x := recv.X.(type) {
+	case *dst.Ident:
+		return receivers[x.Name]
+	case *dst.CallExpr:
+		sel, ok := x.Fun.(*dst.SelectorExpr)
+		if !ok || sel.Sel.Name != "Done" {
+			return false
+		}
+		ident, ok := sel.X.(*dst.Ident)
+		return ok && receivers[ident.Name]
+	}
+	return false
+}
+
+// signalHandler returns the function literal a goroutine runs if it waits for a signal to shut the program down.
+func signalHandler(goStmt *dst.GoStmt, receivers map[string]bool) *dst.FuncLit {
+	lit, ok := goStmt.Call.Fun.(*dst.FuncLit)
+	if !ok || len(receivers) == 0 {
+		return nil
+	}
+	for _, stmt := range lit.Body.List {
+		if receivesSignal(stmt, receivers) {
+			return lit
+		}
+	}
+	return nil
+}
+
+// releasesWaiter returns true if a statement can release a function waiting on a channel: a send on the channel, or
+// closing it.
+func releasesWaiter(stmt dst.Stmt) bool {
+	switch v := stmt.(type) {
+	case *dst.SendStmt:
+		return true
+	case *dst.ExprStmt:
+		call, ok := v.X.(*dst.CallExpr)
+		if !ok {
+			return false
+		}
+		fun, ok := call.Fun.(*dst.Ident)
+		return ok && fun.Name == "close" && fun.Path == ""
+	}
+	return false
+}
+
+// ShutdownOnExit shuts the application down on the exit paths of the function it is created in that do not run
+// deferred functions: before calls to os.Exit and log.Fatal, and in goroutines that handle the signals the program
+// is shut down with, before they release main or at their end. Only statements after the application is created are
+// changed.
+func ShutdownOnExit(manager *InstrumentationManager, fn *dst.FuncDecl, options AgentOptions) {
+	index := agentShutdownIndex(fn, manager.agentVariableName)
+	if index < 0 {
+		return
+	}
+	pkg := manager.GetDecoratorPackage()
+	receivers := signalReceivers(fn.Body)
+	timeout := options.shutdownTimeout()
+
+	dstutil.Apply(fn.Body, func(c *dstutil.Cursor) bool {
+		return c.Parent() != fn.Body || c.Index() > index
+	}, func(c *dstutil.Cursor) bool {
+		switch v := c.Node().(type) {
+		case *dst.GoStmt:
+			lit := signalHandler(v, receivers)
+			if lit == nil {
+				return true
+			}
+			list := lit.Body.List
+			if len(list) > 0 && isExitStmt(list[len(list)-1], pkg) {
+				return true
+			}
+			// main can return as soon as the goroutine releases it, so the application is shut down before
+			for i, stmt := range list {
+				if releasesWaiter(stmt) {
+					updated := append([]dst.Stmt{}, list[:i]...)
+					updated = append(updated, shutdownAgent(manager.agentVariableName, timeout))
+					lit.Body.List = append(updated, list[i:]...)
+					return true
+				}
+			}
+			lit.Body.List = append(list, shutdownAgent(manager.agentVariableName, timeout))
+		case *dst.ExprStmt:
+			// always check c.Index >= 0 to avoid panics when using c.Insert methods
+			if isExitStmt(v, pkg) && c.Index() >= 0 {
+				c.InsertBefore(shutdownAgent(manager.agentVariableName, timeout))
+			}
+		}
+		return true
+	})
+}
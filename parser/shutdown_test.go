@@ -0,0 +1,187 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ShutdownOnExit(t *testing.T) {
+	tests := []struct {
+		name           string
+		code           string
+		timeout        time.Duration
+		wantContain    []string
+		wantNotContain []string
+	}{
+		{
+			name: "defer_shutdown",
+			code: `
+package main
+import "fmt"
+func main() {
+	if len("x") > 0 {
+		return
+	}
+	fmt.Println("done")
+}
+`,
+			wantContain: []string{
+				"panic(nrErr)\n\t}\n\n\tdefer NewRelicAgent.Shutdown(5 * time.Second)\n",
+			},
+			wantNotContain: []string{
+				"\tNewRelicAgent.Shutdown(5 * time.Second)\n}",
+			},
+		},
+		{
+			name: "exit_calls",
+			code: `
+package main
+import (
+	"log"
+	"os"
+)
+func main() {
+	logger := log.New(os.Stderr, "", 0)
+	if len(os.Args) > 2 {
+		logger.Fatalf("too many arguments: %d", len(os.Args))
+	}
+	if len(os.Args) > 1 {
+		os.Exit(2)
+	}
+	log.Fatal("done")
+}
+`,
+			timeout: 10 * time.Second,
+			wantContain: []string{
+				"NewRelicAgent.Shutdown(10 * time.Second)\n\t\tlogger.Fatalf(",
+				"NewRelicAgent.Shutdown(10 * time.Second)\n\t\tos.Exit(2)",
+				"NewRelicAgent.Shutdown(10 * time.Second)\n\tlog.Fatal(\"done\")",
+			},
+		},
+		{
+			name: "signal_handler",
+			code: `
+package main
+import (
+	"fmt"
+	"os"
+	"os/signal"
+)
+func main() {
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt)
+	done := make(chan bool)
+	go func() {
+		<-quit
+		fmt.Println("shutting down")
+		close(done)
+	}()
+	<-done
+}
+`,
+			wantContain: []string{
+				"fmt.Println(\"shutting down\")\n\t\tNewRelicAgent.Shutdown(5 * time.Second)\n\t\tclose(done)\n\t}()",
+			},
+			wantNotContain: []string{
+				"close(done)\n\t\tNewRelicAgent.Shutdown",
+			},
+		},
+		{
+			name: "signal_handler_sends",
+			code: `
+package main
+import (
+	"fmt"
+	"os"
+	"os/signal"
+)
+func main() {
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt)
+	done := make(chan bool)
+	go func() {
+		<-quit
+		done <- true
+		fmt.Println("released")
+	}()
+	<-done
+}
+`,
+			wantContain: []string{
+				"<-quit\n\t\tNewRelicAgent.Shutdown(5 * time.Second)\n\t\tdone <- true\n",
+			},
+			wantNotContain: []string{
+				"fmt.Println(\"released\")\n\t\tNewRelicAgent.Shutdown",
+			},
+		},
+		{
+			name: "signal_context",
+			code: `
+package main
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+)
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		fmt.Println("shutting down")
+		os.Exit(0)
+	}()
+	select {}
+}
+`,
+			wantContain: []string{
+				"NewRelicAgent.Shutdown(5 * time.Second)\n\t\tos.Exit(0)\n\t}()",
+			},
+			wantNotContain: []string{
+				"os.Exit(0)\n\t\tNewRelicAgent.Shutdown",
+			},
+		},
+		{
+			name: "unrelated_goroutine",
+			code: `
+package main
+import "fmt"
+func main() {
+	done := make(chan bool)
+	go func() {
+		<-done
+		fmt.Println("done")
+	}()
+	done <- true
+}
+`,
+			wantNotContain: []string{
+				"fmt.Println(\"done\")\n\t\tNewRelicAgent.Shutdown",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, tt.code)
+			manager.agentOptions.ShutdownTimeout = duration(tt.timeout)
+			if err := tracePackageFunctionCalls(manager); err != nil {
+				t.Fatal(err)
+			}
+			instrumentPackages(manager, InstrumentMain)
+
+			got := restoreTestFile(t, manager.GetDecoratorPackage().Syntax[0])
+			for _, want := range tt.wantContain {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected instrumented code to contain %q, but got:\n%s", want, got)
+				}
+			}
+			for _, notWant := range tt.wantNotContain {
+				if strings.Contains(got, notWant) {
+					t.Errorf("expected instrumented code not to contain %q, but got:\n%s", notWant, got)
+				}
+			}
+		})
+	}
+}
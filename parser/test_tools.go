@@ -3,12 +3,15 @@
 package main
 
 import (
+	"bytes"
 	"os"
 	"path/filepath"
 	"runtime/debug"
 	"testing"
 
+	"github.com/dave/dst"
 	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/decorator/resolver/guess"
 	"golang.org/x/tools/go/packages"
 )
 
@@ -66,3 +69,52 @@ func newTestingInstrumentationManager(t *testing.T, code string) *Instrumentatio
 	manager.SetPackage("parser/tmp")
 	return manager
 }
+
+// newTestingMultiPackageManager creates an instrumentation manager for an application made of several packages, from
+// the code of its files by their path relative to the application, ex: "server/server.go". The main package is
+// expected at the root of the application, and is the current package of the manager.
+func newTestingMultiPackageManager(t *testing.T, files map[string]string) *InstrumentationManager {
+	defer panicRecovery(t)
+
+	testAppDir := "tmp"
+	defer cleanupTestApp(t, testAppDir)
+	for name, code := range files {
+		path := filepath.Join(testAppDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(code), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pkgs, err := decorator.Load(&packages.Config{Dir: testAppDir, Mode: loadMode}, "./...")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffFile := filepath.Join(testAppDir, defaultDiffFileName)
+	manager := NewInstrumentationManager(pkgs, defaultAppName, defaultAgentVariableName, diffFile, testAppDir)
+	manager.SetPackage("parser/tmp")
+	return manager
+}
+
+// testPackageNames maps import paths to package names for packages that the name of can not be guessed from the path
+var testPackageNames = map[string]string{
+	"github.com/elastic/go-elasticsearch/v7": "elasticsearch",
+	"github.com/elastic/go-elasticsearch/v8": "elasticsearch",
+	nrElasticsearchImport:                    "nrelasticsearch",
+	UrfaveCliV2:                              "cli",
+	UrfaveCliV3:                              "cli",
+	CronPath:                                 "cron",
+}
+
+// restoreTestFile prints the source code of a file, with its imports updated to match the code.
+func restoreTestFile(t *testing.T, file *dst.File) string {
+	buf := bytes.NewBuffer([]byte{})
+	r := decorator.NewRestorerWithImports("tmp", guess.WithMap(testPackageNames))
+	if err := r.Fprint(buf, file); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
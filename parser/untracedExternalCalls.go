@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/types"
+	"log"
+	"path/filepath"
+	"sort"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+)
+
+// modes for handling external calls made in functions that are not traced by a transaction
+const (
+	untracedCallsReport      = "report"      // list the calls after instrumenting the application
+	untracedCallsTransaction = "transaction" // start a background transaction in the functions that make them
+	untracedCallsIgnore      = "ignore"
+)
+
+// untracedExternalCall is an external call that is not made inside of a transaction, and can not be traced.
+type untracedExternalCall struct {
+	position string // file and line of the call, relative to the application
+	function string // name of the function the call is made in
+	call     string // the function or method called, ex: "client.Do"
+}
+
+// externalCallMethods are the methods of http clients that make external calls
+var externalCallMethods = map[string]bool{
+	HttpDo:       true,
+	HttpGet:      true,
+	HttpPost:     true,
+	HttpHead:     true,
+	HttpPostForm: true,
+}
+
+// isExternalCall returns true if a call sends a request with net/http or a fasthttp client.
+func isExternalCall(call *dst.CallExpr, pkg *decorator.Package) bool {
+	switch fun := call.Fun.(type) {
+	case *dst.Ident:
+		return fun.Path == NetHttp && externalCallMethods[fun.Name] && fun.Name != HttpDo
+	case *dst.SelectorExpr:
+		if !externalCallMethods[fun.Sel.Name] {
+			return false
+		}
+		if isClient, _ := isNetHttpClientType(fun.X, pkg); isClient {
+			return true
+		}
+		if fun.Sel.Name != FastHttpDo || pkg == nil || pkg.TypesInfo == nil {
+			return false
+		}
+		astExpr, ok := pkg.Decorator.Ast.Nodes[fun.X].(ast.Expr)
+		if !ok {
+			return false
+		}
+		t := pkg.TypesInfo.TypeOf(astExpr)
+		return t != nil && (t.String() == FastHttpPath+"."+FastHttpClient || t.String() == "*"+FastHttpPath+"."+FastHttpClient)
+	}
+	return false
+}
+
+// findExternalCalls returns the external calls made in a function. Calls made by http handler literals are
+// not included, since they are traced by the transaction of the request they serve.
+func findExternalCalls(fn *dst.FuncDecl, pkg *decorator.Package) []*dst.CallExpr {
+	calls := []*dst.CallExpr{}
+	dst.Inspect(fn.Body, func(n dst.Node) bool {
+		switch v := n.(type) {
+		case *dst.FuncLit:
+			return !isHttpHandlerLit(v, pkg)
+		case *dst.CallExpr:
+			if isExternalCall(v, pkg) {
+				calls = append(calls, v)
+			}
+		}
+		return true
+	})
+	return calls
+}
+
+// funcDeclName returns the name of a function, prefixed by the type of its receiver if it is a method.
+func funcDeclName(fn *dst.FuncDecl) string {
+	if fn.Recv == nil || len(fn.Recv.List) == 0 {
+		return fn.Name.Name
+	}
+	recv := fn.Recv.List[0].Type
+	if star, ok := recv.(*dst.StarExpr); ok {
+		recv = star.X
+	}
+	if index, ok := recv.(*dst.IndexExpr); ok {
+		recv = index.X
+	}
+	if ident, ok := recv.(*dst.Ident); ok {
+		return ident.Name + "." + fn.Name.Name
+	}
+	return fn.Name.Name
+}
+
+// isTracedFunction returns true if a function declaration has been traced by a transaction.
+func (m *InstrumentationManager) isTracedFunction(fn *dst.FuncDecl) bool {
+	state, ok := m.packages[m.currentPackage]
+	if !ok {
+		return false
+	}
+	decl, ok := state.tracedDecls[funcDeclName(fn)]
+	return ok && decl == fn
+}
+
+// UntracedExternalCalls returns how external calls made outside of a transaction are handled.
+func (m *InstrumentationManager) UntracedExternalCalls() string {
+	if m.untracedExternalCalls == "" {
+		return untracedCallsReport
+	}
+	return m.untracedExternalCalls
+}
+
+// startBackgroundTransaction traces a function that makes external calls outside of a transaction, and
+// starts a background transaction named after it that lasts for the duration of the function call.
+// The transaction is nil, and the calls are not recorded, if the function is called before the application is created.
+func (m *InstrumentationManager) startBackgroundTransaction(fn *dst.FuncDecl) bool {
+	if !m.canShareApplication(fn) {
+		return false
+	}
+
+	newFn, ok := TraceFunction(m, fn, defaultTxnName)
+	if !ok {
+		return false
+	}
+	m.shareApplication()
+
+	txnStart := startTransaction(backgroundAppVariable, defaultTxnName, funcDeclName(newFn), false)
+	txnEnd := &dst.DeferStmt{
+		Call: endTransaction(defaultTxnName).X.(*dst.CallExpr),
+		Decs: dst.DeferStmtDecorations{
+			NodeDecs: dst.NodeDecs{
+				After: dst.EmptyLine,
+			},
+		},
+	}
+	newFn.Body.List = append([]dst.Stmt{txnStart, txnEnd}, newFn.Body.List...)
+	m.AddImport(newrelicAgentImport)
+	return true
+}
+
+// externalCallPosition returns the file and line an external call is made at, relative to the application.
+func (m *InstrumentationManager) externalCallPosition(call *dst.CallExpr, pkg *decorator.Package) string {
+	astCall, ok := pkg.Decorator.Ast.Nodes[call]
+	if !ok || pkg.Fset == nil {
+		return "unknown position"
+	}
+	position := pkg.Fset.Position(astCall.Pos())
+	fileName := position.Filename
+	if absAppPath, err := filepath.Abs(m.userAppPath); err == nil {
+		if rel, err := filepath.Rel(absAppPath, fileName); err == nil {
+			fileName = rel
+		}
+	}
+	return fmt.Sprintf("%s:%d", fileName, position.Line)
+}
+
+// externalCallName returns the source of the function or method an external call is made to.
+func externalCallName(call *dst.CallExpr, pkg *decorator.Package) string {
+	if ident, ok := call.Fun.(*dst.Ident); ok && ident.Path == NetHttp {
+		return "http." + ident.Name
+	}
+	if astFun, ok := pkg.Decorator.Ast.Nodes[call.Fun].(ast.Expr); ok {
+		return types.ExprString(astFun)
+	}
+	if sel, ok := call.Fun.(*dst.SelectorExpr); ok {
+		return sel.Sel.Name
+	}
+	return ""
+}
+
+// InstrumentUntracedExternalCalls finds external calls made in functions that are not traced by a transaction.
+// Depending on the mode chosen by the user, background transactions are started in the functions that make them.
+// The calls that are not instrumented are returned, so that they can be reported.
+func (m *InstrumentationManager) InstrumentUntracedExternalCalls() []untracedExternalCall {
+	mode := m.UntracedExternalCalls()
+	if mode == untracedCallsIgnore {
+		return nil
+	}
+
+	pkgNames := make([]string, 0, len(m.packages))
+	for name := range m.packages {
+		pkgNames = append(pkgNames, name)
+	}
+	sort.Strings(pkgNames)
+
+	untraced := []untracedExternalCall{}
+	for _, pkgName := range pkgNames {
+		m.SetPackage(pkgName)
+		pkg := m.packages[pkgName].pkg
+		for _, file := range pkg.Syntax {
+			for _, decl := range file.Decls {
+				fn, ok := decl.(*dst.FuncDecl)
+				if !ok || fn.Body == nil || m.isTracedFunction(fn) {
+					continue
+				}
+				calls := findExternalCalls(fn, pkg)
+				if len(calls) == 0 {
+					continue
+				}
+				if mode == untracedCallsTransaction && m.startBackgroundTransaction(fn) {
+					continue
+				}
+				for _, call := range calls {
+					untraced = append(untraced, untracedExternalCall{
+						position: m.externalCallPosition(call, pkg),
+						function: funcDeclName(fn),
+						call:     externalCallName(call, pkg),
+					})
+				}
+			}
+		}
+	}
+	return untraced
+}
+
+// reportUntracedExternalCalls logs the external calls that are not made inside of a transaction.
+func reportUntracedExternalCalls(calls []untracedExternalCall, mode string) {
+	if len(calls) == 0 {
+		return
+	}
+	log.Printf("uninstrumented external calls (%d):", len(calls))
+	for _, call := range calls {
+		log.Printf("  %s: %s in %s", call.position, call.call, call.function)
+	}
+	if mode == untracedCallsReport {
+		log.Printf("these calls are not made inside of a transaction; use -untraced-external-calls=%s to start background transactions for them", untracedCallsTransaction)
+	}
+}
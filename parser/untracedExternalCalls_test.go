@@ -0,0 +1,190 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dave/dst"
+)
+
+func Test_funcDeclName(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want string
+	}{
+		{
+			name: "function",
+			code: `
+package main
+func fetch() {}`,
+			want: "fetch",
+		},
+		{
+			name: "pointer_receiver",
+			code: `
+package main
+type poller struct{}
+func (p *poller) poll() {}`,
+			want: "poller.poll",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, tt.code)
+			decls := manager.GetDecoratorPackage().Syntax[0].Decls
+			fn := decls[len(decls)-1].(*dst.FuncDecl)
+			if got := funcDeclName(fn); got != tt.want {
+				t.Errorf("funcDeclName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_InstrumentUntracedExternalCalls(t *testing.T) {
+	tests := []struct {
+		name           string
+		code           string
+		mode           string
+		wantContain    []string
+		wantNotContain []string
+		wantUntraced   []string
+	}{
+		{
+			name: "report_orphan_call",
+			code: `
+package main
+import "net/http"
+func main() {
+	go poll()
+}
+func poll() {
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	http.DefaultClient.Do(req)
+}`,
+			mode:           untracedCallsReport,
+			wantNotContain: []string{"nrApp"},
+			wantUntraced:   []string{"http.DefaultClient.Do in poll"},
+		},
+		{
+			name: "background_transaction",
+			code: `
+package main
+import "net/http"
+func main() {
+	go poll()
+}
+func poll() {
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	http.DefaultClient.Do(req)
+}`,
+			mode: untracedCallsTransaction,
+			wantContain: []string{
+				"nrApp = NewRelicAgent",
+				`nrTxn := nrApp.StartTransaction("poll")`,
+				"defer nrTxn.End()",
+				"externalSegment := newrelic.StartExternalSegment(nrTxn, req)",
+				"var nrApp *newrelic.Application",
+			},
+		},
+		{
+			name: "calls_in_main_are_reported",
+			code: `
+package main
+import "net/http"
+func main() {
+	http.Get("http://example.com")
+}`,
+			mode:           untracedCallsTransaction,
+			wantNotContain: []string{"nrApp"},
+			wantUntraced:   []string{"http.Get in main"},
+		},
+		{
+			name: "traced_call",
+			code: `
+package main
+import "net/http"
+func main() {
+	fetch()
+}
+func fetch() {
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	http.DefaultClient.Do(req)
+}`,
+			mode:           untracedCallsReport,
+			wantNotContain: []string{"nrApp"},
+		},
+		{
+			name: "methods_sharing_a_name",
+			code: `
+package main
+import "net/http"
+type users struct{}
+func (u *users) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req, _ := http.NewRequest("GET", "http://users.example", nil)
+	http.DefaultClient.Do(req)
+}
+type orders struct{}
+func (o *orders) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req, _ := http.NewRequest("GET", "http://orders.example", nil)
+	http.DefaultClient.Do(req)
+}
+func main() {
+	http.Handle("/users", &users{})
+	http.Handle("/orders", &orders{})
+	http.ListenAndServe(":8000", nil)
+}`,
+			mode:           untracedCallsTransaction,
+			wantNotContain: []string{`StartTransaction("users.ServeHTTP")`, `StartTransaction("orders.ServeHTTP")`},
+		},
+		{
+			name: "ignore",
+			code: `
+package main
+import "net/http"
+func main() {
+	go poll()
+}
+func poll() {
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	http.DefaultClient.Do(req)
+}`,
+			mode:           untracedCallsIgnore,
+			wantNotContain: []string{"nrApp"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, tt.code)
+			manager.untracedExternalCalls = tt.mode
+			if err := tracePackageFunctionCalls(manager); err != nil {
+				t.Fatal(err)
+			}
+			instrumentPackages(manager, InstrumentMain, InstrumentHandleFunction)
+			untraced := manager.InstrumentUntracedExternalCalls()
+			manager.writeHelpers()
+
+			got := restoreTestFile(t, manager.GetDecoratorPackage().Syntax[0])
+			for _, want := range tt.wantContain {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected instrumented code to contain %q, but got:\n%s", want, got)
+				}
+			}
+			for _, notWant := range tt.wantNotContain {
+				if strings.Contains(got, notWant) {
+					t.Errorf("expected instrumented code not to contain %q, but got:\n%s", notWant, got)
+				}
+			}
+
+			if len(untraced) != len(tt.wantUntraced) {
+				t.Fatalf("expected %d untraced external calls, but got %+v", len(tt.wantUntraced), untraced)
+			}
+			for i, want := range tt.wantUntraced {
+				if got := untraced[i].call + " in " + untraced[i].function; got != want {
+					t.Errorf("untraced external call = %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}